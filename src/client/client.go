@@ -1,93 +1,409 @@
 package main
 
 import (
-	"crypto/x509"
+	"bytes"
+	"context"
 	"crypto/tls"
-	"io/ioutil"
-	"strconv"
+	"errors"
+	"fmt"
 	"github.com/jpillora/backoff"
+	"github.com/kz/swanntools/src/spool"
+	"github.com/kz/swanntools/src/tunnel"
 	"time"
 	log "github.com/Sirupsen/logrus"
 	"net"
 )
 
-// Server responses
-const (
-	SuccessfulClientAuthString = "200"
-	FailedClientAuthString     = "403"
-	InvalidChannelString       = "400"
-	ChannelInUseString         = "409"
-)
-
-// client represents the local machine sending the DVR stream
+// client represents the local machine sending the DVR streams of every channel over a single session
 type client struct {
-	conn    *tls.Conn   // conn is the TCP (w/ TLS) connection to the server
-	send    chan []byte // send is the channel on which messages are sent
-	channel *int        // channel is the channel number of the stream
+	session  *session               // session is the session with the server, or nil while it is unreachable
+	sessions chan *session          // sessions receives the session once the server is reachable again
+	send     chan *tunnel.Message   // send is the channel on which messages are sent
+	spool    *spool.Spool           // spool holds messages while the server is unreachable, or nil to drop them
+	dropped  int                    // dropped is the number of messages dropped while the server was unreachable
+	inflight []inflight             // inflight are the data messages sent but not yet acknowledged, oldest first
+	acks     chan ack               // acks receives the acknowledgements sent by the server
+	lastAck  time.Time              // lastAck is when the server last acknowledged messages, or the session started
+	streams  []*tunnel.Open         // streams are the channels to open, where stream ID i+1 carries streams[i]
+	ids      map[tunnel.Open]uint16 // ids are the stream IDs of the streams, keyed by channel and named site
+	numbered map[uint16]uint64      // numbered holds the sequence number of the last frame numbered on each stream
+	ctx      context.Context        // ctx stops reconnecting to the server once it is cancelled
+}
+
+// session is an authenticated session with the server
+type session struct {
+	conn   *tls.Conn         // conn is the TCP (w/ TLS) connection to the server
+	tunnel *tunnel.Conn      // tunnel sends and receives messages on conn
+	caps   tunnel.Capability // caps are the optional protocol features used on the session
+	resume map[uint16]uint64 // resume holds the sequence number of the last frame the server has of each stream
+}
+
+// inflight is a data message which has been sent but not acknowledged
+type inflight struct {
+	stream   uint16          // stream is the ID of the stream of the message
+	sequence uint64          // sequence is the sequence number of the frame in the message
+	message  *tunnel.Message // message is the message as it was created by the stream
 }
 
-// Client creates a new client struct
-func Client(channel *int) *client {
-	c := &client{channel: channel}
-	c.conn = c.newServerConnection()
-	c.send = make(chan []byte, socketBufferSize)
+// ack acknowledges every data message of a stream up to a sequence number
+type ack struct {
+	stream   uint16 // stream is the ID of the acknowledged stream
+	sequence uint64 // sequence is the sequence number of the last acknowledged frame
+}
+
+// Client creates a new client struct which connects to the server in the background until the context is cancelled,
+// holding messages in sp until the session carrying the streams is authenticated
+func Client(ctx context.Context, streams []*tunnel.Open, sp *spool.Spool) *client {
+	c := &client{streams: streams, spool: sp, ids: make(map[tunnel.Open]uint16), numbered: make(map[uint16]uint64)}
+	for i, open := range streams {
+		c.ids[spooledOpen(open)] = streamID(i)
+	}
+	c.send = make(chan *tunnel.Message, socketBufferSize)
+	c.sessions = make(chan *session)
+	c.acks = make(chan ack, socketBufferSize)
+	c.ctx = ctx
+	go c.connect(ctx)
 	return c
 }
 
-// Handle handles events such as messages being sent
+// streamID returns the ID of the stream at index i of the streams
+func streamID(i int) uint16 {
+	return uint16(i + 1)
+}
+
+// connect establishes a new session with the server and passes it to the handler, giving up once the context is
+// cancelled
+func (c *client) connect(ctx context.Context) {
+	s := c.newServerConnection(ctx)
+	if s == nil {
+		return
+	}
+	if s.caps.Has(tunnel.CapAck) {
+		go s.readAcks(c.acks)
+	}
+	select {
+	case c.sessions <- s:
+	case <-ctx.Done():
+		s.conn.Close()
+	}
+}
+
+// Handle handles events such as messages being sent. Messages are held while the server is unreachable and replayed
+// in order once it is reachable again, after resending those the server did not acknowledge. Handle returns once the
+// send channel is closed and the messages sent on it have been drained.
 func (c *client) Handle() {
+events:
 	for {
+		// Hold messages until the session is established
+		if c.session == nil {
+			select {
+			case message, ok := <-c.send:
+				if !ok {
+					break events
+				}
+				c.hold(message)
+			case a := <-c.acks:
+				c.acknowledge(a)
+			case s := <-c.sessions:
+				c.session = s
+				c.lastAck = time.Now()
+				if c.dropped > 0 {
+					log.Warnf("Dropped %d messages while the server was unreachable", c.dropped)
+					c.dropped = 0
+				}
+				c.resend()
+				if c.spool != nil && !c.spool.Empty() {
+					log.Infof("Replaying %d bytes of spooled messages...", c.spool.Size())
+				}
+			}
+			continue
+		}
+
+		// Wait for acknowledgements once too many messages are unacknowledged, holding new messages meanwhile
+		if len(c.inflight) >= maxUnacked {
+			select {
+			case message, ok := <-c.send:
+				if !ok {
+					break events
+				}
+				c.hold(message)
+			case a := <-c.acks:
+				c.acknowledge(a)
+			case <-time.After(timeout - time.Since(c.lastAck)):
+				c.disconnect(errors.New("the server stopped acknowledging messages"))
+			}
+			continue
+		}
+
+		// Replay held messages before sending new ones so that frames stay in order
+		if c.spool != nil && !c.spool.Empty() {
+			select {
+			case message, ok := <-c.send:
+				if !ok {
+					break events
+				}
+				c.hold(message)
+			case a := <-c.acks:
+				c.acknowledge(a)
+			default:
+				c.replay()
+			}
+			continue
+		}
+
 		select {
-		// Handles sending of video stream data to the server
-		case message := <-c.send:
-			// Update the deadline for the server connection
-			c.conn.SetDeadline(time.Now().Add(timeout))
-			// Write the data to the server
-			_, err := c.conn.Write(message)
-			if err != nil {
-				log.Warnln("Error occurred while writing to server: ", err.Error())
-				log.Infoln("Attempting to reestablish connection...")
-				// Close the connection
-				c.conn.Close()
-				// Reattempt the connection
-				c.conn = c.newServerConnection()
-				// Loop again
-				continue
+		// Handles sending of messages to the server
+		case message, ok := <-c.send:
+			if !ok {
+				break events
+			}
+			if err := c.write(message); err != nil {
+				c.hold(message)
 			}
+		// Handles acknowledgements from the server
+		case a := <-c.acks:
+			c.acknowledge(a)
+		}
+	}
+	c.finish()
+}
+
+// finish waits for the server to acknowledge the messages it was sent, holding those it does not acknowledge in time
+// ahead of the spool so that the next run sends them first, then closes the session and the spool
+func (c *client) finish() {
+	if c.session != nil && len(c.inflight) > 0 {
+		log.Infof("Waiting for the server to acknowledge %d messages...", len(c.inflight))
+		deadline := time.After(timeout)
+	acks:
+		for len(c.inflight) > 0 {
+			select {
+			case a := <-c.acks:
+				c.acknowledge(a)
+			case <-deadline:
+				break acks
+			}
+		}
+	}
+	if len(c.inflight) > 0 {
+		log.Warnf("The server did not acknowledge %d messages", len(c.inflight))
+		c.holdInflight()
+	}
+
+	if c.session != nil {
+		c.session.conn.Close()
+		c.session = nil
+	}
+	if c.spool != nil {
+		if !c.spool.Empty() {
+			log.WithField("Path", config.spool).Infof("Kept %d bytes of spooled messages for the next run",
+				c.spool.Size())
+		}
+		if err := c.spool.Close(); err != nil {
+			log.Warnln("Unable to close the spool: ", err.Error())
+		}
+	}
+}
+
+// write sends a message on the session, disconnecting on error. Data messages are numbered when they are first sent
+// and kept until the server acknowledges them.
+func (c *client) write(message *tunnel.Message) error {
+	// Messages are created with every feature of the client, so remove those the server does not use
+	wire := message
+	var data *tunnel.Data
+	if message.Type == tunnel.MsgData {
+		var err error
+		if data, err = message.Data(tunnel.Capabilities); err != nil {
+			log.Warnln("Dropping invalid message: ", err.Error())
+			return nil
+		}
+		if c.number(message.Stream, data) {
+			message = data.Message(message.Stream, tunnel.Capabilities)
+		}
+		wire = data.Message(message.Stream, c.session.caps)
+	}
+	acked := data != nil && c.session.caps.Has(tunnel.CapAck)
+
+	// Update the deadline for the server connection
+	c.session.conn.SetWriteDeadline(time.Now().Add(timeout))
+	// Write the message to the server
+	if err := c.session.tunnel.Send(wire); err != nil {
+		c.disconnect(err)
+		return err
+	}
+
+	if acked {
+		c.inflight = append(c.inflight, inflight{stream: message.Stream, sequence: data.Sequence, message: message})
+	}
+	return nil
+}
+
+// number numbers a frame of the stream which has not been sent yet, reporting whether it did so. Frames are numbered
+// after the last frame numbered on the stream or the last frame the server has of it, whichever is later, so that
+// the numbers keep increasing when either the client or the server restarts. Frames which were numbered by an
+// earlier session or run, such as those resent or replayed from the spool, keep their numbers.
+func (c *client) number(stream uint16, data *tunnel.Data) bool {
+	last := c.numbered[stream]
+	if data.Sequence != 0 {
+		if data.Sequence > last {
+			c.numbered[stream] = data.Sequence
+		}
+		return false
+	}
+	if resume := c.session.resume[stream]; resume > last {
+		last = resume
+	}
+	data.Sequence = last + 1
+	c.numbered[stream] = data.Sequence
+	return true
+}
+
+// disconnect closes the session after an error and reconnects in the background
+func (c *client) disconnect(err error) {
+	log.Warnln("Error occurred while writing to server: ", err.Error())
+	log.Infoln("Attempting to reestablish connection...")
+	// Close the connection
+	c.session.conn.Close()
+	c.session = nil
+	// Reattempt the connection without holding up the streams
+	go c.connect(c.ctx)
+}
+
+// acknowledge forgets the messages the server has acknowledged
+func (c *client) acknowledge(a ack) {
+	kept := c.inflight[:0]
+	for _, f := range c.inflight {
+		if f.stream != a.stream || f.sequence > a.sequence {
+			kept = append(kept, f)
+		}
+	}
+	c.inflight = kept
+	c.lastAck = time.Now()
+}
+
+// resend sends the messages which were not acknowledged on the last session, skipping those the server already has
+func (c *client) resend() {
+	pending := c.inflight
+	c.inflight = nil
+	resent := 0
+	for i, f := range pending {
+		if f.sequence <= c.session.resume[f.stream] {
+			continue
 		}
+		if c.write(f.message) != nil {
+			// Keep the rest for the next session
+			c.inflight = append(c.inflight, pending[i:]...)
+			return
+		}
+		resent++
+	}
+	if resent > 0 {
+		log.Infof("Resent %d messages which the server did not receive", resent)
 	}
 }
 
-// newServerConnection creates a new TLS connection with the server
-func (c *client) newServerConnection() *tls.Conn {
-	////////////////////////////
-	// 1. Handle certificates //
-	////////////////////////////
+// readAcks passes the acknowledgements sent by the server to acks until the session is closed
+func (s *session) readAcks(acks chan<- ack) {
+	// Acknowledgements only arrive while messages are sent, so wait for them for as long as the session is open
+	s.conn.SetReadDeadline(time.Time{})
+	for {
+		m, err := s.tunnel.Receive()
+		if err != nil {
+			// The session is closed and replaced by the handler once writing fails
+			return
+		}
+		sequence, err := m.Sequence()
+		if m.Type != tunnel.MsgAck || err != nil {
+			log.WithField("type", m.Type).Warnln("Ignoring unexpected message from server")
+			continue
+		}
+		acks <- ack{stream: m.Stream, sequence: sequence}
+	}
+}
 
-	// Load client key pair for TLS connection
-	clientCerts, err := tls.LoadX509KeyPair(config.certs+"/client.pem", config.certs+"/client.key")
+// hold keeps a message which cannot be sent yet in the spool, or drops it if spooling is disabled
+func (c *client) hold(message *tunnel.Message) {
+	if c.spool == nil {
+		if c.dropped == 0 {
+			log.Warnln("Dropping messages until the server is reachable, use --spool to keep them")
+		}
+		c.dropped++
+		return
+	}
+
+	record, err := c.spoolRecord(message)
+	if err == nil {
+		err = c.spool.Append(record)
+	}
 	if err != nil {
-		log.Fatalln("Unable to load client key pair")
+		log.Warnln("Unable to spool message: ", err.Error())
+	}
+	if dropped := c.spool.Dropped(); dropped > 0 {
+		log.Warnf("The spool is full, dropped the oldest %d bytes", dropped)
+	}
+}
+
+// holdInflight keeps the messages which the server did not acknowledge ahead of those in the spool, which were sent
+// to the handler after them, so that the next run sends them first just as a new session resends them before
+// replaying the spool
+func (c *client) holdInflight() {
+	pending := c.inflight
+	c.inflight = nil
+	if c.spool == nil {
+		if c.dropped == 0 {
+			log.Warnln("Dropping messages until the server is reachable, use --spool to keep them")
+		}
+		c.dropped += len(pending)
+		return
 	}
 
-	// Read the server certificate
-	serverCert, err := ioutil.ReadFile(config.certs + "/server.pem")
+	var records [][]byte
+	for _, f := range pending {
+		record, err := c.spoolRecord(f.message)
+		if err != nil {
+			log.Warnln("Unable to spool message: ", err.Error())
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := c.spool.Prepend(records); err != nil {
+		log.Warnln("Unable to spool messages: ", err.Error())
+	}
+	if dropped := c.spool.Dropped(); dropped > 0 {
+		log.Warnf("The spool is full, dropped the oldest %d bytes", dropped)
+	}
+}
+
+// replay sends the oldest spooled message, removing it from the spool once it has been sent
+func (c *client) replay() {
+	data, err := c.spool.Peek()
 	if err != nil {
-		log.Fatalln("Unable to read server certificate file")
+		// Stop spooling rather than retrying a spool which cannot be read
+		log.Errorln("Unable to read from spool, disabling it: ", err.Error())
+		c.spool.Close()
+		c.spool = nil
+		return
 	}
-	roots := x509.NewCertPool()
-	roots.AppendCertsFromPEM(serverCert)
 
-	// Add both certificates to the TLS config
-	tlsConfig := &tls.Config{
-		// TODO: Generate CA-signed certificates instead
-		InsecureSkipVerify: true,
-		Certificates:       []tls.Certificate{clientCerts},
-		RootCAs:            roots,
+	message, err := c.spooledMessage(data)
+	if err != nil {
+		log.Warnln("Discarding spooled message: ", err.Error())
+	} else if c.write(message) != nil {
+		// Keep the message for the next session
+		return
+	}
+	if err := c.spool.Remove(); err != nil {
+		log.Warnln("Unable to remove message from spool: ", err.Error())
+	}
+	if c.spool.Empty() {
+		log.Infoln("Finished replaying spooled messages")
 	}
+}
 
+// newServerConnection creates a new authenticated session with the server, retrying until it is reachable or
+// returning nil once the context is cancelled
+func (c *client) newServerConnection(ctx context.Context) *session {
 	//////////////////////////////
-	// 2. Connect to the server //
+	// 1. Connect to the server //
 	//////////////////////////////
 
 	log.Infoln("Establishing connection and authenticating with server...")
@@ -102,59 +418,76 @@ func (c *client) newServerConnection() *tls.Conn {
 
 	// Create a local conn variable
 	var conn *tls.Conn
-	// Create a variable to store the server authentication response
-	var authResponse []byte
+	// Create a variable to store the session once authenticated
+	s := &session{}
+	// Create variables to store the server authentication response
+	var authResponse uint16
+	var authReason string
 
 	// Use a ;; loop to handle network failure and backoff
 	for {
 		// Create a new connection with a timeout
-		dialer := &net.Dialer{Timeout: timeout}
-		conn, err = tls.DialWithDialer(dialer, "tcp", config.dest.String(), tlsConfig)
+		raw, err := dialServer(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
+			// Retrying only helps with certificate errors once the certificates have been replaced
+			if isCertificateError(err) {
+				log.Errorln("Unable to verify the server certificate: ", err.Error())
+			} else {
+				log.Warnln("Unable to dial the server: ", err.Error())
+			}
 			// Increment the backoff duration
 			d := b.Duration()
-			log.Warnln("Unable to dial the server: ", err.Error())
 			// Wait for the backoff duration
 			log.Infof("Retrying in %s...", d)
-			time.Sleep(d)
+			if !sleep(ctx, d) {
+				return nil
+			}
 			// Retry by restarting the loop
 			continue
 		}
+		conn = raw
 
 		// Update the connection deadline with a new timeout
 		conn.SetDeadline(time.Now().Add(timeout))
 
-		// Send the channel number along with login details
-		_, err = conn.Write([]byte(strconv.Itoa(*c.channel) + config.key + "\n"))
+		// Authenticate and open a stream for each channel
+		s.conn, s.tunnel = conn, tunnel.NewConn(conn)
+		status, reason, err := c.handshake(s)
 		if err != nil {
 			// Close the connection as it is no longer untouched
 			conn.Close()
+			// Retrying only helps once the client certificate has been replaced if the server does not accept it
+			if isCertificateError(err) {
+				log.Errorln("The server rejected the client certificate: ", err.Error())
+			} else {
+				log.Warnln("Unable to set up a session with the server: ", err.Error())
+			}
 			// Increment the backoff duration
 			d := b.Duration()
-			log.Warnln("Writing stream init to server failed: ", err.Error())
 			// Wait for the backoff duration
 			log.Infof("Retrying in %s...", d)
-			time.Sleep(d)
+			if !sleep(ctx, d) {
+				return nil
+			}
 			// Retry by restarting the loop
 			continue
 		}
-
-		// Create a byte array to store the server response
-		authResponse = make([]byte, 3)
-		// Read the server response
-		_, err = conn.Read(authResponse)
-		if err != nil {
-			// Close the connection as it is no longer untouched
+		// The server may still hold the channel for a session which it has not noticed is gone, so wait for it to
+		// be released or taken over
+		if status == tunnel.StatusChannelInUse {
 			conn.Close()
-			// Increment the backoff duration
 			d := b.Duration()
-			log.Warnln("Unable to read the server authentication response: ", err.Error())
-			// Wait for the backoff duration
+			log.Warnln("The server is receiving the channel from another session: ", reason)
 			log.Infof("Retrying in %s...", d)
-			time.Sleep(d)
-			// Retry by restarting the loop
+			if !sleep(ctx, d) {
+				return nil
+			}
 			continue
 		}
+		authResponse, authReason = status, reason
 
 		// Reset the backoff and end the loop due to successful connection
 		b.Reset()
@@ -162,25 +495,190 @@ func (c *client) newServerConnection() *tls.Conn {
 	}
 
 	/////////////////////////////////////
-	// 3. Authenticate with the server //
+	// 2. Authenticate with the server //
 	/////////////////////////////////////
 
-	// Check authResponse with auth strings
-	if string(authResponse) == SuccessfulClientAuthString {
-		log.Infoln("Successfully authenticated with the server. Passing stream to server.")
-	} else if string(authResponse) == FailedClientAuthString {
+	// Check authResponse with the status codes
+	switch authResponse {
+	case tunnel.StatusOK:
+		log.Infoln("Successfully authenticated with the server. Passing streams to server.")
+	case tunnel.StatusUnauthorized:
 		conn.Close()
-		log.Fatalln("Authentication failed due to invalid credentials.")
-	} else if string(authResponse) == InvalidChannelString {
+		log.Fatalln("Authentication failed: ", authReason)
+	case tunnel.StatusInvalidChannel:
 		conn.Close()
 		log.Fatalln("Authentication failed due to invalid channel provided.")
-	} else if string(authResponse) == ChannelInUseString {
+	case tunnel.StatusVersionNotSupported:
 		conn.Close()
-		log.Fatalln("Unable to connect as channel is in use.")
-	} else {
+		log.Fatalln("Authentication failed as the server does not support this version of the client: ", authReason)
+	default:
 		conn.Close()
-		log.Fatalln("Authentication failed due to unknown reason.")
+		log.Fatalln("Authentication failed due to unknown reason: ", authReason)
+	}
+
+	return s
+}
+
+// dialServer connects to the server with the certificates currently in the certificate folder, so that certificates
+// which are replaced while the client is running are used from the next connection
+func dialServer(ctx context.Context) (*tls.Conn, error) {
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up TLS: %s", err.Error())
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: timeout}, Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", config.dest.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*tls.Conn), nil
+}
+
+// handshake negotiates the protocol version and features of the session, authenticates it and opens a stream for
+// each channel, returning the first status which is not StatusOK along with the reason given by the server. Errors
+// are only returned for network failures, which are worth retrying.
+func (c *client) handshake(s *session) (uint16, string, error) {
+	tc := s.tunnel
+
+	// Say hello with the version and key of the client
+	hello := &tunnel.Hello{Version: tunnel.Version, Capabilities: tunnel.Capabilities, ClientID: config.id,
+		Key: config.key}
+	msg, err := hello.Message()
+	if err != nil {
+		log.Fatalln("Unable to encode the authentication message: ", err.Error())
+	}
+	if err := tc.Send(msg); err != nil {
+		return 0, "", err
+	}
+	reply, err := tc.Receive()
+	if err != nil {
+		return 0, "", err
+	}
+	if reply.Type != tunnel.MsgHelloReply {
+		return 0, "", fmt.Errorf("expected message type %d but got %d", tunnel.MsgHelloReply, reply.Type)
+	}
+	helloReply := &tunnel.HelloReply{}
+	if err := helloReply.UnmarshalBinary(reply.Payload); err != nil {
+		return 0, "", err
+	}
+	if helloReply.Status != tunnel.StatusOK {
+		return helloReply.Status, helloReply.Reason, nil
 	}
+	if !helloReply.Accepts() {
+		return tunnel.StatusVersionNotSupported, fmt.Sprintf("the server asked for version %d", helloReply.Version),
+			nil
+	}
+	s.caps = helloReply.Capabilities
+	s.resume = make(map[uint16]uint64)
+	log.WithField("version", helloReply.Version).Infoln("Negotiated protocol version with the server")
+
+	// Open a stream for each channel, naming the DVR it belongs to unless it is published as the client ID
+	for i, open := range c.streams {
+		msg, err := open.Message(streamID(i), s.caps)
+		if err != nil {
+			return tunnel.StatusVersionNotSupported, "the server does not support streaming from several DVRs", nil
+		}
+		if err := tc.Send(msg); err != nil {
+			return 0, "", err
+		}
+		if status, err := readStatus(tc, tunnel.MsgOpenReply); err != nil || status != tunnel.StatusOK {
+			log.WithFields(log.Fields{"dvr": open.Site, "channel": open.Channel}).
+				Warnln("The server did not accept the channel")
+			return status, fmt.Sprintf("the server did not accept channel %d", open.Channel), err
+		}
+
+		// Find out which frames of the channel the server already has
+		if s.caps.Has(tunnel.CapAck) {
+			sequence, err := readAck(tc, streamID(i))
+			if err != nil {
+				return 0, "", err
+			}
+			s.resume[streamID(i)] = sequence
+		}
+	}
+	return tunnel.StatusOK, "", nil
+}
+
+// readStatus reads a reply of the expected type and returns its status
+func readStatus(tc *tunnel.Conn, expected tunnel.MessageType) (uint16, error) {
+	reply, err := tc.Receive()
+	if err != nil {
+		return 0, err
+	}
+	if reply.Type != expected {
+		return 0, fmt.Errorf("expected message type %d but got %d", expected, reply.Type)
+	}
+	return reply.Status()
+}
+
+// readAck reads the acknowledgement of the stream which follows its MsgOpenReply and returns its sequence number
+func readAck(tc *tunnel.Conn, stream uint16) (uint64, error) {
+	reply, err := tc.Receive()
+	if err != nil {
+		return 0, err
+	}
+	if reply.Type != tunnel.MsgAck || reply.Stream != stream {
+		return 0, fmt.Errorf("expected an acknowledgement of stream %d but got message type %d", stream, reply.Type)
+	}
+	return reply.Sequence()
+}
+
+// spooledOpen returns the stream as it is identified in the spool, naming the site even if it is the client ID so that
+// records are not replayed as another client after the ID changes
+func spooledOpen(open *tunnel.Open) tunnel.Open {
+	spooled := *open
+	if spooled.Site == "" {
+		spooled.Site = config.id
+	}
+	return spooled
+}
 
-	return conn
+// spoolRecord encodes a message for the spool, preceded by a MsgOpen message naming the channel and site of its
+// stream. Stream IDs are numbered afresh on every run, so the stream is identified by what it carries instead.
+func (c *client) spoolRecord(message *tunnel.Message) ([]byte, error) {
+	i := int(message.Stream) - 1
+	if i < 0 || i >= len(c.streams) {
+		return nil, fmt.Errorf("the stream %d is not open", message.Stream)
+	}
+	open := spooledOpen(c.streams[i])
+	header, err := open.Message(message.Stream, tunnel.CapSites)
+	if err != nil {
+		return nil, err
+	}
+	record, err := header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(record, data...), nil
+}
+
+// spooledMessage decodes a message encoded by spoolRecord, moving it to the stream which carries the same channel and
+// site on this run. Messages of streams which are no longer streamed cannot be delivered, and are reported as errors.
+func (c *client) spooledMessage(record []byte) (*tunnel.Message, error) {
+	r := bytes.NewReader(record)
+	header, err := tunnel.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if header.Type != tunnel.MsgOpen {
+		return nil, errors.New("the message was spooled by an older version without its channel")
+	}
+	open, err := header.Open(tunnel.CapSites)
+	if err != nil {
+		return nil, err
+	}
+	message, err := tunnel.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := c.ids[*open]
+	if !ok {
+		return nil, fmt.Errorf("channel %d of %s is no longer streamed", open.Channel, open.Site)
+	}
+	message.Stream = id
+	return message, nil
 }
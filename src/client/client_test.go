@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/kz/swanntools/src/pki"
+	"github.com/kz/swanntools/src/spool"
+	"github.com/kz/swanntools/src/tunnel"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of the streams which is not connected to a server
+func newTestClient(streams ...*tunnel.Open) *client {
+	config.id = "home"
+	c := &client{streams: streams, ids: make(map[tunnel.Open]uint16), numbered: make(map[uint16]uint64)}
+	for i, open := range streams {
+		c.ids[spooledOpen(open)] = streamID(i)
+	}
+	return c
+}
+
+// dataMessage returns a data message of the stream carrying the frame with the sequence number
+func dataMessage(stream uint16, sequence uint64) *tunnel.Message {
+	d := &tunnel.Data{Sequence: sequence, Captured: time.Unix(1, 0), Frame: []byte{0x01}}
+	return d.Message(stream, tunnel.Capabilities)
+}
+
+func TestSpooledMessagesFollowTheirChannel(t *testing.T) {
+	before := newTestClient(&tunnel.Open{Channel: 1}, &tunnel.Open{Channel: 2, Site: "shed"},
+		&tunnel.Open{Channel: 3})
+	records := make([][]byte, 3)
+	for i := range records {
+		var err error
+		if records[i], err = before.spoolRecord(dataMessage(streamID(i), 7)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The next run streams channel 2 of the shed first and no longer streams channel 3
+	after := newTestClient(&tunnel.Open{Channel: 2, Site: "shed"}, &tunnel.Open{Channel: 1, Site: "home"})
+	if m, err := after.spooledMessage(records[0]); err != nil || m.Stream != 2 {
+		t.Errorf("Expected channel 1 of the client ID to move to stream 2, got %+v (%v)", m, err)
+	}
+	if m, err := after.spooledMessage(records[1]); err != nil || m.Stream != 1 {
+		t.Errorf("Expected channel 2 of the shed to move to stream 1, got %+v (%v)", m, err)
+	}
+	if _, err := after.spooledMessage(records[2]); err == nil {
+		t.Error("Expected channel 3 to be discarded as it is no longer streamed")
+	}
+
+	// Records spooled by older versions do not say which channel they belong to
+	legacy, _ := dataMessage(1, 7).MarshalBinary()
+	if _, err := after.spooledMessage(legacy); err == nil {
+		t.Error("Expected a record without its channel to be discarded")
+	}
+}
+
+func TestUnacknowledgedMessagesAreSpooledFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := newTestClient(&tunnel.Open{Channel: 1})
+	if c.spool, err = spool.Open(dir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames 1 and 2 were sent but not acknowledged when the server became unreachable, then frame 3 was spooled
+	c.inflight = []inflight{{stream: 1, sequence: 1, message: dataMessage(1, 1)},
+		{stream: 1, sequence: 2, message: dataMessage(1, 2)}}
+	c.hold(dataMessage(1, 3))
+	c.finish()
+
+	// The next run replays them in the order they were captured
+	next := newTestClient(&tunnel.Open{Channel: 1})
+	if next.spool, err = spool.Open(dir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	defer next.spool.Close()
+	for _, expected := range []uint64{1, 2, 3} {
+		record, err := next.spool.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		next.spool.Remove()
+		m, err := next.spooledMessage(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, err := m.Data(tunnel.Capabilities); err != nil || d.Sequence != expected {
+			t.Errorf("Expected frame %d, got %+v (%v)", expected, d, err)
+		}
+	}
+}
+
+// newTestSession returns a session with a server over TLS which passes every data message it receives to frames,
+// closing frames once the session ends
+func newTestSession(t *testing.T, resume map[uint16]uint64) (*session, <-chan *tunnel.Data) {
+	ca, err := pki.NewCA("test-ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.IssueServer([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	local, remote := net.Pipe()
+	frames := make(chan *tunnel.Data, 16)
+	go func() {
+		defer close(frames)
+		server := tunnel.NewConn(tls.Server(remote, &tls.Config{Certificates: []tls.Certificate{cert}}))
+		for {
+			m, err := server.Receive()
+			if err != nil {
+				return
+			}
+			if d, err := m.Data(tunnel.Capabilities); err == nil {
+				frames <- d
+			}
+		}
+	}()
+	conn := tls.Client(local, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	return &session{conn: conn, tunnel: tunnel.NewConn(conn), caps: tunnel.Capabilities, resume: resume}, frames
+}
+
+// received returns the sequence numbers of the frames received by a test session once it has ended
+func received(frames <-chan *tunnel.Data) []uint64 {
+	var sequences []uint64
+	for d := range frames {
+		sequences = append(sequences, d.Sequence)
+	}
+	return sequences
+}
+
+func TestAcknowledgedMessagesAreForgotten(t *testing.T) {
+	c := newTestClient(&tunnel.Open{Channel: 1}, &tunnel.Open{Channel: 2})
+	var frames <-chan *tunnel.Data
+	c.session, frames = newTestSession(t, nil)
+	for _, m := range []*tunnel.Message{dataMessage(1, 1), dataMessage(2, 1), dataMessage(1, 2), dataMessage(1, 3)} {
+		if err := c.write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.session.conn.Close()
+	if sequences := received(frames); len(sequences) != 4 {
+		t.Fatalf("Expected the server to receive 4 frames, got %v", sequences)
+	}
+
+	// Acknowledging frame 2 of stream 1 keeps its later frames and the frames of stream 2
+	c.acknowledge(ack{stream: 1, sequence: 2})
+	if len(c.inflight) != 2 || c.inflight[0].stream != 2 || c.inflight[1].sequence != 3 {
+		t.Errorf("Expected frame 1 of stream 2 and frame 3 of stream 1 to be kept, got %+v", c.inflight)
+	}
+	c.acknowledge(ack{stream: 2, sequence: 1})
+	c.acknowledge(ack{stream: 1, sequence: 3})
+	if len(c.inflight) != 0 {
+		t.Errorf("Expected every frame to be acknowledged, got %+v", c.inflight)
+	}
+}
+
+func TestUnacknowledgedMessagesAreResent(t *testing.T) {
+	c := newTestClient(&tunnel.Open{Channel: 1})
+	for sequence := uint64(1); sequence <= 4; sequence++ {
+		c.inflight = append(c.inflight, inflight{stream: 1, sequence: sequence, message: dataMessage(1, sequence)})
+	}
+
+	// The server received frame 2 but its acknowledgement was lost with the last session
+	var frames <-chan *tunnel.Data
+	c.session, frames = newTestSession(t, map[uint16]uint64{1: 2})
+	c.resend()
+	c.session.conn.Close()
+	if sequences := received(frames); len(sequences) != 2 || sequences[0] != 3 || sequences[1] != 4 {
+		t.Errorf("Expected frames 3 and 4 to be resent, got %v", sequences)
+	}
+	if len(c.inflight) != 2 || c.inflight[0].sequence != 3 {
+		t.Errorf("Expected the resent frames to wait for their acknowledgement, got %+v", c.inflight)
+	}
+}
+
+func TestFramesAreNumberedAfterTheServerResumePoint(t *testing.T) {
+	c := newTestClient(&tunnel.Open{Channel: 1}, &tunnel.Open{Channel: 2})
+
+	// The server has frame 41 of stream 1 from before the client restarted, and frame 7 of stream 2 was replayed
+	// from the spool with the number it was given then
+	var frames <-chan *tunnel.Data
+	c.session, frames = newTestSession(t, map[uint16]uint64{1: 41})
+	for _, m := range []*tunnel.Message{dataMessage(1, 0), dataMessage(2, 7), dataMessage(2, 0), dataMessage(1, 0)} {
+		if err := c.write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.session.conn.Close()
+	expected := []uint64{42, 7, 8, 43}
+	sequences := received(frames)
+	if len(sequences) != len(expected) {
+		t.Fatalf("Expected frames %v, got %v", expected, sequences)
+	}
+	for i := range expected {
+		if sequences[i] != expected[i] {
+			t.Errorf("Expected frames %v, got %v", expected, sequences)
+			break
+		}
+	}
+
+	// Frames are kept with their numbers so that they are resent as they were first sent
+	for i, f := range c.inflight {
+		d, err := f.message.Data(tunnel.Capabilities)
+		if err != nil || d.Sequence != expected[i] || f.sequence != expected[i] {
+			t.Errorf("Expected frame %d to be kept with its number, got %+v", expected[i], f)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/configfile"
+	"github.com/kz/swanntools/src/tunnel"
+	"github.com/urfave/cli"
+)
+
+// ConfigFile is the YAML or TOML file given by --config. Flags and environment variables take precedence over the
+// settings in the file.
+type ConfigFile struct {
+	ID     string `config:"id"` // ID is the name the client identifies itself with to the server
+	Server struct {
+		Address     string `config:"address"`     // Address is the address of the server in the format host:port
+		Key         string `config:"key"`         // Key is the passphrase to authenticate with the server
+		Name        string `config:"name"`        // Name is the name the server certificate must be issued to
+		Fingerprint string `config:"fingerprint"` // Fingerprint is the fingerprint of the server certificate to pin
+	} `config:"server"`
+	Certs struct {
+		Folder string `config:"folder"` // Folder is the certificate folder
+		CA     string `config:"ca"`     // CA is the file path to the CA certificate which signs the server certificate
+	} `config:"certs"`
+	Spool struct {
+		Path string `config:"path"` // Path is the directory to spool streams to while the server is unreachable
+		Size int    `config:"size"` // Size is the maximum size of the spool in megabytes
+	} `config:"spool"`
+	DVRs []DVRConfig `config:"dvrs"` // DVRs are the DVRs to stream from, unless DVRs are given with flags
+}
+
+// DVRConfig is a DVR in the configuration file
+type DVRConfig struct {
+	Name     string `config:"name"`          // Name is the site the DVR is published as, defaulting to the client ID
+	Address  string `config:"address"`       // Address is the address of the DVR in the format host:port
+	User     string `config:"user"`          // User is the username to authenticate with the DVR
+	Pass     string `config:"pass"`          // Pass is the password to authenticate with the DVR
+	Channels []int  `config:"channels"`      // Channels are the channels to stream from the DVR
+	Count    int    `config:"channel_count"` // Count is the number of channels of the DVR, defaulting to 32
+	Sub      []int  `config:"sub"`           // Sub are the channels streamed from their sub-stream
+}
+
+// fileDVRs are the DVRs in the configuration file, which are used unless DVRs are given with flags
+var fileDVRs []*DVR
+
+// loadConfigFile reads the file given by --config, if any, into the flags which were not set on the command line or
+// by environment variables
+func loadConfigFile(c *cli.Context) error {
+	if flags.config == "" {
+		return nil
+	}
+	file := &ConfigFile{}
+	err := configfile.Load(flags.config, file)
+	if err == nil {
+		fileDVRs, err = file.validate()
+	}
+	if err != nil {
+		log.WithField("Path", flags.config).Fatalln("Invalid configuration file: ", err.Error())
+	}
+
+	setString(c, "id", &flags.id, file.ID)
+	setString(c, "dest", &flags.dest, file.Server.Address)
+	setString(c, "key", &flags.key, file.Server.Key)
+	setString(c, "server-name", &flags.serverName, file.Server.Name)
+	setString(c, "server-fingerprint", &flags.fingerprint, file.Server.Fingerprint)
+	setString(c, "certs", &flags.certs, file.Certs.Folder)
+	setString(c, "ca", &flags.ca, file.Certs.CA)
+	setString(c, "spool", &flags.spool, file.Spool.Path)
+	if file.Spool.Size != 0 && !c.IsSet("spool-size") {
+		flags.spoolSize = file.Spool.Size
+	}
+	return nil
+}
+
+// validate checks the settings of the file, returning an error naming the offending key, and returns its DVRs
+func (f *ConfigFile) validate() ([]*DVR, error) {
+	if len(f.ID) > 255 {
+		return nil, configfile.Errorf("id", "cannot be longer than 255 bytes")
+	}
+	if f.Server.Address != "" {
+		if _, _, err := net.SplitHostPort(f.Server.Address); err != nil {
+			return nil, configfile.Errorf("server.address", "needs to be in the format host:port")
+		}
+	}
+	if f.Spool.Size < 0 {
+		return nil, configfile.Errorf("spool.size", "needs to be a positive number of megabytes")
+	}
+
+	var dvrs []*DVR
+	names := map[string]bool{}
+	for i, d := range f.DVRs {
+		key := fmt.Sprintf("dvrs[%d]", i)
+		if d.Name != "" && !tunnel.ValidSite(d.Name) {
+			return nil, configfile.Errorf(key+".name", "needs to be made of letters, digits, dots, dashes and "+
+				"underscores")
+		}
+		if names[d.Name] {
+			return nil, configfile.Errorf(key+".name", "is used by more than one DVR, where DVRs without a name "+
+				"use the client ID")
+		}
+		names[d.Name] = true
+		source, err := net.ResolveTCPAddr("tcp", d.Address)
+		if err != nil {
+			return nil, configfile.Errorf(key+".address", "needs to be in the format host:port: %s", err.Error())
+		}
+		if d.User == "" {
+			return nil, configfile.Errorf(key+".user", "is required")
+		}
+		if d.Pass == "" {
+			return nil, configfile.Errorf(key+".pass", "is required")
+		}
+		count, err := channelCount(d.Count)
+		if err != nil {
+			return nil, configfile.Errorf(key+".channel_count", "%s", err.Error())
+		}
+		if err := checkChannels(d.Channels, count); err != nil {
+			return nil, configfile.Errorf(key+".channels", "%s", err.Error())
+		}
+		sub := map[int]bool{}
+		for j, channel := range d.Sub {
+			if !intInSlice(&channel, &d.Channels) {
+				return nil, configfile.Errorf(fmt.Sprintf("%s.sub[%d]", key, j), "needs to be one of the channels")
+			}
+			sub[channel] = true
+		}
+		dvrs = append(dvrs, &DVR{name: d.Name, source: source, user: d.User, pass: d.Pass, channels: d.Channels,
+			count: count, sub: sub})
+	}
+	return dvrs, nil
+}
+
+// setString sets the flag with the name to the value from the configuration file unless the value is empty or the
+// flag was set on the command line or by an environment variable
+func setString(c *cli.Context, name string, flag *string, value string) {
+	if value != "" && !c.IsSet(name) {
+		*flag = value
+	}
+}
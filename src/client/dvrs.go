@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kz/swanntools/src/dvr"
+	"github.com/kz/swanntools/src/tunnel"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DVR is a DVR whose channels are streamed to the server, each DVR being published as its own site
+type DVR struct {
+	name     string       // name is the site the channels are published as, or empty to publish them as the client ID
+	source   *net.TCPAddr // source is the TCPAddr of the DVR
+	user     string       // user is the username to authenticate with the DVR
+	pass     string       // pass is the password to authenticate with the DVR
+	channels []int        // channels is an array of the channels streamed from the DVR
+	count    int          // count is the number of channels of the DVR model, which the channels are checked against
+	sub      map[int]bool // sub holds the channels whose sub-stream is streamed instead of the main stream
+}
+
+// streamType returns the stream requested of the channel
+func (d *DVR) streamType(channel int) dvr.StreamType {
+	if d.sub[channel] {
+		return dvr.SubStream
+	}
+	return dvr.MainStream
+}
+
+// site returns the name of the site the channels of the DVR are published as
+func (d *DVR) site() string {
+	if d.name == "" {
+		return config.id
+	}
+	return d.name
+}
+
+// parseDVR parses a DVR given with --dvr in the format name=user:pass@host:port/channels[/count], where the
+// channels are delimited by plus signs and may be followed by :sub to stream their sub-stream, and count is the
+// number of channels of the DVR. The password may contain any character but commas, which delimit DVRs in SWANN_DVR.
+func parseDVR(definition string) (*DVR, error) {
+	eq := strings.Index(definition, "=")
+	at := strings.LastIndex(definition, "@")
+	var address []string
+	if at > eq {
+		address = strings.Split(definition[at+1:], "/")
+	}
+	if eq < 1 || len(address) < 2 || len(address) > 3 {
+		return nil, fmt.Errorf("the DVR %q needs to be in the format name=user:pass@host:port/channels[/count]",
+			definition)
+	}
+	d := &DVR{name: definition[:eq]}
+	if !tunnel.ValidSite(d.name) {
+		return nil, fmt.Errorf("the DVR name %q needs to be made of letters, digits, dots, dashes and underscores",
+			d.name)
+	}
+
+	// Split the credentials at the first colon so that the password may contain colons
+	credentials := strings.SplitN(definition[eq+1:at], ":", 2)
+	if len(credentials) != 2 || credentials[0] == "" || credentials[1] == "" {
+		return nil, fmt.Errorf("the DVR %s needs a username and a password", d.name)
+	}
+	d.user, d.pass = credentials[0], credentials[1]
+
+	source, err := net.ResolveTCPAddr("tcp", address[0])
+	if err != nil {
+		return nil, fmt.Errorf("resolving the address of the DVR %s failed: %s", d.name, err.Error())
+	}
+	d.source = source
+
+	// The DVR is assumed to have as many channels as a stream request can select unless its count is given
+	count := 0
+	if len(address) == 3 {
+		if count, err = strconv.Atoi(address[2]); err != nil || count < 1 {
+			return nil, fmt.Errorf("the DVR %s has an invalid number of channels: needs to be a number between 1 "+
+				"and %d", d.name, dvr.MaxChannels)
+		}
+	}
+	if d.count, err = channelCount(count); err != nil {
+		return nil, fmt.Errorf("the DVR %s has an invalid number of channels: %s", d.name, err.Error())
+	}
+	if d.channels, d.sub, err = parseChannels(strings.Split(address[1], "+"), d.count); err != nil {
+		return nil, fmt.Errorf("the DVR %s has invalid channels: %s", d.name, err.Error())
+	}
+	return d, nil
+}
+
+// parseChannels converts channel numbers to integers, ensuring that they are unique and supported by a DVR with count
+// channels. Each channel may be followed by :main or :sub to choose its stream, and the channels whose sub-stream is
+// chosen are returned.
+func parseChannels(list []string, count int) ([]int, map[int]bool, error) {
+	var channels []int
+	sub := map[int]bool{}
+	for _, channel := range list {
+		// Split off the stream type, which is the main stream unless given
+		streamType := dvr.MainStream
+		if i := strings.Index(channel, ":"); i >= 0 {
+			var err error
+			if streamType, err = dvr.ParseStreamType(channel[i+1:]); err != nil {
+				return nil, nil, fmt.Errorf("the stream of channel %s needs to be either main or sub", channel[:i])
+			}
+			channel = channel[:i]
+		}
+
+		// Convert channel to integer
+		intChannel, err := strconv.Atoi(channel)
+		if err != nil {
+			return nil, nil, fmt.Errorf("all channels need to be a number between 1 and %d", count)
+		}
+		channels = append(channels, intChannel)
+		if streamType == dvr.SubStream {
+			sub[intChannel] = true
+		}
+	}
+	if err := checkChannels(channels, count); err != nil {
+		return nil, nil, err
+	}
+	return channels, sub, nil
+}
+
+// channelCount returns the number of channels of a DVR given as count, which is every channel a stream request can
+// select if it is zero. The settings reply of the DVR has not been decoded, so the number cannot be asked of the DVR.
+func channelCount(count int) (int, error) {
+	if count == 0 {
+		return dvr.MaxChannels, nil
+	}
+	if count < 1 || count > dvr.MaxChannels {
+		return 0, fmt.Errorf("needs to be a number between 1 and %d", dvr.MaxChannels)
+	}
+	return count, nil
+}
+
+// checkChannels ensures that the channels of a DVR with count channels are unique and supported
+func checkChannels(channels []int, count int) error {
+	if len(channels) == 0 {
+		return errors.New("you must select a channel")
+	}
+	for i, channel := range channels {
+		// Ensure the DVR has the channel, which the channel mask of the stream request is then able to select
+		if channel < 1 || channel > count {
+			return fmt.Errorf("all channels need to be a number between 1 and %d", count)
+		}
+
+		// Ensure all channels are unique
+		previous := channels[:i]
+		if intInSlice(&channel, &previous) {
+			return errors.New("all channels need to be unique")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/kz/swanntools/src/dvr"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestChannelsAreCheckedAgainstTheDVR(t *testing.T) {
+	// Without a channel count, any channel the stream request can select is accepted
+	d, err := parseDVR("shed=admin:secret@127.0.0.1:9000/1+32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.count != 32 || len(d.channels) != 2 {
+		t.Errorf("Expected channels 1 and 32 of a DVR with 32 channels, got %v of %d", d.channels, d.count)
+	}
+
+	// An 8 channel DVR has channel 8 but not channel 9
+	if d, err = parseDVR("shed=admin:secret@127.0.0.1:9000/5+8/8"); err != nil || d.count != 8 {
+		t.Errorf("Expected channels 5 and 8 of a DVR with 8 channels, got %+v (%v)", d, err)
+	}
+	if _, err := parseDVR("shed=admin:secret@127.0.0.1:9000/5+9/8"); err == nil {
+		t.Error("Expected channel 9 to be rejected for a DVR with 8 channels")
+	}
+
+	// The channel count cannot exceed what the stream request can select
+	for _, definition := range []string{"shed=admin:secret@127.0.0.1:9000/1/0",
+		"shed=admin:secret@127.0.0.1:9000/1/33", "shed=admin:secret@127.0.0.1:9000/1/eight",
+		"shed=admin:secret@127.0.0.1:9000/1/8/8"} {
+		if _, err := parseDVR(definition); err == nil {
+			t.Errorf("Expected %q to be rejected", definition)
+		}
+	}
+}
+
+func TestConfigFileChecksChannelsAgainstTheDVR(t *testing.T) {
+	f := &ConfigFile{DVRs: []DVRConfig{{Address: "127.0.0.1:9000", User: "admin", Pass: "secret", Channels: []int{5},
+		Count: 4}}}
+	if _, err := f.validate(); err == nil || err.Error() != "dvrs[0].channels: all channels need to be a number "+
+		"between 1 and 4" {
+		t.Errorf("Expected channel 5 of a DVR with 4 channels to be rejected, got %v", err)
+	}
+	f.DVRs[0].Count = 33
+	if _, err := f.validate(); err == nil {
+		t.Error("Expected a DVR with more channels than a stream request can select to be rejected")
+	}
+}
+
+func TestChannelsChooseTheirStream(t *testing.T) {
+	d, err := parseDVR("shed=admin:secret@127.0.0.1:9000/1+5:sub+6:main/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.channels) != 3 || d.channels[1] != 5 {
+		t.Fatalf("Expected channels 1, 5 and 6, got %v", d.channels)
+	}
+	for channel, expected := range map[int]dvr.StreamType{1: dvr.MainStream, 5: dvr.SubStream, 6: dvr.MainStream} {
+		if st := d.streamType(channel); st != expected {
+			t.Errorf("Expected the %s stream of channel %d, got %s", expected, channel, st)
+		}
+	}
+	if _, err := parseDVR("shed=admin:secret@127.0.0.1:9000/1:mobile"); err == nil {
+		t.Error("Expected an unknown stream to be rejected")
+	}
+
+}
+
+func TestStreamRequestsItsStream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d, err := parseDVR("shed=admin:secret@" + l.Addr().String() + "/5:sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := (&dvr.StreamRequest{Channel: 5, Stream: dvr.SubStream, User: "admin", Pass: "secret"}).
+		MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the request sent to the DVR, then hang up
+	requests := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(requests)
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, len(expected))
+		io.ReadFull(conn, request)
+		requests <- request
+	}()
+	s := &Stream{dvr: d, channel: 5, streamType: d.streamType(5)}
+	if _, err := s.newStreamConnection(context.Background()); err == nil {
+		t.Error("Expected the stream to fail once the DVR hangs up")
+	}
+	if request := <-requests; !bytes.Equal(request, expected) {
+		t.Errorf("Expected a request for the sub-stream of channel 5, got %x", request)
+	}
+}
+
+func TestConfigFileChoosesSubStreams(t *testing.T) {
+	f := &ConfigFile{DVRs: []DVRConfig{{Address: "127.0.0.1:9000", User: "admin", Pass: "secret",
+		Channels: []int{1, 2}, Sub: []int{2}}}}
+	dvrs, err := f.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dvrs[0].streamType(1) != dvr.MainStream || dvrs[0].streamType(2) != dvr.SubStream {
+		t.Error("Expected the sub-stream of channel 2 only")
+	}
+	f.DVRs[0].Sub = []int{3}
+	if _, err := f.validate(); err == nil || err.Error() != "dvrs[0].sub[0]: needs to be one of the channels" {
+		t.Errorf("Expected a sub-stream of a channel which is not streamed to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/pki"
+	"github.com/kz/swanntools/src/tunnel"
+	"github.com/urfave/cli"
+)
+
+// enrollCommand redeems an enrollment code for a client certificate
+var enrollCommand = cli.Command{
+	Name: "enroll",
+	Usage: "Receive a client certificate from the server given by --dest, writing it to the folder given by " +
+		"--certs",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "code", Value: "", Usage: "Enrollment code created by swanntools-server certs token"},
+	},
+	Action: enroll,
+}
+
+// enroll connects to the server without a certificate, trusting it by the fingerprint in the enrollment code, and
+// writes the certificate it signs to the certificate folder along with the CA certificate
+func enroll(c *cli.Context) error {
+	if flags.dest == "" || flags.certs == "" || c.String("code") == "" {
+		log.Fatalln("You need --dest, --certs and --code to enroll. Run --help for more details.")
+	}
+	secret, pin, err := pki.ParseEnrollmentCode(c.String("code"))
+	if err != nil {
+		log.Fatalln("Unable to read the enrollment code: ", err.Error())
+	}
+
+	// Never replace a certificate the client already has
+	certFile, keyFile := filepath.Join(flags.certs, "client.pem"), filepath.Join(flags.certs, "client.key")
+	for _, path := range []string{certFile, keyFile} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			log.Fatalf("The file %s already exists, remove it first to enroll again", path)
+		}
+	}
+
+	request, key, err := pki.NewRequest(clientID())
+	if err != nil {
+		log.Fatalln("Unable to create a certificate request: ", err.Error())
+	}
+	reply, err := requestCertificate(secret, pin, request)
+	if err != nil {
+		log.Fatalln("Unable to enroll with the server: ", err.Error())
+	}
+	if reply.Status != tunnel.StatusOK {
+		log.WithField("code", reply.Status).Fatalln("The server refused to enroll the client: ", reply.Reason)
+	}
+	cert, err := pki.ParseCertificate(reply.Certificate)
+	if err != nil {
+		log.Fatalln("Unable to parse the client certificate: ", err.Error())
+	}
+
+	// Write the key last so that the certificate folder is only usable once everything is in place
+	if err := os.MkdirAll(flags.certs, 0700); err != nil {
+		log.Fatalln("Unable to create the certificate folder: ", err.Error())
+	}
+	caFile := filepath.Join(flags.certs, "ca.pem")
+	if _, err := os.Stat(caFile); os.IsNotExist(err) {
+		writeFile(caFile, reply.CA, 0644)
+	} else {
+		log.WithField("Path", caFile).Warnln("Keeping the existing CA certificate")
+	}
+	writeFile(certFile, reply.Certificate, 0644)
+	writeFile(keyFile, key, 0600)
+
+	log.WithFields(log.Fields{"cert": cert.Subject.CommonName, "expires": cert.NotAfter.Format(time.RFC3339)}).
+		Infoln("Enrolled with the server")
+	return nil
+}
+
+// requestCertificate sends the enrollment to the server and returns its reply
+func requestCertificate(secret string, pin, request []byte) (*tunnel.EnrollmentReply, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	pinCertificate(tlsConfig, pin)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", flags.dest, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	tc := tunnel.NewConn(conn)
+	msg, err := (&tunnel.Enrollment{Token: secret, Request: request}).Message()
+	if err != nil {
+		return nil, err
+	}
+	if err := tc.Send(msg); err != nil {
+		return nil, err
+	}
+	if msg, err = tc.Receive(); err != nil {
+		return nil, err
+	}
+	if msg.Type != tunnel.MsgEnrollReply {
+		return nil, fmt.Errorf("expected an enrollment reply but got message type %d", msg.Type)
+	}
+	reply := &tunnel.EnrollmentReply{}
+	if err := reply.UnmarshalBinary(msg.Payload); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// writeFile writes data to a new file, exiting if it cannot be written
+func writeFile(path string, data []byte, perm os.FileMode) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err == nil {
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Fatalln("Unable to write file: ", err.Error())
+	}
+}
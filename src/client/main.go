@@ -1,42 +1,58 @@
 package main
 
 import (
+	"context"
 	"os"
 	"github.com/urfave/cli"
 	"net"
 	"sync"
 	"strings"
-	"strconv"
 	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/shutdown"
+	"github.com/kz/swanntools/src/spool"
+	"github.com/kz/swanntools/src/tunnel"
 	"time"
 )
 
 const (
-	maxChannels      = 4               // maxChannels is the maximum number of channels supported
 	timeout          = 5 * time.Second // timeout is the time before network operations timeout
-	socketBufferSize = 1460            // socketBufferSize is the maximum buffer size for DVR data
+	socketBufferSize = 1460            // socketBufferSize is the number of messages buffered for the server
+	defaultSpoolSize = 1024            // defaultSpoolSize is the size of the spool in megabytes if none is configured
+	maxUnacked       = 1460            // maxUnacked is the number of messages sent before the server must acknowledge
 )
 
 // Config is a struct of all the configuration variables after user input is processed
 type Config struct {
-	source   *net.TCPAddr // source is the TCPAddr of the DVR
-	dest     *net.TCPAddr // dest is the TCPAddr of the server
-	user     string       // user is the username to authenticate with the DVR
-	pass     string       // pass is the password to authenticate with the DVR
-	key      string       // key is the passphrase to authenticate with the server
-	channels []int        // channels is an array of currently used channels
-	certs    string       // certs is the location to the folder storing client certificates
+	dvrs        []*DVR       // dvrs are the DVRs to stream channels from
+	dest        *net.TCPAddr // dest is the TCPAddr of the server
+	key         string       // key is the passphrase to authenticate with the server
+	id          string       // id is the name the client identifies itself with to the server
+	certs       string       // certs is the location to the folder storing client certificates
+	ca          string       // ca is the file path to the CA certificate which signs the server certificate, if given
+	serverName  string       // serverName is the name the server certificate must be issued to
+	fingerprint string       // fingerprint is the pinned fingerprint of the server certificate, if any
+	spool       string       // spool is the directory holding messages while the server is unreachable, if any
+	spoolSize   int64        // spoolSize is the maximum size of the spool in bytes
 }
 
 // Flags is a struct of the possible flags for CLI input
 type Flags struct {
-	user     string
-	pass     string
-	key      string
-	source   string
-	dest     string
-	channels string
-	certs    string
+	user        string
+	pass        string
+	key         string
+	id          string
+	source      string
+	dest        string
+	channels    string
+	count       int
+	dvrs        cli.StringSlice
+	certs       string
+	ca          string
+	serverName  string
+	fingerprint string
+	spool       string
+	spoolSize   int
+	config      string
 }
 
 // Initialize global variables
@@ -54,23 +70,51 @@ func main() {
 	// Each flag is saved in in the global flags variable
 	app.Flags = []cli.Flag{
 		cli.StringFlag{Name: "user", Value: "", Usage: "Username to authenticate with",
-			Destination: &flags.user, EnvVar: "SWANN_USER", },
+			Destination: &flags.user, EnvVar: "SWANN_USER"},
 		cli.StringFlag{Name: "pass", Value: "", Usage: "Password to authenticate with",
-			Destination: &flags.pass, EnvVar: "SWANN_PASS", },
+			Destination: &flags.pass, EnvVar: "SWANN_PASS"},
 		cli.StringFlag{Name: "source", Value: "", Usage: "The address of the DVR in the format host:port",
-			Destination: &flags.source, EnvVar: "SWANN_SOURCE", },
+			Destination: &flags.source, EnvVar: "SWANN_SOURCE"},
 		cli.StringFlag{Name: "dest", Value: "", Usage: "The address of the streaming server in the format host:port",
-			Destination: &flags.dest, EnvVar: "SWANN_DEST", },
+			Destination: &flags.dest, EnvVar: "SWANN_DEST"},
 		cli.StringFlag{Name: "key", Value: "", Usage: "Passphrase to authenticate with the server",
 			Destination: &flags.key, EnvVar: "SWANN_KEY"},
-		cli.StringFlag{Name: "channels", Value: "", Usage: "Channel(s) to stream, delimited by commas",
-			Destination: &flags.channels, EnvVar: "SWANN_CHANNELS", },
+		cli.StringFlag{Name: "id", Value: "", Usage: "Name to identify the client to the server, defaulting to the hostname",
+			Destination: &flags.id, EnvVar: "SWANN_ID"},
+		cli.StringFlag{Name: "channels", Value: "", Usage: "Channel(s) to stream, delimited by commas, each " +
+			"followed by :sub to stream its sub-stream instead of the main stream",
+			Destination: &flags.channels, EnvVar: "SWANN_CHANNELS"},
+		cli.IntFlag{Name: "channel-count", Value: 0, Usage: "Number of channels of the DVR given by --source, " +
+			"defaulting to the 32 channels a stream request can select", Destination: &flags.count,
+			EnvVar: "SWANN_CHANNEL_COUNT"},
+		cli.StringSliceFlag{Name: "dvr", Usage: "Another DVR to stream from in the format " +
+			"name=user:pass@host:port/channels[/count], with channels delimited by plus signs and optionally " +
+			"followed by :sub and count being the number of channels of the DVR, published as the site name " +
+			"instead of the client ID, which can be repeated", Value: &flags.dvrs,
+			EnvVar: "SWANN_DVR"},
 		cli.StringFlag{Name: "certs", Value: "", Usage: "Absolute file path to the certificate folder",
-			Destination: &flags.certs, EnvVar: "SWANN_CERTS", },
+			Destination: &flags.certs, EnvVar: "SWANN_CERTS"},
+		cli.StringFlag{Name: "ca", Value: "", Usage: "File path to the CA certificate which signs the server " +
+			"certificate, defaulting to ca.pem or else server.pem in the certificate folder",
+			Destination: &flags.ca, EnvVar: "SWANN_CA"},
+		cli.StringFlag{Name: "server-name", Value: "", Usage: "Name the server certificate must be issued to, " +
+			"defaulting to the host of --dest", Destination: &flags.serverName, EnvVar: "SWANN_SERVER_NAME"},
+		cli.StringFlag{Name: "server-fingerprint", Value: "", Usage: "SHA-256 fingerprint of the server certificate " +
+			"to pin instead of verifying it against the CA", Destination: &flags.fingerprint,
+			EnvVar: "SWANN_SERVER_FINGERPRINT"},
+		cli.StringFlag{Name: "spool", Value: "", Usage: "Directory to spool streams to while the server is unreachable",
+			Destination: &flags.spool, EnvVar: "SWANN_SPOOL"},
+		cli.IntFlag{Name: "spool-size", Value: defaultSpoolSize, Usage: "Maximum size of the spool in megabytes",
+			Destination: &flags.spoolSize, EnvVar: "SWANN_SPOOL_SIZE"},
+		cli.StringFlag{Name: "config", Value: "", Usage: "File path to a YAML or TOML configuration file, whose " +
+			"settings are overridden by flags and environment variables", Destination: &flags.config,
+			EnvVar: "SWANN_CONFIG"},
 	}
 
 	app.Name = "swanntools-client"
 	app.Usage = "client for kz/swanntools"
+	app.Commands = []cli.Command{enrollCommand}
+	app.Before = loadConfigFile
 	app.Action = func(c *cli.Context) error {
 		// Run the main application
 		run()
@@ -90,47 +134,69 @@ func run() {
 	config = Config{}
 
 	// Ensure that the command line flags are not empty
-	if flags.user == "" || flags.pass == "" || flags.key == "" || flags.source == "" || flags.dest == "" ||
-		flags.channels == "" || flags.certs == "" {
+	if flags.key == "" || flags.dest == "" || flags.certs == "" ||
+		(flags.source == "" && len(flags.dvrs) == 0 && len(fileDVRs) == 0) {
 		log.Fatalln("You are missing one or more flags. Run --help for more details.")
 	}
 
-	// Add user, pass and key flags to config
-	config.user = flags.user
-	config.pass = flags.pass
+	// Add key flag to config
 	config.key = flags.key
 
-	// Parse  channel flag string (e.g., "1,3,4" -> ["1", "3", "4"])
-	channelSlice := strings.Split(flags.channels, ",")
+	// Identify the client by its hostname unless a name is given
+	config.id = clientID()
 
-	// Ensure channels exist
-	if len(channelSlice) == 0 {
-		log.Fatalln("You must select a channel")
+	// DVRs given with flags replace those in the configuration file
+	if flags.source == "" && len(flags.dvrs) == 0 {
+		config.dvrs = fileDVRs
 	}
 
-	// Validate each flag
-	for i, channel := range channelSlice {
-		// Convert channel to integer
-		intChannel, err := strconv.Atoi(channel)
+	// The DVR given by --source is published as the client ID
+	if flags.source != "" {
+		if flags.user == "" || flags.pass == "" || flags.channels == "" {
+			log.Fatalln("You need --user, --pass and --channels to stream from --source. Run --help for more details.")
+		}
 
-		// Ensure maxChannels constraint is kept
-		if i >= maxChannels {
-			log.Fatalf("You cannot have greater than %d streams", maxChannels)
-		} else if err != nil || intChannel > maxChannels {
-			log.Fatalf("All channels need to be a number between 1 and %d", maxChannels)
+		// Resolve the source address
+		sourceTCPAddr, err := net.ResolveTCPAddr("tcp", flags.source)
+		if err != nil {
+			log.Fatalln("Resolving the source address failed: ", err.Error())
 		}
 
-		// Ensure all channels are unique
-		if intInSlice(&intChannel, &config.channels) {
-			log.Fatalln("All channels need to be unique")
+		// Check the channels against the number of channels of the DVR
+		count, err := channelCount(flags.count)
+		if err != nil {
+			log.Fatalln("Invalid channel count: ", err.Error())
 		}
 
-		// Store channel number in config
-		config.channels = append(config.channels, intChannel)
+		// Parse channel flag string (e.g., "1,3:sub,4" -> [1, 3, 4] with the sub-stream of channel 3)
+		channels, sub, err := parseChannels(strings.Split(flags.channels, ","), count)
+		if err != nil {
+			log.Fatalln("Invalid channels: ", err.Error())
+		}
+		config.dvrs = append(config.dvrs, &DVR{source: sourceTCPAddr, user: flags.user, pass: flags.pass,
+			channels: channels, count: count, sub: sub})
+	}
+
+	// Add each DVR given by --dvr
+	for _, definition := range flags.dvrs {
+		d, err := parseDVR(definition)
+		if err != nil {
+			log.Fatalln("Invalid DVR: ", err.Error())
+		}
+		config.dvrs = append(config.dvrs, d)
+	}
+
+	// Ensure that every DVR is published as a different site
+	sites := map[string]bool{}
+	for _, d := range config.dvrs {
+		if sites[d.site()] {
+			log.Fatalf("The site %s is used by more than one DVR", d.site())
+		}
+		sites[d.site()] = true
 	}
 
 	// Ensure certificates exist
-	for _, file := range []string{"client.key", "client.pem", "server.pem"} {
+	for _, file := range []string{"client.key", "client.pem"} {
 		if _, err := os.Stat(flags.certs + "/" + file); err != nil {
 			log.Fatalln("Unable to stat certificates: ", err.Error())
 		}
@@ -139,40 +205,108 @@ func run() {
 	// Store certificates in config
 	config.certs = flags.certs
 
+	// Store the spool settings in config
+	if flags.spoolSize <= 0 {
+		log.Fatalln("The spool size needs to be a positive number of megabytes")
+	}
+	config.spool = flags.spool
+	config.spoolSize = int64(flags.spoolSize) << 20
+
 	//////////////////////////////////
 	// 2. Resolve the TCP addresses //
 	//////////////////////////////////
 
-	// Resolve the source address
-	sourceTCPAddr, err := net.ResolveTCPAddr("tcp", flags.source)
-	if err != nil {
-		log.Fatalln("Resolving the source address failed: ", err.Error())
-	}
-
 	// Resolve the destination address
 	destTCPAddr, err := net.ResolveTCPAddr("tcp", flags.dest)
 	if err != nil {
 		log.Fatalln("Resolving the destination address failed: ", err.Error())
 	}
 
-	// Store addresses in config
-	config.source = sourceTCPAddr
+	// Store address in config
 	config.dest = destTCPAddr
 
+	// Verify the server by the host it is reached at unless a name is given
+	serverName := flags.serverName
+	if serverName == "" {
+		if serverName, _, err = net.SplitHostPort(flags.dest); err != nil {
+			log.Fatalln("Resolving the destination address failed: ", err.Error())
+		}
+	}
+
+	// Check that the client certificate and whatever the server is verified with can be loaded, which is done again
+	// on every connection so that replaced certificates are used
+	config.ca, config.serverName, config.fingerprint = flags.ca, serverName, flags.fingerprint
+	if _, err = loadTLSConfig(); err != nil {
+		log.Fatalln("Unable to set up TLS: ", err.Error())
+	}
+
 	////////////////////////////////////
 	// 3. Retrieve the camera streams //
 	////////////////////////////////////
 
-	// Loop through each channel number
-	for i := range config.channels {
+	// Open the spool, replaying anything left from an earlier run once connected
+	var sp *spool.Spool
+	if config.spool != "" {
+		if sp, err = spool.Open(config.spool, config.spoolSize); err != nil {
+			log.Fatalln("Unable to open the spool: ", err.Error())
+		}
+		if !sp.Empty() {
+			log.WithField("Path", config.spool).Infof("Found %d bytes of spooled messages to replay", sp.Size())
+		}
+	}
+
+	// Number the streams of every channel of every DVR
+	var streams []*Stream
+	var opens []*tunnel.Open
+	for _, d := range config.dvrs {
+		for _, channel := range d.channels {
+			streams = append(streams, &Stream{dvr: d, channel: channel, streamType: d.streamType(channel),
+				id: streamID(len(streams))})
+			opens = append(opens, &tunnel.Open{Channel: channel, Site: d.name})
+		}
+	}
+
+	// Stop streaming once the client is sent SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go shutdown.OnSignal(cancel)
+
+	// Create a client with a single session carrying every stream
+	c := Client(ctx, opens, sp)
+
+	// Loop through each stream
+	for _, s := range streams {
 		// Prevent main from exiting early before goroutines exit
 		wg.Add(1)
 
-		// Create a goroutine which streams channel to server
-		s := Stream{channel: &config.channels[i]}
-		go s.StreamToServer()
+		// Create a goroutine which streams the channel to server
+		s.client = c
+		go s.StreamToServer(ctx)
 	}
 
-	// Wait for all goroutines to complete before exiting
-	wg.Wait()
+	// Stop sending messages once every stream has stopped
+	go func() {
+		wg.Wait()
+		close(c.send)
+	}()
+
+	// Handle the messages until they have been sent or spooled before exiting
+	c.Handle()
+	log.Infoln("Client stopped")
+}
+
+// clientID returns the name the client identifies itself with, which is its hostname unless a name is given
+func clientID() string {
+	id := flags.id
+	if id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalln("Unable to determine the hostname, use --id instead: ", err.Error())
+		}
+		id = hostname
+	}
+	if len(id) > 255 {
+		log.Fatalln("The client ID cannot be longer than 255 bytes")
+	}
+	return id
 }
@@ -1,37 +1,59 @@
 package main
 
 import (
+	"context"
 	"net"
-	"fmt"
-	"encoding/hex"
-	"bytes"
 	log "github.com/Sirupsen/logrus"
-	"math"
 	"github.com/jpillora/backoff"
+	"github.com/kz/swanntools/src/dvr"
+	"github.com/kz/swanntools/src/tunnel"
 	"time"
 )
 
-// Hex values of the byte arrays required in string form
-const (
-	initStreamValues     = "00000000000000000000010000000300000000000000000000006800000001000000100000000N0000000100000000UUUUUUUUUU000000000000000000000000000001000000000000010124000000PPPPPPPPPPPP00009cc9c805000000000400010004000000a8c9c80500000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
-	successfulAuthValues = "1000000000000000"
-	failedAuthValues     = "0800000004000000"
-)
-
 // Stream is a struct handling streaming from the DVR
 type Stream struct {
-	channel   *int    // channel is a pointer to the DVR channel
-	initBytes *[]byte // initBytes is a pointer to the byte array required to initialize a DVR stream
+	dvr        *DVR               // dvr is the DVR the channel is streamed from
+	channel    int                // channel is the DVR channel
+	streamType dvr.StreamType     // streamType selects the main stream or the sub-stream of the channel
+	id         uint16             // id is the ID of the stream carrying the channel on the session
+	client     *client            // client sends the frames to the server
+	request    *dvr.StreamRequest // request is the request required to initialize a DVR stream
 }
 
-// newStreamConnection creates and sets up a new TCP connection
-func (s *Stream) newStreamConnection() *net.Conn {
-	// Generate the initBytes if it does not exist
-	if s.initBytes == nil {
-		s.generateInitBytes()
+// newStreamConnection makes a single attempt to create and set up a new TCP connection
+func (s *Stream) newStreamConnection(ctx context.Context) (net.Conn, error) {
+	// Create the stream request if it does not exist
+	if s.request == nil {
+		s.request = &dvr.StreamRequest{Channel: s.channel, Stream: s.streamType, User: s.dvr.user, Pass: s.dvr.pass}
+	}
+
+	// Attempt to dial the DVR with a timeout
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.dvr.source.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the connection deadline with a new timeout
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// Send the stream request and check if DVR has authenticated the user
+	err = dvr.RequestStream(conn, s.request)
+	if err != nil {
+		// Close the connection as it is no longer untouched
+		conn.Close()
+		return nil, err
 	}
 
-	log.Infoln("Establishing connection and authenticating with the DVR...")
+	// Return the stream
+	return conn, nil
+}
+
+// connect creates a new stream connection, backing off and retrying while errors are temporary until the context is
+// cancelled
+func (s *Stream) connect(ctx context.Context) (net.Conn, error) {
+	logger := s.logger()
+	logger.Infoln("Establishing connection and authenticating with the DVR...")
 
 	// Add a backoff algorithm to handle network failures
 	b := &backoff.Backoff{
@@ -41,144 +63,105 @@ func (s *Stream) newStreamConnection() *net.Conn {
 		Jitter: false,                  // Disable jitter
 	}
 
-	// Create a local net.Conn variable
-	var conn net.Conn
-
 	// Use a ;; loop to handle network failure and backoff
 	for {
-		var err error
-
-		// Attempt to dial the DVR with a timeout
-		conn, err = net.DialTimeout("tcp", config.source.String(), timeout)
-		if err != nil {
-			log.Warnln("Dialing the DVR failed:", err.Error())
-			// Increment the backoff duration
-			d := b.Duration()
-			// Wait for the backoff duration
-			log.Infof("Retrying in %s...", d)
-			time.Sleep(d)
-			// Retry by restarting the loop
-			continue
+		conn, err := s.newStreamConnection(ctx)
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, ctx.Err()
 		}
-
-		// Update the connection deadline with a new timeout
-		conn.SetDeadline(time.Now().Add(timeout))
-
-		// Send the stream initialization byte array to the DVR
-		_, err = conn.Write(*s.initBytes)
-		if err != nil {
-			log.Warnln("Writing stream init to DVR failed: ", err.Error())
-			// Close the connection as it is no longer untouched
-			conn.Close()
-			// Increment the backoff duration
-			d := b.Duration()
-			// Wait for the backoff duration
-			log.Infof("Retrying in %s...", d)
-			time.Sleep(d)
-			// Retry by restarting the loop
-			continue
+		if err == nil {
+			logger.Infoln("DVR authentication successful. Passing stream to client.")
+			return conn, nil
 		}
 
-		// Reset the backoff and end the loop due to successful connection
-		b.Reset()
-		break
-	}
-
-	// Read the authentication response from the DVR
-	data := make([]byte, 8)
-	_, err := conn.Read(data)
-	if err != nil {
-		conn.Close()
-		log.Fatalln("Unable to read DVR authentication response: ", err.Error())
-	}
-
-	// Check if DVR has authenticated the user
-	successfulAuthBytes, _ := hex.DecodeString(successfulAuthValues)
-	failedAuthBytes, _ := hex.DecodeString(failedAuthValues)
-	if bytes.Equal(data, successfulAuthBytes) {
-		log.Infoln("DVR authentication successful. Passing stream to client.")
-	} else if bytes.Equal(data, failedAuthBytes) {
-		conn.Close()
-		log.Fatalln("DVR authentication failed due to invalid credentials.")
-	} else {
-		conn.Close()
-		log.Fatalln("DVR authentication failed due to unknown reason.")
-	}
-
-	// Return the stream
-	return &conn
-}
-
-// generateInitBytes returns the byte array required to initialize a stream
-func (s *Stream) generateInitBytes() {
-	hexValues := initStreamValues
-
-	channelStartPos := 77
-	channelEndPos := 78
-
-	// Convert channel from 1, 2, 3, 4 to 1, 2, 4, 8 respectively
-	parsedChannel := int(math.Exp2(float64(*s.channel - 1)))
-	hexValues = hexValues[:channelStartPos] + fmt.Sprintf("%d", parsedChannel) + hexValues[channelEndPos:]
-
-	// Parse username
-	for i, v := range config.user {
-		startPos := 94 + 2*i
-		endPos := 96 + 2*i
-		hexValues = hexValues[:startPos] + fmt.Sprintf("%x", int(v)) + hexValues[endPos:]
-	}
-
-	// Parse password
-	for i, v := range config.pass {
-		startPos := 158 + 2*i
-		endPos := 160 + 2*i
-		hexValues = hexValues[:startPos] + fmt.Sprintf("%x", int(v)) + hexValues[endPos:]
-	}
+		// Give up if retrying will not help, such as when the credentials are invalid
+		if !dvr.IsTemporary(err) {
+			return nil, err
+		}
 
-	// Decode the hex string into a byte array
-	byteArray, err := hex.DecodeString(hexValues)
-	if err != nil {
-		log.Fatalln("Unable to decode stream initialization values to byte array: ", err.Error())
+		// Increment the backoff duration
+		d := b.Duration()
+		logger.Warnln("Connecting to the DVR failed: ", err.Error())
+		// Wait for the backoff duration
+		logger.Infof("Retrying in %s...", d)
+		if !sleep(ctx, d) {
+			return nil, ctx.Err()
+		}
 	}
-
-	s.initBytes = &byteArray
 }
 
-// StreamToServer streams the video to the server
-func (s *Stream) StreamToServer() {
+// StreamToServer streams the video to the server until the context is cancelled
+func (s *Stream) StreamToServer(ctx context.Context) {
 	// Remove a WaitGroup entry once stream halts so main can exit
 	defer wg.Done()
 
 	// Create a new stream connection
-	conn := *s.newStreamConnection()
-	defer conn.Close()
-
-	// Create a client and handler to receive messages
-	c := Client(s.channel)
+	conn, err := s.connect(ctx)
+	if err != nil {
+		s.giveUp(ctx, err)
+		return
+	}
+	// Close the connection once the context is cancelled so that reading from it stops
+	stop := closeOnCancel(ctx, conn)
 
-	// Run the client handler in a goroutine
-	go c.Handle()
+	// Split the camera stream into frames
+	demuxer := dvr.NewDemuxer(conn)
 
 	// Get the main camera stream and send it to the client handler
 	for {
-		// Create a byte array
-		data := make([]byte, socketBufferSize)
-
 		// Update the DVR conn timeout
 		conn.SetDeadline(time.Now().Add(timeout))
 
-		// Read from the DVR
-		n, err := conn.Read(data)
+		// Read a whole frame from the DVR
+		frame, err := demuxer.ReadFrame()
 		if err != nil {
-			log.Warnln("Error occurred while reading from DVR stream connection: ", err.Error())
 			// Close the connection
+			stop()
 			conn.Close()
+			// Stop streaming if the connection was closed because the client is shutting down
+			if ctx.Err() != nil {
+				s.logger().Infoln("Stopped streaming from the DVR")
+				return
+			}
+			s.logger().Warnln("Error occurred while reading from DVR stream connection: ", err.Error())
 			// Reattempt the connection
-			conn = *s.newStreamConnection()
+			conn, err = s.connect(ctx)
+			if err != nil {
+				s.giveUp(ctx, err)
+				return
+			}
+			stop = closeOnCancel(ctx, conn)
+			// Start demuxing the new connection
+			demuxer = dvr.NewDemuxer(conn)
 			// Loop again and listen for more data
 			continue
 		}
 
-		// Send the data to the c.send chan for handling by the client handler
-		c.send <- data[:n]
+		// Encode the frame so that it is sent to the server in one piece
+		data, _ := frame.MarshalBinary()
+
+		// Send the data to the client handler on the stream of the channel, stamped with the time it was captured so
+		// that it keeps its timing if it is spooled. The handler numbers the frame once it is sent to the server.
+		d := &tunnel.Data{Captured: time.Now(), Frame: data}
+		s.client.send <- d.Message(s.id, tunnel.Capabilities)
 	}
 }
+
+// giveUp logs why the channel is no longer streamed and closes its stream on the session, unless the client is
+// shutting down
+func (s *Stream) giveUp(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		s.logger().Infoln("Stopped streaming from the DVR")
+		return
+	}
+	s.logger().Errorln("Giving up on channel: ", err.Error())
+	s.client.send <- &tunnel.Message{Type: tunnel.MsgClose, Stream: s.id}
+}
+
+// logger returns a logger identifying the DVR and channel of the stream
+func (s *Stream) logger() *log.Entry {
+	return log.WithFields(log.Fields{"dvr": s.dvr.site(), "channel": s.channel, "stream": s.streamType})
+}
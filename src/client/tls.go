@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"github.com/kz/swanntools/src/pki"
+)
+
+// errFingerprintMismatch is returned when the server presents a certificate which does not match the pinned
+// fingerprint
+var errFingerprintMismatch = errors.New("the server certificate does not match the pinned fingerprint")
+
+// newTLSConfig creates the TLS config used to connect to the server. The client presents its certificate and verifies
+// the server certificate either against the pinned fingerprint, if any, or against the CA and the server name.
+func newTLSConfig(certs, ca, serverName, fingerprint string) (*tls.Config, error) {
+	// Load client key pair for TLS connection
+	clientCerts, err := tls.LoadX509KeyPair(certs+"/client.pem", certs+"/client.key")
+	if err != nil {
+		return nil, fmt.Errorf("unable to load client key pair: %s", err.Error())
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{clientCerts},
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// Only accept the exact server certificate when it is pinned
+	if fingerprint != "" {
+		pin, err := pki.ParseFingerprint(fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		pinCertificate(tlsConfig, pin)
+		return tlsConfig, nil
+	}
+
+	// Otherwise trust the CA, falling back to the server certificate itself if it is self-signed
+	if ca == "" {
+		ca = certs + "/ca.pem"
+		if _, err := os.Stat(ca); os.IsNotExist(err) {
+			ca = certs + "/server.pem"
+		}
+	}
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificate: %s", err.Error())
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", ca)
+	}
+	tlsConfig.RootCAs = roots
+	return tlsConfig, nil
+}
+
+// loadTLSConfig loads the TLS config with the certificates currently in the certificate folder
+func loadTLSConfig() (*tls.Config, error) {
+	return newTLSConfig(config.certs, config.ca, config.serverName, config.fingerprint)
+}
+
+// pinCertificate makes the TLS config only accept the server certificate with the SHA-256 fingerprint. The chain is
+// not verified as the pin replaces the CA, so the certificate is checked by hand instead.
+func pinCertificate(tlsConfig *tls.Config, pin []byte) {
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errFingerprintMismatch
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(sum[:], pin) {
+			return fmt.Errorf("%s, got %s", errFingerprintMismatch.Error(), pki.Fingerprint(rawCerts[0]))
+		}
+		return nil
+	}
+}
+
+// isCertificateError reports whether err is caused by a certificate being rejected by either side, which will not
+// be resolved by retrying
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return true
+	}
+	if strings.Contains(err.Error(), errFingerprintMismatch.Error()) {
+		return true
+	}
+	// The server rejects certificates with an alert, which is only available as text
+	for _, alert := range []string{"bad certificate", "unknown certificate authority", "certificate required"} {
+		if strings.Contains(err.Error(), "remote error: tls: "+alert) {
+			return true
+		}
+	}
+	return false
+}
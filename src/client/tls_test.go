@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/kz/swanntools/src/pki"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCerts is a certificate folder of a client along with the certificates of the server it connects to
+type testCerts struct {
+	dir      string          // dir is the certificate folder of the client
+	server   tls.Certificate // server is the key pair of the server, issued for localhost by the server CA
+	serverCA *pki.CA         // serverCA signs the server certificate
+	clientCA *pki.CA         // clientCA signs the client certificate
+}
+
+// newTestCerts creates a certificate folder holding a client key pair and the CA of the server
+func newTestCerts(t *testing.T) *testCerts {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCerts{dir: dir}
+	if c.serverCA, err = pki.NewCA("server-ca", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if c.clientCA, err = pki.NewCA("client-ca", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := c.serverCA.IssueServer([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.server, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err = c.clientCA.IssueClient("home", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.write(t, "client.pem", certPEM)
+	c.write(t, "client.key", keyPEM)
+	c.write(t, "ca.pem", c.serverCA.CertPEM())
+	return c
+}
+
+// write writes a file to the certificate folder
+func (c *testCerts) write(t *testing.T, name string, data []byte) {
+	if err := ioutil.WriteFile(filepath.Join(c.dir, name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// connect performs a handshake with a server presenting the server certificate which only accepts clients whose
+// certificate is signed by clientCA, returning the error seen by the client
+func (c *testCerts) connect(config *tls.Config, clientCA *pki.CA) error {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.Cert)
+	local, remote := net.Pipe()
+	go func() {
+		server := tls.Server(remote, &tls.Config{Certificates: []tls.Certificate{c.server}, ClientCAs: clientCAs,
+			ClientAuth: tls.RequireAndVerifyClientCert})
+		if server.Handshake() == nil {
+			server.Write([]byte{0x01})
+		}
+		server.Close()
+	}()
+
+	// The server verifies the client certificate after the client has finished its handshake, so read its reply
+	conn := tls.Client(local, config)
+	defer local.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	_, err := conn.Read(make([]byte, 1))
+	return err
+}
+
+func TestTLSConfigVerifiesServerAgainstCA(t *testing.T) {
+	c := newTestCerts(t)
+	defer os.RemoveAll(c.dir)
+
+	config, err := newTLSConfig(c.dir, "", "localhost", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(config, c.clientCA); err != nil {
+		t.Errorf("Expected the server signed by the CA to be accepted, got %v", err)
+	}
+
+	// The server certificate needs to be issued to the server name
+	if config, err = newTLSConfig(c.dir, "", "server.example.com", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(config, c.clientCA); err == nil || !isCertificateError(err) {
+		t.Errorf("Expected a certificate error for another server name, got %v", err)
+	}
+
+	// A CA which did not sign the server certificate rejects it
+	other, err := pki.NewCA("other-ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.write(t, "other.pem", other.CertPEM())
+	if config, err = newTLSConfig(c.dir, filepath.Join(c.dir, "other.pem"), "localhost", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(config, c.clientCA); err == nil || !isCertificateError(err) {
+		t.Errorf("Expected a certificate error for a mismatched CA, got %v", err)
+	}
+
+	// The server rejecting the client certificate cannot be resolved by retrying either
+	if config, err = newTLSConfig(c.dir, "", "localhost", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(config, other); err == nil || !isCertificateError(err) {
+		t.Errorf("Expected a certificate error for a client certificate signed by another CA, got %v", err)
+	}
+}
+
+func TestTLSConfigFallsBackToServerCertificate(t *testing.T) {
+	c := newTestCerts(t)
+	defer os.RemoveAll(c.dir)
+
+	// Without ca.pem the certificate in server.pem is trusted
+	if err := os.Rename(filepath.Join(c.dir, "ca.pem"), filepath.Join(c.dir, "server.pem")); err != nil {
+		t.Fatal(err)
+	}
+	config, err := newTLSConfig(c.dir, "", "localhost", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(config, c.clientCA); err != nil {
+		t.Errorf("Expected the server to be verified against server.pem, got %v", err)
+	}
+
+	os.Remove(filepath.Join(c.dir, "server.pem"))
+	if _, err := newTLSConfig(c.dir, "", "localhost", ""); err == nil {
+		t.Error("Expected an error without a certificate to verify the server against")
+	}
+}
+
+func TestTLSConfigPinsServerCertificate(t *testing.T) {
+	c := newTestCerts(t)
+	defer os.RemoveAll(c.dir)
+
+	// The pin replaces the CA and the server name
+	pin := pki.Fingerprint(c.server.Certificate[0])
+	config, err := newTLSConfig(c.dir, "", "server.example.com", pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.connect(config, c.clientCA); err != nil {
+		t.Errorf("Expected the pinned server certificate to be accepted, got %v", err)
+	}
+
+	// Pinning any other certificate rejects the server, even if the CA signed its certificate
+	if config, err = newTLSConfig(c.dir, "", "localhost", pki.Fingerprint(c.serverCA.Cert.Raw)); err != nil {
+		t.Fatal(err)
+	}
+	err = c.connect(config, c.clientCA)
+	if err == nil || !isCertificateError(err) {
+		t.Errorf("Expected a certificate error for a wrong pin, got %v", err)
+	}
+
+	if _, err := newTLSConfig(c.dir, "", "localhost", "not a fingerprint"); err == nil {
+		t.Error("Expected an error for an invalid fingerprint")
+	}
+}
+
+func TestNetworkErrorsAreNotCertificateErrors(t *testing.T) {
+	for _, err := range []error{io.EOF, errors.New("dial tcp 127.0.0.1:9000: connect: connection refused"),
+		&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}} {
+		if isCertificateError(err) {
+			t.Errorf("Expected %v not to be a certificate error", err)
+		}
+	}
+}
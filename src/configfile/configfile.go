@@ -0,0 +1,185 @@
+// Package configfile loads YAML and TOML configuration files into structs. Fields are matched to keys by their config
+// tag, and unknown keys or values of the wrong type are reported by the path of the offending key so that mistakes
+// are easy to find in large files.
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error is an invalid key or value in a configuration file
+type Error struct {
+	Key     string // Key is the path of the offending key, such as dvrs[1].channels
+	Message string // Message describes what is wrong with the key
+}
+
+// Error returns the path of the key followed by what is wrong with it
+func (e *Error) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// Errorf returns an Error for the key with a formatted message
+func Errorf(key, format string, args ...interface{}) *Error {
+	return &Error{Key: key, Message: fmt.Sprintf(format, args...)}
+}
+
+// durationType is decoded from strings such as 15s or 1h30m
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Load reads the configuration file at path into the struct v points to. Files ending in .yaml or .yml are read as
+// YAML and files ending in .toml as TOML. Keys which are missing from the file leave their fields untouched.
+func Load(path string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("configfile: Load needs a pointer to a struct")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Decode the file into plain values first so that both formats are checked against the struct the same way
+	tree := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		_, err = toml.Decode(string(data), &tree)
+	default:
+		return fmt.Errorf("configfile: %s needs to end in .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("configfile: unable to parse %s: %s", path, err.Error())
+	}
+	return decode("", tree, rv.Elem())
+}
+
+// decode stores the value found at the key in v
+func decode(key string, value interface{}, v reflect.Value) error {
+	// Empty values, such as a YAML key without a value, keep the field as it is
+	if value == nil {
+		return nil
+	}
+
+	if v.Type() == durationType {
+		s, ok := value.(string)
+		if !ok {
+			return Errorf(key, "needs to be a duration such as 15s or 1h30m")
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return Errorf(key, "needs to be a duration such as 15s or 1h30m")
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return Errorf(key, "needs to be a string")
+		}
+		v.SetString(s)
+
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return Errorf(key, "needs to be true or false")
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch value := value.(type) {
+		case int:
+			n = int64(value)
+		case int64:
+			n = value
+		case uint64:
+			n = int64(value)
+		default:
+			return Errorf(key, "needs to be a whole number")
+		}
+		if v.OverflowInt(n) {
+			return Errorf(key, "is too large")
+		}
+		v.SetInt(n)
+
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			// TOML decodes arrays of tables on their own
+			tables, isTables := value.([]map[string]interface{})
+			if !isTables {
+				return Errorf(key, "needs to be a list")
+			}
+			for _, table := range tables {
+				list = append(list, table)
+			}
+		}
+		slice := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := decode(fmt.Sprintf("%s[%d]", key, i), item, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decode(key, value, v.Elem())
+
+	case reflect.Struct:
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return Errorf(key, "needs to be a section of keys")
+		}
+
+		// Go through the keys in order so that the same file always reports the same error
+		names := make([]string, 0, len(table))
+		for name := range table {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			path := name
+			if key != "" {
+				path = key + "." + name
+			}
+			field, ok := fieldByTag(v, name)
+			if !ok {
+				return Errorf(path, "is not a known setting")
+			}
+			if err := decode(path, table[name], field); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("configfile: unable to decode %s into a field of type %s", key, v.Type())
+	}
+	return nil
+}
+
+// fieldByTag returns the field of the struct whose config tag is the name
+func fieldByTag(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("config") == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
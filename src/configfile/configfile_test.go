@@ -0,0 +1,138 @@
+package configfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testConfig exercises every kind of field the package decodes
+type testConfig struct {
+	Name    string        `config:"name"`
+	Enabled bool          `config:"enabled"`
+	Timeout time.Duration `config:"timeout"`
+	Server  struct {
+		Address string `config:"address"`
+		Port    int    `config:"port"`
+	} `config:"server"`
+	Devices []testDevice `config:"devices"`
+}
+
+// testDevice is an entry of a list of sections
+type testDevice struct {
+	Name     string `config:"name"`
+	Channels []int  `config:"channels"`
+}
+
+// writeConfig writes the contents to a file with the name in a temporary folder, returning its path
+func writeConfig(t *testing.T, name, contents string) string {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// checkConfig checks that the config holds the values written by TestLoadYAML and TestLoadTOML
+func checkConfig(t *testing.T, c *testConfig) {
+	if c.Name != "home" || !c.Enabled || c.Timeout != 90*time.Second || c.Server.Address != "example.com" ||
+		c.Server.Port != 9000 {
+		t.Errorf("Unexpected values %+v", c)
+	}
+	if len(c.Devices) != 2 || c.Devices[0].Name != "garage" || len(c.Devices[0].Channels) != 2 ||
+		c.Devices[0].Channels[1] != 3 || c.Devices[1].Name != "shed" || len(c.Devices[1].Channels) != 0 {
+		t.Errorf("Unexpected devices %+v", c.Devices)
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+name: home
+enabled: true
+timeout: 1m30s
+server:
+  address: example.com
+  port: 9000
+devices:
+  - name: garage
+    channels: [1, 3]
+  - name: shed
+`)
+	c := &testConfig{}
+	if err := Load(path, c); err != nil {
+		t.Fatal(err)
+	}
+	checkConfig(t, c)
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeConfig(t, "config.toml", `
+name = "home"
+enabled = true
+timeout = "1m30s"
+
+[server]
+address = "example.com"
+port = 9000
+
+[[devices]]
+name = "garage"
+channels = [1, 3]
+
+[[devices]]
+name = "shed"
+`)
+	c := &testConfig{}
+	if err := Load(path, c); err != nil {
+		t.Fatal(err)
+	}
+	checkConfig(t, c)
+}
+
+func TestLoadKeepsMissingKeys(t *testing.T) {
+	path := writeConfig(t, "config.yml", "server:\n  port: 1\n")
+	c := &testConfig{Name: "default"}
+	if err := Load(path, c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "default" || c.Server.Port != 1 {
+		t.Errorf("Expected the name to be kept and the port to be 1, got %+v", c)
+	}
+}
+
+func TestLoadReportsOffendingKey(t *testing.T) {
+	for contents, key := range map[string]string{
+		"server:\n  adress: example.com\n":                    "server.adress",
+		"server:\n  port: ninety\n":                           "server.port",
+		"timeout: 90\n":                                       "timeout",
+		"devices:\n  - name: garage\n    channels: [1, x]\n": "devices[0].channels[1]",
+		"devices:\n  name: garage\n":                          "devices",
+		"server: example.com\n":                               "server",
+	} {
+		err := Load(writeConfig(t, "config.yaml", contents), &testConfig{})
+		if e, ok := err.(*Error); !ok || e.Key != key {
+			t.Errorf("Expected an error at %s for %q, got %v", key, contents, err)
+		}
+	}
+
+	err := Load(writeConfig(t, "config.toml", "[[devices]]\nchannels = [\"1\"]\n"), &testConfig{})
+	if e, ok := err.(*Error); !ok || e.Key != "devices[0].channels[0]" {
+		t.Errorf("Expected an error at devices[0].channels[0], got %v", err)
+	}
+}
+
+func TestLoadRejectsUnknownFormats(t *testing.T) {
+	if err := Load(writeConfig(t, "config.json", "{}"), &testConfig{}); err == nil {
+		t.Errorf("Expected an error for a JSON file")
+	}
+	if err := Load(writeConfig(t, "config.yaml", "name: [\n"), &testConfig{}); err == nil {
+		t.Errorf("Expected an error for invalid YAML")
+	}
+}
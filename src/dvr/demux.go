@@ -0,0 +1,157 @@
+package dvr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame framing
+const (
+	FrameHeaderSize = 16      // FrameHeaderSize is the size of the chunk header preceding each frame
+	MaxFrameSize    = 4 << 20 // MaxFrameSize is the largest frame payload accepted before assuming corruption
+	NoSignalStream  = 31      // NoSignalStream is the stream number sent for channels without a camera
+)
+
+// Chunk types, as used in the chunk IDs of the stream (e.g. 00dc)
+const (
+	ChunkVideo = "dc" // ChunkVideo is a compressed video frame
+	ChunkAudio = "wb" // ChunkAudio is an audio frame
+)
+
+// ErrInvalidFrame is returned when an encoded frame does not start with a valid chunk header
+var ErrInvalidFrame = errors.New("dvr: invalid frame")
+
+// StreamHeader is the marker found near the start of every camera stream
+var StreamHeader = []byte("MDVR96NT")
+
+// Frame is a single chunk of the camera stream. Each chunk starts with a 16 byte header made up of an AVI style
+// chunk ID (a two digit stream number and a chunk type, e.g. 00dc), a codec FourCC (e.g. H264), the payload length
+// and a timestamp, both little-endian.
+type Frame struct {
+	Stream    int    // Stream is the stream number from the chunk ID
+	Type      string // Type is the chunk type from the chunk ID
+	Codec     string // Codec is the codec FourCC
+	Timestamp uint32 // Timestamp is the frame time reported by the DVR
+	Payload   []byte // Payload is the frame data, which is an Annex B byte stream for H264 video
+}
+
+// IsVideo reports whether the frame is a video frame from a connected camera
+func (f *Frame) IsVideo() bool {
+	return f.Type == ChunkVideo && f.Stream != NoSignalStream
+}
+
+// MarshalBinary encodes the frame along with its chunk header
+func (f *Frame) MarshalBinary() ([]byte, error) {
+	data := make([]byte, FrameHeaderSize+len(f.Payload))
+	copy(data[0:2], fmt.Sprintf("%02d", f.Stream%100))
+	copy(data[2:4], f.Type)
+	copy(data[4:8], f.Codec)
+	binary.LittleEndian.PutUint32(data[8:12], uint32(len(f.Payload)))
+	binary.LittleEndian.PutUint32(data[12:16], f.Timestamp)
+	copy(data[FrameHeaderSize:], f.Payload)
+	return data, nil
+}
+
+// UnmarshalBinary decodes a frame encoded by MarshalBinary
+func (f *Frame) UnmarshalBinary(data []byte) error {
+	if len(data) < FrameHeaderSize {
+		return ErrShortMessage
+	}
+	parsed, length, ok := parseFrameHeader(data)
+	if !ok || int(length) != len(data)-FrameHeaderSize {
+		return ErrInvalidFrame
+	}
+	*f = *parsed
+	f.Payload = data[FrameHeaderSize:]
+	return nil
+}
+
+// parseFrameHeader decodes a chunk header, reporting false if hdr does not look like one
+func parseFrameHeader(hdr []byte) (*Frame, uint32, bool) {
+	// The chunk ID must be a two digit stream number followed by a known chunk type
+	if !isDigit(hdr[0]) || !isDigit(hdr[1]) {
+		return nil, 0, false
+	}
+	chunkType := string(hdr[2:4])
+	if chunkType != ChunkVideo && chunkType != ChunkAudio {
+		return nil, 0, false
+	}
+
+	// The codec must be a FourCC made up of upper case letters and digits
+	for _, c := range hdr[4:8] {
+		if !isDigit(c) && (c < 'A' || c > 'Z') {
+			return nil, 0, false
+		}
+	}
+
+	// Reject lengths which can only be the result of corruption
+	length := binary.LittleEndian.Uint32(hdr[8:12])
+	if length > MaxFrameSize {
+		return nil, 0, false
+	}
+
+	f := &Frame{
+		Stream:    int(hdr[0]-'0')*10 + int(hdr[1]-'0'),
+		Type:      chunkType,
+		Codec:     string(hdr[4:8]),
+		Timestamp: binary.LittleEndian.Uint32(hdr[12:16]),
+	}
+	return f, length, true
+}
+
+// isDigit reports whether c is an ASCII digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Demuxer splits a camera stream into frames
+type Demuxer struct {
+	r          *bufio.Reader
+	HeaderSeen bool  // HeaderSeen reports whether the StreamHeader has been read
+	Skipped    int64 // Skipped is the number of bytes discarded while searching for frames
+}
+
+// NewDemuxer creates a Demuxer reading a camera stream from r
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// ReadFrame reads the next complete frame, skipping the stream header and any bytes which are not part of a frame
+func (d *Demuxer) ReadFrame() (*Frame, error) {
+	for {
+		// Peek at what could be the next chunk header
+		hdr, err := d.r.Peek(FrameHeaderSize)
+		if err != nil {
+			if err == io.EOF && len(hdr) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		// Read the frame if the chunk header is valid
+		if f, length, ok := parseFrameHeader(hdr); ok {
+			d.r.Discard(FrameHeaderSize)
+			f.Payload = make([]byte, length)
+			if _, err := io.ReadFull(d.r, f.Payload); err != nil {
+				if err == io.EOF {
+					return nil, io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			return f, nil
+		}
+
+		// Skip over the stream header in one go, otherwise resynchronise a byte at a time
+		skip := 1
+		if bytes.HasPrefix(hdr, StreamHeader) {
+			d.HeaderSeen = true
+			skip = len(StreamHeader)
+		}
+		d.r.Discard(skip)
+		d.Skipped += int64(skip)
+	}
+}
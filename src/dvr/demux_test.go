@@ -0,0 +1,74 @@
+package dvr
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDemuxerSplitsStreamIntoFrames(t *testing.T) {
+	first := &Frame{Stream: 0, Type: ChunkVideo, Codec: "H264", Timestamp: 40, Payload: []byte{0, 0, 0, 1, 0x67}}
+	second := &Frame{Stream: 31, Type: ChunkVideo, Codec: "H264", Timestamp: 80, Payload: []byte{0, 0, 1, 0x41}}
+
+	// Build a stream with a header and some junk before the frames
+	stream := append([]byte("MDVR96NT\x00\x01\x02"), marshalFrame(t, first)...)
+	stream = append(stream, marshalFrame(t, second)...)
+
+	d := NewDemuxer(bytes.NewReader(stream))
+	for _, expected := range []*Frame{first, second} {
+		f, err := d.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Stream != expected.Stream || f.Type != expected.Type || f.Codec != expected.Codec ||
+			f.Timestamp != expected.Timestamp || !bytes.Equal(f.Payload, expected.Payload) {
+			t.Errorf("Frame %+v not as expected %+v", f, expected)
+		}
+	}
+
+	if _, err := d.ReadFrame(); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end of the stream, got %v", err)
+	}
+	if !d.HeaderSeen || d.Skipped != 11 {
+		t.Errorf("Expected the header and 11 bytes to be skipped, got %v and %d", d.HeaderSeen, d.Skipped)
+	}
+	if second.IsVideo() {
+		t.Error("Frames without a camera should not be reported as video")
+	}
+}
+
+func TestDemuxerReportsTruncatedFrames(t *testing.T) {
+	data := marshalFrame(t, &Frame{Type: ChunkVideo, Codec: "H264", Payload: make([]byte, 100)})
+
+	d := NewDemuxer(bytes.NewReader(data[:50]))
+	if _, err := d.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	f := &Frame{Stream: 2, Type: ChunkAudio, Codec: "G726", Timestamp: 1234, Payload: []byte{1, 2, 3}}
+	data := marshalFrame(t, f)
+
+	var decoded Frame
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Stream != f.Stream || decoded.Type != f.Type || decoded.Codec != f.Codec ||
+		decoded.Timestamp != f.Timestamp || !bytes.Equal(decoded.Payload, f.Payload) {
+		t.Errorf("Frame %+v not as expected %+v", decoded, f)
+	}
+
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidFrame {
+		t.Errorf("Expected ErrInvalidFrame for a truncated frame, got %v", err)
+	}
+}
+
+func marshalFrame(t *testing.T, f *Frame) []byte {
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,116 @@
+// Package dvr implements the media port protocol spoken by RaySharp DVRs such as the Swann DVR4-1200.
+//
+// Every request sent to the DVR is a fixed size message made up of seven bytes of padding, a big-endian
+// header and a command specific payload, zero padded to RequestSize bytes. The layout of each message was
+// worked out from Wireshark captures of the web client (see the research journal in the README), so fields
+// whose purpose is unknown are reproduced exactly as they were captured.
+package dvr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Message sizes
+const (
+	RequestSize   = 507                         // RequestSize is the size of every request sent to the DVR
+	ResponseSize  = RequestSize - requestOffset // ResponseSize is the size of a full response from the DVR
+	HeaderSize    = 20                          // HeaderSize is the size of the header preceding each payload
+	requestOffset = 7                           // requestOffset is the number of padding bytes before the header
+	requestMarker = 1                           // requestMarker is the first header field of every message
+)
+
+// Command identifies the type of a message
+type Command uint32
+
+// Commands observed in captures of the web client
+const (
+	CommandStream   Command = 0x03 // CommandStream requests a camera stream
+	CommandIntent   Command = 0x0a // CommandIntent establishes an intent to log in
+	CommandSettings Command = 0x0e // CommandSettings requests the DVR settings
+	CommandLogin    Command = 0x19 // CommandLogin logs in to the web panel
+)
+
+var (
+	// ErrShortMessage is returned when a message is too short to be decoded
+	ErrShortMessage = errors.New("dvr: message too short")
+	// ErrUnexpectedCommand is returned when a response is for a different command than expected
+	ErrUnexpectedCommand = errors.New("dvr: unexpected command in response")
+)
+
+// Header is the header which precedes the payload of every request and response
+type Header struct {
+	Marker   uint32  // Marker is always 1
+	Command  Command // Command is the type of the message
+	Sequence uint8   // Sequence is echoed back by the DVR and is incremented by the web client
+	_        [3]byte
+	Param    uint32 // Param is a command specific value, only set on intent messages
+	Length   uint32 // Length is the size of the payload following the header
+}
+
+// MarshalBinary encodes the header into its wire format
+func (h *Header) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, h); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the header from the start of data
+func (h *Header) UnmarshalBinary(data []byte) error {
+	if len(data) < HeaderSize {
+		return ErrShortMessage
+	}
+	return binary.Read(bytes.NewReader(data[:HeaderSize]), binary.BigEndian, h)
+}
+
+// marshalRequest encodes a header and payload into a padded request
+func marshalRequest(command Command, sequence uint8, param uint32, payload interface{}) ([]byte, error) {
+	h := Header{
+		Marker:   requestMarker,
+		Command:  command,
+		Sequence: sequence,
+		Param:    param,
+		Length:   uint32(binary.Size(payload)),
+	}
+
+	// Write the padding, header and payload into a buffer
+	buf := bytes.NewBuffer(make([]byte, requestOffset))
+	if err := binary.Write(buf, binary.BigEndian, &h); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, payload); err != nil {
+		return nil, err
+	}
+
+	// Pad the request to its fixed size
+	request := make([]byte, RequestSize)
+	copy(request, buf.Bytes())
+	return request, nil
+}
+
+// unmarshalResponse decodes a response into a header and payload, ensuring the command is as expected
+func unmarshalResponse(data []byte, command Command, payload interface{}) (Header, error) {
+	var h Header
+	if err := h.UnmarshalBinary(data); err != nil {
+		return h, err
+	}
+	if h.Command != command {
+		return h, ErrUnexpectedCommand
+	}
+	if len(data) < HeaderSize+binary.Size(payload) {
+		return h, ErrShortMessage
+	}
+	return h, binary.Read(bytes.NewReader(data[HeaderSize:]), binary.BigEndian, payload)
+}
+
+// putString copies s into the fixed size field dst, failing if it does not fit
+func putString(dst []byte, s string, name string) error {
+	if len(s) > len(dst) {
+		return &FieldError{Field: name, Max: len(dst)}
+	}
+	copy(dst, s)
+	return nil
+}
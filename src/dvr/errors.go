@@ -0,0 +1,50 @@
+package dvr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Errors returned when a stream cannot be established
+var (
+	// ErrInvalidCredentials is returned when the DVR rejects the username or password
+	ErrInvalidCredentials = errors.New("dvr: invalid credentials")
+	// ErrTimeout is returned when the DVR does not respond in time
+	ErrTimeout = errors.New("dvr: timed out waiting for the DVR")
+	// ErrProtocolMismatch is returned when the peer does not appear to speak the media port protocol
+	ErrProtocolMismatch = errors.New("dvr: peer does not speak the media port protocol")
+)
+
+// UnknownReplyError is returned when the DVR sends a well formed reply with an unrecognised code
+type UnknownReplyError struct {
+	Reply Reply // Reply is the reply received from the DVR
+}
+
+// Error implements the error interface
+func (e *UnknownReplyError) Error() string {
+	return fmt.Sprintf("dvr: unknown reply (length %d, code %#08x)", e.Reply.Length, uint32(e.Reply.Code))
+}
+
+// IsTemporary reports whether err is likely to go away if the request is retried
+func IsTemporary(err error) bool {
+	switch err.(type) {
+	case *UnknownReplyError:
+		return true
+	case *FieldError:
+		return false
+	}
+	switch err {
+	case ErrInvalidCredentials, ErrProtocolMismatch:
+		return false
+	}
+	return true
+}
+
+// wrapNetError converts network timeouts into ErrTimeout
+func wrapNetError(err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrTimeout
+	}
+	return err
+}
@@ -0,0 +1,207 @@
+package dvr
+
+import (
+	"fmt"
+)
+
+const (
+	intentParam = 0x29230000 // intentParam is the header parameter sent with every intent message
+	MaxChannels = 32         // MaxChannels is the number of channels the channel mask of a stream request can select
+)
+
+// streamOptions and streamTrailer are fields of the stream request whose meaning is unknown, apart from the stream
+// type which precedes the options
+var (
+	streamOptions = [7]byte{0x00, 0x01, 0x01, 0x24, 0x00, 0x00, 0x00}
+	streamTrailer = [24]byte{
+		0x9c, 0xc9, 0xc8, 0x05, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, 0x01, 0x00,
+		0x04, 0x00, 0x00, 0x00, 0xa8, 0xc9, 0xc8, 0x05, 0x00, 0x00, 0x00, 0x00,
+	}
+)
+
+// FieldError is returned when a value does not fit in its fixed size field
+type FieldError struct {
+	Field string // Field is the name of the field
+	Max   int    // Max is the maximum length of the field in bytes
+}
+
+// Error implements the error interface
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("dvr: %s cannot be longer than %d bytes", e.Field, e.Max)
+}
+
+// IntentRequest establishes an intent to log in to the web panel
+type IntentRequest struct {
+	Sequence uint8 // Sequence is an arbitrary value which is echoed back in the response
+}
+
+// intentPayload is the wire format of the intent request payload
+type intentPayload struct {
+	Version uint8
+	_       [27]byte
+}
+
+// MarshalBinary encodes the intent request
+func (m *IntentRequest) MarshalBinary() ([]byte, error) {
+	return marshalRequest(CommandIntent, m.Sequence, intentParam, &intentPayload{Version: 1})
+}
+
+// IntentResponse acknowledges an intent request
+type IntentResponse struct {
+	Sequence uint8   // Sequence is the value sent in the intent request
+	Token    [4]byte // Token is a value set by the DVR
+}
+
+// intentResponsePayload is the wire format of the intent response payload
+type intentResponsePayload struct {
+	Version uint8
+	_       [3]byte
+	Token   [4]byte
+	_       [20]byte
+}
+
+// UnmarshalBinary decodes the intent response
+func (m *IntentResponse) UnmarshalBinary(data []byte) error {
+	var p intentResponsePayload
+	h, err := unmarshalResponse(data, CommandIntent, &p)
+	if err != nil {
+		return err
+	}
+	m.Sequence = h.Sequence
+	m.Token = p.Token
+	return nil
+}
+
+// LoginRequest logs in to the web panel
+type LoginRequest struct {
+	Sequence uint8  // Sequence is one greater than the sequence of the preceding intent request
+	User     string // User is the username to log in with
+	Pass     string // Pass is the password to log in with
+}
+
+// loginPayload is the wire format of the login request payload
+type loginPayload struct {
+	User [32]byte
+	Pass [32]byte
+	_    [20]byte
+}
+
+// MarshalBinary encodes the login request
+func (m *LoginRequest) MarshalBinary() ([]byte, error) {
+	var p loginPayload
+	if err := putString(p.User[:], m.User, "username"); err != nil {
+		return nil, err
+	}
+	if err := putString(p.Pass[:], m.Pass, "password"); err != nil {
+		return nil, err
+	}
+	return marshalRequest(CommandLogin, m.Sequence, 0, &p)
+}
+
+// SettingsRequest requests the DVR settings, which the DVR sends regardless of authentication
+type SettingsRequest struct {
+	Sequence uint8 // Sequence is an arbitrary value
+}
+
+// MarshalBinary encodes the settings request
+func (m *SettingsRequest) MarshalBinary() ([]byte, error) {
+	return marshalRequest(CommandSettings, m.Sequence, 0, &[20]byte{})
+}
+
+// StreamType selects which of the streams of a channel is requested
+type StreamType uint8
+
+// Stream types of a channel. Only requests for the main stream have been captured, so the value of the sub-stream is
+// the next in sequence and has yet to be confirmed by a capture.
+const (
+	MainStream StreamType = 0x00 // MainStream is the 704x480 stream, which is the one captured from the web client
+	SubStream  StreamType = 0x01 // SubStream is the lower quality 320x240 stream also served to mobile clients
+)
+
+// String returns the name of the stream type
+func (t StreamType) String() string {
+	switch t {
+	case MainStream:
+		return "main"
+	case SubStream:
+		return "sub"
+	default:
+		return fmt.Sprintf("StreamType(%d)", uint8(t))
+	}
+}
+
+// ParseStreamType parses the name of a stream type, either main or sub
+func ParseStreamType(name string) (StreamType, error) {
+	switch name {
+	case "main":
+		return MainStream, nil
+	case "sub":
+		return SubStream, nil
+	default:
+		return 0, fmt.Errorf("dvr: unknown stream type %q, which needs to be either main or sub", name)
+	}
+}
+
+// StreamRequest requests a camera stream
+type StreamRequest struct {
+	Channel int        // Channel is the channel number, starting from 1
+	Stream  StreamType // Stream is the stream of the channel to request, the main stream by default
+	User    string     // User is the username to authenticate with
+	Pass    string     // Pass is the password to authenticate with
+}
+
+// streamPayload is the wire format of the stream request payload
+type streamPayload struct {
+	Version     uint32
+	Size        uint32
+	ChannelMask uint32
+	Count       uint32
+	_           uint32
+	User        [16]byte
+	Flags       uint32
+	_           uint32
+	StreamType  StreamType
+	Options     [7]byte
+	Pass        [8]byte
+	Trailer     [24]byte
+	_           [20]byte
+}
+
+// MarshalBinary encodes the stream request
+func (m *StreamRequest) MarshalBinary() ([]byte, error) {
+	mask, err := ChannelMask(m.Channel)
+	if err != nil {
+		return nil, err
+	}
+	if m.Stream != MainStream && m.Stream != SubStream {
+		return nil, fmt.Errorf("dvr: %s is not a known stream type", m.Stream)
+	}
+
+	p := streamPayload{
+		Version:     1,
+		Size:        16,
+		ChannelMask: mask,
+		Count:       1,
+		Flags:       1,
+		StreamType:  m.Stream,
+		Options:     streamOptions,
+		Trailer:     streamTrailer,
+	}
+	if err := putString(p.User[:], m.User, "username"); err != nil {
+		return nil, err
+	}
+	if err := putString(p.Pass[:], m.Pass, "password"); err != nil {
+		return nil, err
+	}
+	return marshalRequest(CommandStream, 0, 0, &p)
+}
+
+// ChannelMask returns the channel mask selecting the channel, where bit 0 selects channel 1. DVRs with 8 or 16
+// channels, such as the DVR8-2600, select their upper channels with the higher bits of the same field.
+func ChannelMask(channel int) (uint32, error) {
+	if channel < 1 || channel > MaxChannels {
+		return 0, fmt.Errorf("dvr: channel %d is out of range, channels are numbered from 1 to %d", channel,
+			MaxChannels)
+	}
+	return 1 << uint(channel-1), nil
+}
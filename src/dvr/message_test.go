@@ -0,0 +1,177 @@
+package dvr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// decodePadded decodes a captured hex message, right padding it with zeros to size bytes
+func decodePadded(t *testing.T, values string, size int) []byte {
+	b, err := hex.DecodeString(values + strings.Repeat("0", size*2-len(values)))
+	if err != nil {
+		t.Fatal("Unable to decode expected values: ", err.Error())
+	}
+	return b
+}
+
+func TestIntentRequestMatchesCapture(t *testing.T) {
+	expected := decodePadded(t, "00000000000000000000010000000a7b000000292300000000001c01", RequestSize)
+	res, err := (&IntentRequest{Sequence: 0x7b}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, res) {
+		t.Error("Intent request not as expected")
+	}
+}
+
+func TestIntentResponseIsDecoded(t *testing.T) {
+	data := decodePadded(t, "000000010000000a7b000000292300000000001c010000000100961200", ResponseSize)
+
+	var res IntentResponse
+	if err := res.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Sequence != 0x7b {
+		t.Errorf("Expected sequence 0x7b, got %#x", res.Sequence)
+	}
+	if res.Token != [4]byte{0x01, 0x00, 0x96, 0x12} {
+		t.Errorf("Unexpected token %x", res.Token)
+	}
+}
+
+func TestIntentResponseRejectsOtherCommands(t *testing.T) {
+	data := decodePadded(t, "0000000100000019", ResponseSize)
+
+	var res IntentResponse
+	if err := res.UnmarshalBinary(data); err != ErrUnexpectedCommand {
+		t.Errorf("Expected ErrUnexpectedCommand, got %v", err)
+	}
+}
+
+func TestLoginRequestMatchesCapture(t *testing.T) {
+	expected := decodePadded(t, "0000000000000000000001000000197c000000000000000000005461646d696e"+
+		"000000000000000000000000000000000000000000000000000000706173737764", RequestSize)
+	res, err := (&LoginRequest{Sequence: 0x7c, User: "admin", Pass: "passwd"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, res) {
+		t.Error("Login request not as expected")
+	}
+}
+
+func TestSettingsRequestMatchesCapture(t *testing.T) {
+	expected := decodePadded(t, "00000000000000000000010000000e1c0000000000000000000014", RequestSize)
+	res, err := (&SettingsRequest{Sequence: 0x1c}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, res) {
+		t.Error("Settings request not as expected")
+	}
+}
+
+func TestStreamRequestMatchesCapture(t *testing.T) {
+	expected := decodePadded(t, "0000000000000000000001000000030000000000000000000000680000000100000010"+
+		"00000002000000010000000061646d696e0000000000000000000000000000010000000000000101240000007061737377"+
+		"6400009cc9c805000000000400010004000000a8c9c805", RequestSize)
+	res, err := (&StreamRequest{Channel: 2, User: "admin", Pass: "passwd"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, res) {
+		t.Error("Stream request not as expected")
+	}
+}
+
+func TestStreamRequestEncodesUpperChannels(t *testing.T) {
+	for channel, mask := range map[int]string{
+		1: "00000001", 5: "00000010", 8: "00000080", 9: "00000100", 16: "00008000", 32: "80000000",
+	} {
+		res, err := (&StreamRequest{Channel: channel, User: "admin", Pass: "passwd"}).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The channel mask follows the padding, the header and the version and size fields
+		if got := hex.EncodeToString(res[35:39]); got != mask {
+			t.Errorf("Expected the mask of channel %d to be %s, got %s", channel, mask, got)
+		}
+	}
+}
+
+func TestStreamRequestEncodesStreamType(t *testing.T) {
+	main, err := (&StreamRequest{Channel: 2, User: "admin", Pass: "passwd"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := (&StreamRequest{Channel: 2, Stream: SubStream, User: "admin", Pass: "passwd"}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stream type follows the username and the two words after it, and is the only field which differs
+	if main[71] != byte(MainStream) || sub[71] != byte(SubStream) {
+		t.Errorf("Expected the stream types %d and %d, got %d and %d", MainStream, SubStream, main[71], sub[71])
+	}
+	main[71] = sub[71]
+	if !bytes.Equal(main, sub) {
+		t.Error("Expected only the stream type to differ")
+	}
+
+	if _, err := (&StreamRequest{Channel: 2, Stream: 7}).MarshalBinary(); err == nil {
+		t.Error("Expected an error for an unknown stream type")
+	}
+}
+
+func TestParseStreamType(t *testing.T) {
+	for name, expected := range map[string]StreamType{"main": MainStream, "sub": SubStream} {
+		if st, err := ParseStreamType(name); err != nil || st != expected || st.String() != name {
+			t.Errorf("Expected %s to parse as %d, got %d, %v", name, expected, st, err)
+		}
+	}
+	if _, err := ParseStreamType("mobile"); err == nil {
+		t.Error("Expected an error for an unknown stream type")
+	}
+}
+
+func TestStreamRequestRejectsChannelsOutOfRange(t *testing.T) {
+	for _, channel := range []int{0, MaxChannels + 1} {
+		if _, err := (&StreamRequest{Channel: channel}).MarshalBinary(); err == nil {
+			t.Errorf("Expected an error for channel %d", channel)
+		}
+	}
+}
+
+func TestStreamRequestRejectsLongPassword(t *testing.T) {
+	_, err := (&StreamRequest{Channel: 1, User: "admin", Pass: "password1"}).MarshalBinary()
+	if _, ok := err.(*FieldError); !ok {
+		t.Errorf("Expected a FieldError, got %v", err)
+	}
+}
+
+func TestRepliesCanBeDecoded(t *testing.T) {
+	for values, expected := range map[string]Reply{
+		"0800000002000000": LoginAccepted,
+		"08000000ffffffff": LoginRejected,
+		"1000000000000000": StreamAccepted,
+		"0800000004000000": StreamRejected,
+	} {
+		data, _ := hex.DecodeString(values)
+		res, err := ReadReply(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res != expected {
+			t.Errorf("Reply %s decoded as %+v", values, res)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package dvr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// ReplySize is the size of a status reply
+const ReplySize = 8
+
+// ReplyCode is the status code of a reply
+type ReplyCode uint32
+
+// Reply is the short status reply sent by the DVR after a login or stream request. Unlike requests, replies
+// are little-endian.
+type Reply struct {
+	Length uint32    // Length is the size of the reply, which is larger than ReplySize when a stream follows
+	Code   ReplyCode // Code is the status code of the reply
+}
+
+// Replies observed in captures of the web client
+var (
+	LoginAccepted  = Reply{Length: 8, Code: 0x00000002}  // LoginAccepted is sent after a successful login
+	LoginRejected  = Reply{Length: 8, Code: 0xffffffff}  // LoginRejected is sent after a failed login
+	StreamAccepted = Reply{Length: 16, Code: 0x00000000} // StreamAccepted is sent before the camera stream
+	StreamRejected = Reply{Length: 8, Code: 0x00000004}  // StreamRejected is sent after a failed stream request
+)
+
+// MarshalBinary encodes the reply
+func (r *Reply) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the reply
+func (r *Reply) UnmarshalBinary(data []byte) error {
+	if len(data) < ReplySize {
+		return ErrShortMessage
+	}
+	return binary.Read(bytes.NewReader(data[:ReplySize]), binary.LittleEndian, r)
+}
+
+// ReadReply reads a single reply from r
+func ReadReply(r io.Reader) (Reply, error) {
+	var reply Reply
+	data := make([]byte, ReplySize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return reply, err
+	}
+	return reply, reply.UnmarshalBinary(data)
+}
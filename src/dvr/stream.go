@@ -0,0 +1,43 @@
+package dvr
+
+import (
+	"io"
+)
+
+// RequestStream sends a stream request over rw and reads the DVR's reply. If nil is returned, the camera stream
+// follows on rw. Deadlines are left to the caller; a timed out read is reported as ErrTimeout.
+func RequestStream(rw io.ReadWriter, req *StreamRequest) error {
+	// Encode the stream request
+	data, err := req.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// Send the stream request to the DVR
+	if _, err := rw.Write(data); err != nil {
+		return wrapNetError(err)
+	}
+
+	// Read the reply from the DVR
+	reply, err := ReadReply(rw)
+	if err != nil {
+		return wrapNetError(err)
+	}
+
+	return CheckStreamReply(reply)
+}
+
+// CheckStreamReply returns the error represented by a reply to a stream request, or nil if it was accepted
+func CheckStreamReply(reply Reply) error {
+	switch {
+	case reply == StreamAccepted:
+		return nil
+	case reply == StreamRejected:
+		return ErrInvalidCredentials
+	case reply.Length != ReplySize && reply.Length != StreamAccepted.Length:
+		// Replies are always a known size, so anything else is not a DVR
+		return ErrProtocolMismatch
+	default:
+		return &UnknownReplyError{Reply: reply}
+	}
+}
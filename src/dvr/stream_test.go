@@ -0,0 +1,55 @@
+package dvr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// fakeConn is a ReadWriter which records writes and replays a canned reply
+type fakeConn struct {
+	bytes.Buffer
+	reply *bytes.Reader
+}
+
+func (c *fakeConn) Read(p []byte) (int, error) {
+	return c.reply.Read(p)
+}
+
+func newFakeConn(values string) *fakeConn {
+	data, _ := hex.DecodeString(values)
+	return &fakeConn{reply: bytes.NewReader(data)}
+}
+
+func TestRequestStreamReturnsTypedErrors(t *testing.T) {
+	req := &StreamRequest{Channel: 1, User: "admin", Pass: "passwd"}
+
+	for values, expected := range map[string]error{
+		"1000000000000000": nil,
+		"0800000004000000": ErrInvalidCredentials,
+		"485454502f312e31": ErrProtocolMismatch,
+	} {
+		conn := newFakeConn(values)
+		if err := RequestStream(conn, req); err != expected {
+			t.Errorf("Reply %s returned %v, expected %v", values, err, expected)
+		}
+
+		if conn.Len() != RequestSize {
+			t.Errorf("Expected a %d byte request to be written, got %d", RequestSize, conn.Len())
+		}
+	}
+}
+
+func TestRequestStreamReturnsUnknownReplies(t *testing.T) {
+	err := RequestStream(newFakeConn("0800000009000000"), &StreamRequest{Channel: 1})
+
+	if _, ok := err.(*UnknownReplyError); !ok {
+		t.Fatalf("Expected an UnknownReplyError, got %v", err)
+	}
+	if !IsTemporary(err) {
+		t.Error("Unknown replies should be temporary")
+	}
+	if IsTemporary(ErrInvalidCredentials) {
+		t.Error("Invalid credentials should not be temporary")
+	}
+}
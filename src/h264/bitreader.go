@@ -0,0 +1,83 @@
+package h264
+
+import (
+	"errors"
+)
+
+// ErrShortData is returned when a parameter set ends before all of its fields are read
+var ErrShortData = errors.New("h264: unexpected end of data")
+
+// bitReader reads big-endian bit fields and Exp-Golomb codes from an RBSP
+type bitReader struct {
+	data []byte
+	pos  int // pos is the position of the next bit to read
+}
+
+// u reads an unsigned integer of n bits
+func (r *bitReader) u(n int) (uint32, error) {
+	if r.pos+n > len(r.data)*8 {
+		return 0, ErrShortData
+	}
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit := r.data[r.pos/8] >> uint(7-r.pos%8) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+// flag reads a single bit as a boolean
+func (r *bitReader) flag() (bool, error) {
+	v, err := r.u(1)
+	return v == 1, err
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		bit, err := r.u(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, ErrShortData
+		}
+	}
+	v, err := r.u(zeros)
+	return (1<<uint(zeros) - 1) + v, err
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1), err
+	}
+	return -int32(v / 2), err
+}
+
+// unescapeRBSP removes the emulation prevention bytes from a NAL unit payload
+func unescapeRBSP(data []byte) []byte {
+	rbsp := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		// Drop the 0x03 in any 0x000003 sequence
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
@@ -0,0 +1,83 @@
+package h264
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Sequence parameter sets for a 704x480 baseline stream and a 1920x1080 high profile stream with VUI timing
+const (
+	baselineSPS = "6742c01eda02c0f640"
+	highSPS     = "67640028acca80780227e584000003000400000300ca10"
+)
+
+func TestParseAnnexBSplitsNALUnits(t *testing.T) {
+	sps, _ := hex.DecodeString(baselineSPS)
+	data := AppendAnnexB(nil, sps, []byte{0x68, 0xce, 0x38, 0x80})
+	// Use a three byte start code and trailing zeros for the last unit
+	data = append(data, 0x00, 0x00, 0x01, 0x65, 0x88, 0x84, 0x00, 0x00)
+
+	units := ParseAnnexB(data)
+	if len(units) != 3 {
+		t.Fatalf("Expected 3 NAL units, got %d", len(units))
+	}
+
+	for i, expected := range []NALType{NALSPS, NALPPS, NALIDR} {
+		if units[i].Type != expected {
+			t.Errorf("NAL unit %d has type %d, expected %d", i, units[i].Type, expected)
+		}
+	}
+	if !bytes.Equal(units[0].Data, sps) || !bytes.Equal(units[2].Data, []byte{0x65, 0x88, 0x84}) {
+		t.Error("NAL unit data not as expected")
+	}
+	if !ContainsKeyframe(units) || ContainsKeyframe(units[:2]) {
+		t.Error("Keyframe not detected correctly")
+	}
+}
+
+func TestParseSPSBaseline(t *testing.T) {
+	nal, _ := hex.DecodeString(baselineSPS)
+	s, err := ParseSPS(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ProfileIdc != 66 || s.LevelIdc != 30 || s.Width != 704 || s.Height != 480 {
+		t.Errorf("Unexpected SPS %+v", s)
+	}
+	if s.FrameRate() != 0 {
+		t.Errorf("Expected no frame rate without VUI, got %f", s.FrameRate())
+	}
+}
+
+func TestParseSPSHighWithCroppingAndTiming(t *testing.T) {
+	nal, _ := hex.DecodeString(highSPS)
+	s, err := ParseSPS(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ProfileIdc != 100 || s.LevelIdc != 40 || s.Width != 1920 || s.Height != 1080 {
+		t.Errorf("Unexpected SPS %+v", s)
+	}
+	if s.FrameRate() != 25 {
+		t.Errorf("Expected a frame rate of 25, got %f", s.FrameRate())
+	}
+}
+
+func TestParameterSetsUpdate(t *testing.T) {
+	sps, _ := hex.DecodeString(baselineSPS)
+	units := ParseAnnexB(AppendAnnexB(nil, sps, []byte{0x68, 0xce, 0x38, 0x80}))
+
+	var p ParameterSets
+	if !p.Update(units) || !p.Ready() {
+		t.Fatal("Expected parameter sets to be recorded")
+	}
+	if p.Update(units) {
+		t.Error("Identical parameter sets should not be reported as changed")
+	}
+	if p.SPS.Width != 704 {
+		t.Errorf("Expected a width of 704, got %d", p.SPS.Width)
+	}
+}
@@ -0,0 +1,102 @@
+// Package h264 parses H.264 Annex B byte streams, as sent by the DVR, into NAL units and decodes the parameter
+// sets needed to describe the stream.
+package h264
+
+import (
+	"bytes"
+)
+
+// NALType is the type of a NAL unit
+type NALType uint8
+
+// NAL unit types used by the DVR
+const (
+	NALSlice NALType = 1 // NALSlice is a coded slice of a non-IDR picture
+	NALIDR   NALType = 5 // NALIDR is a coded slice of an IDR picture, which starts a keyframe
+	NALSEI   NALType = 6 // NALSEI is supplemental enhancement information
+	NALSPS   NALType = 7 // NALSPS is a sequence parameter set
+	NALPPS   NALType = 8 // NALPPS is a picture parameter set
+	NALAUD   NALType = 9 // NALAUD is an access unit delimiter
+)
+
+// NALUnit is a single NAL unit without its start code
+type NALUnit struct {
+	Type   NALType // Type is the type of the NAL unit
+	RefIdc uint8   // RefIdc is the nal_ref_idc of the NAL unit
+	Data   []byte  // Data is the NAL unit including its header byte
+}
+
+// StartsAccessUnit reports whether the NAL unit can only appear at the start of an access unit
+func (u *NALUnit) StartsAccessUnit() bool {
+	switch u.Type {
+	case NALAUD, NALSPS, NALPPS, NALSEI:
+		return true
+	}
+	return false
+}
+
+// ParseAnnexB splits an Annex B byte stream into NAL units. Data before the first start code is ignored.
+func ParseAnnexB(data []byte) []NALUnit {
+	var units []NALUnit
+	for _, nal := range SplitAnnexB(data) {
+		units = append(units, NALUnit{
+			Type:   NALType(nal[0] & 0x1f),
+			RefIdc: (nal[0] >> 5) & 0x03,
+			Data:   nal,
+		})
+	}
+	return units
+}
+
+// SplitAnnexB returns the NAL units in an Annex B byte stream with their start codes removed. The returned slices
+// share memory with data.
+func SplitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		// Look for the three byte start code, which is also the tail of a four byte start code
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+
+		// End the previous NAL unit, trimming the leading zero of a four byte start code
+		if start >= 0 {
+			nals = appendNAL(nals, data[start:i])
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 {
+		nals = appendNAL(nals, data[start:])
+	}
+	return nals
+}
+
+// appendNAL appends a NAL unit with any trailing zero bytes removed, skipping empty units
+func appendNAL(nals [][]byte, nal []byte) [][]byte {
+	nal = bytes.TrimRight(nal, "\x00")
+	if len(nal) == 0 {
+		return nals
+	}
+	return append(nals, nal)
+}
+
+// ContainsKeyframe reports whether any of the NAL units is an IDR slice
+func ContainsKeyframe(units []NALUnit) bool {
+	for _, u := range units {
+		if u.Type == NALIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendAnnexB appends the NAL units to dst, each prefixed by a four byte start code
+func AppendAnnexB(dst []byte, nals ...[]byte) []byte {
+	for _, nal := range nals {
+		dst = append(dst, 0, 0, 0, 1)
+		dst = append(dst, nal...)
+	}
+	return dst
+}
@@ -0,0 +1,42 @@
+package h264
+
+import (
+	"bytes"
+)
+
+// ParameterSets tracks the most recent SPS and PPS of a stream, which a decoder needs before any slice
+type ParameterSets struct {
+	SPS     *SPS   // SPS is the decoded sequence parameter set
+	SPSData []byte // SPSData is the sequence parameter set NAL unit
+	PPSData []byte // PPSData is the picture parameter set NAL unit
+}
+
+// Update records any parameter sets found in units, reporting whether either of them changed
+func (p *ParameterSets) Update(units []NALUnit) bool {
+	changed := false
+	for _, u := range units {
+		switch u.Type {
+		case NALSPS:
+			if bytes.Equal(u.Data, p.SPSData) {
+				continue
+			}
+			// Ignore parameter sets which cannot be decoded rather than losing the previous one
+			sps, err := ParseSPS(u.Data)
+			if err != nil {
+				continue
+			}
+			p.SPS, p.SPSData, changed = sps, append([]byte(nil), u.Data...), true
+		case NALPPS:
+			if bytes.Equal(u.Data, p.PPSData) {
+				continue
+			}
+			p.PPSData, changed = append([]byte(nil), u.Data...), true
+		}
+	}
+	return changed
+}
+
+// Ready reports whether both parameter sets have been seen
+func (p *ParameterSets) Ready() bool {
+	return p.SPS != nil && p.PPSData != nil
+}
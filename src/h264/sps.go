@@ -0,0 +1,313 @@
+package h264
+
+import (
+	"errors"
+)
+
+// ErrNotSPS is returned when ParseSPS is given a NAL unit which is not a sequence parameter set
+var ErrNotSPS = errors.New("h264: NAL unit is not a sequence parameter set")
+
+// SPS is a decoded sequence parameter set
+type SPS struct {
+	ProfileIdc      uint8  // ProfileIdc is the profile of the stream (e.g. 66 for baseline)
+	ConstraintFlags uint8  // ConstraintFlags holds the constraint_set flags
+	LevelIdc        uint8  // LevelIdc is the level of the stream multiplied by ten
+	ID              uint32 // ID is the seq_parameter_set_id
+	ChromaFormatIdc uint32 // ChromaFormatIdc is the chroma sampling format, which is 1 (4:2:0) unless stated
+	Log2MaxFrameNum uint32 // Log2MaxFrameNum is the number of bits used for frame_num in slice headers
+	PicOrderCntType uint32 // PicOrderCntType is the picture order count type
+	MaxNumRefFrames uint32 // MaxNumRefFrames is the maximum number of reference frames
+	FrameMbsOnly    bool   // FrameMbsOnly is false for interlaced streams
+	Width           int    // Width is the cropped width of the picture in pixels
+	Height          int    // Height is the cropped height of the picture in pixels
+	NumUnitsInTick  uint32 // NumUnitsInTick is from the VUI timing info, or zero if absent
+	TimeScale       uint32 // TimeScale is from the VUI timing info, or zero if absent
+	FixedFrameRate  bool   // FixedFrameRate is from the VUI timing info
+}
+
+// FrameRate returns the frame rate given by the VUI timing info, or zero if it is absent
+func (s *SPS) FrameRate() float64 {
+	if s.NumUnitsInTick == 0 {
+		return 0
+	}
+	return float64(s.TimeScale) / float64(2*s.NumUnitsInTick)
+}
+
+// ParseSPS decodes a sequence parameter set NAL unit, including its header byte
+func ParseSPS(nal []byte) (*SPS, error) {
+	if len(nal) < 4 {
+		return nil, ErrShortData
+	}
+	if NALType(nal[0]&0x1f) != NALSPS {
+		return nil, ErrNotSPS
+	}
+
+	s := &SPS{ProfileIdc: nal[1], ConstraintFlags: nal[2], LevelIdc: nal[3], ChromaFormatIdc: 1}
+	r := &bitReader{data: unescapeRBSP(nal[4:])}
+	if err := s.parse(r); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parse decodes the fields of the SPS following the level
+func (s *SPS) parse(r *bitReader) error {
+	var err error
+	if s.ID, err = r.ue(); err != nil {
+		return err
+	}
+
+	// High profiles describe their chroma format, bit depth and scaling matrices
+	switch s.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if s.ChromaFormatIdc, err = r.ue(); err != nil {
+			return err
+		}
+		if s.ChromaFormatIdc == 3 {
+			// separate_colour_plane_flag
+			if _, err = r.u(1); err != nil {
+				return err
+			}
+		}
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		for i := 0; i < 2; i++ {
+			if _, err = r.ue(); err != nil {
+				return err
+			}
+		}
+		// qpprime_y_zero_transform_bypass_flag
+		if _, err = r.u(1); err != nil {
+			return err
+		}
+		if err = skipScalingMatrix(r, s.ChromaFormatIdc); err != nil {
+			return err
+		}
+	}
+
+	log2MaxFrameNumMinus4, err := r.ue()
+	if err != nil {
+		return err
+	}
+	s.Log2MaxFrameNum = log2MaxFrameNumMinus4 + 4
+
+	if s.PicOrderCntType, err = r.ue(); err != nil {
+		return err
+	}
+	switch s.PicOrderCntType {
+	case 0:
+		// log2_max_pic_order_cnt_lsb_minus4
+		if _, err = r.ue(); err != nil {
+			return err
+		}
+	case 1:
+		// delta_pic_order_always_zero_flag, offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		if _, err = r.u(1); err != nil {
+			return err
+		}
+		if _, err = r.se(); err != nil {
+			return err
+		}
+		if _, err = r.se(); err != nil {
+			return err
+		}
+		cycle, err := r.ue()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < cycle; i++ {
+			if _, err = r.se(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.MaxNumRefFrames, err = r.ue(); err != nil {
+		return err
+	}
+	// gaps_in_frame_num_value_allowed_flag
+	if _, err = r.u(1); err != nil {
+		return err
+	}
+
+	widthMbs, err := r.ue()
+	if err != nil {
+		return err
+	}
+	heightMapUnits, err := r.ue()
+	if err != nil {
+		return err
+	}
+	if s.FrameMbsOnly, err = r.flag(); err != nil {
+		return err
+	}
+	if !s.FrameMbsOnly {
+		// mb_adaptive_frame_field_flag
+		if _, err = r.u(1); err != nil {
+			return err
+		}
+	}
+	// direct_8x8_inference_flag
+	if _, err = r.u(1); err != nil {
+		return err
+	}
+
+	// Calculate the picture size before cropping
+	frameHeightFactor := 2
+	if s.FrameMbsOnly {
+		frameHeightFactor = 1
+	}
+	s.Width = int(widthMbs+1) * 16
+	s.Height = int(heightMapUnits+1) * 16 * frameHeightFactor
+
+	cropping, err := r.flag()
+	if err != nil {
+		return err
+	}
+	if cropping {
+		var crop [4]uint32 // left, right, top, bottom
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return err
+			}
+		}
+
+		// Crop units depend on the chroma subsampling
+		cropUnitX, cropUnitY := 1, frameHeightFactor
+		switch s.ChromaFormatIdc {
+		case 1:
+			cropUnitX, cropUnitY = 2, 2*frameHeightFactor
+		case 2:
+			cropUnitX = 2
+		}
+		s.Width -= int(crop[0]+crop[1]) * cropUnitX
+		s.Height -= int(crop[2]+crop[3]) * cropUnitY
+	}
+
+	vui, err := r.flag()
+	if err != nil || !vui {
+		return err
+	}
+
+	// A truncated VUI still leaves a usable SPS, so its errors are ignored
+	s.parseVUITiming(r)
+	return nil
+}
+
+// parseVUITiming decodes the VUI parameters as far as the timing info
+func (s *SPS) parseVUITiming(r *bitReader) error {
+	// aspect_ratio_info_present_flag
+	if present, err := r.flag(); err != nil {
+		return err
+	} else if present {
+		idc, err := r.u(8)
+		if err != nil {
+			return err
+		}
+		// Extended_SAR carries the sar_width and sar_height
+		if idc == 255 {
+			if _, err = r.u(32); err != nil {
+				return err
+			}
+		}
+	}
+
+	// overscan_info_present_flag
+	if present, err := r.flag(); err != nil {
+		return err
+	} else if present {
+		if _, err = r.u(1); err != nil {
+			return err
+		}
+	}
+
+	// video_signal_type_present_flag
+	if present, err := r.flag(); err != nil {
+		return err
+	} else if present {
+		// video_format, video_full_range_flag
+		if _, err = r.u(4); err != nil {
+			return err
+		}
+		colour, err := r.flag()
+		if err != nil {
+			return err
+		}
+		if colour {
+			if _, err = r.u(24); err != nil {
+				return err
+			}
+		}
+	}
+
+	// chroma_loc_info_present_flag
+	if present, err := r.flag(); err != nil {
+		return err
+	} else if present {
+		if _, err = r.ue(); err != nil {
+			return err
+		}
+		if _, err = r.ue(); err != nil {
+			return err
+		}
+	}
+
+	// timing_info_present_flag
+	if present, err := r.flag(); err != nil || !present {
+		return err
+	}
+	numUnitsInTick, err := r.u(32)
+	if err != nil {
+		return err
+	}
+	timeScale, err := r.u(32)
+	if err != nil {
+		return err
+	}
+	fixed, err := r.flag()
+	if err != nil {
+		return err
+	}
+	s.NumUnitsInTick, s.TimeScale, s.FixedFrameRate = numUnitsInTick, timeScale, fixed
+	return nil
+}
+
+// skipScalingMatrix skips over the seq_scaling_matrix of high profile streams
+func skipScalingMatrix(r *bitReader, chromaFormatIdc uint32) error {
+	present, err := r.flag()
+	if err != nil || !present {
+		return err
+	}
+
+	count := 8
+	if chromaFormatIdc == 3 {
+		count = 12
+	}
+	for i := 0; i < count; i++ {
+		listPresent, err := r.flag()
+		if err != nil {
+			return err
+		}
+		if !listPresent {
+			continue
+		}
+
+		size := 16
+		if i >= 6 {
+			size = 64
+		}
+		last, next := int32(8), int32(8)
+		for j := 0; j < size; j++ {
+			if next != 0 {
+				delta, err := r.se()
+				if err != nil {
+					return err
+				}
+				next = (last + delta + 256) % 256
+			}
+			if next != 0 {
+				last = next
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package hls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaylistListsNewestSegments(t *testing.T) {
+	w := NewWindow(FormatTS, 2)
+	if _, ok := w.Playlist(); ok {
+		t.Error("Expected no playlist before the first segment")
+	}
+
+	w.Add([]byte{0}, 2*time.Second)
+	w.Add([]byte{1}, 2500*time.Millisecond)
+	w.Add([]byte{2}, 2*time.Second)
+
+	playlist, ok := w.Playlist()
+	if !ok {
+		t.Fatal("Expected a playlist")
+	}
+	expected := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+		"#EXTINF:2.500,\n1.ts\n#EXTINF:2.000,\n2.ts\n"
+	if string(playlist) != expected {
+		t.Errorf("Expected playlist:\n%s\nbut got:\n%s", expected, playlist)
+	}
+}
+
+func TestWindowDropsOldSegments(t *testing.T) {
+	w := NewWindow(FormatTS, 1)
+	for i := 0; i < 4; i++ {
+		w.Add([]byte{byte(i)}, time.Second)
+	}
+
+	// Segments stay available for one playlist length after they stop being listed
+	if _, ok := w.Segment(1); ok {
+		t.Error("Expected segment 1 to have been dropped")
+	}
+	for _, sequence := range []uint64{2, 3} {
+		data, ok := w.Segment(sequence)
+		if !ok || data[0] != byte(sequence) {
+			t.Errorf("Expected segment %d to be available", sequence)
+		}
+	}
+}
+
+func TestFMP4PlaylistReferencesInit(t *testing.T) {
+	w := NewWindow(FormatFMP4, 3)
+	w.SetInit([]byte("init"))
+	w.Add([]byte{0}, time.Second)
+
+	playlist, _ := w.Playlist()
+	if !strings.Contains(string(playlist), "#EXT-X-MAP:URI=\"init.mp4\"\n") ||
+		!strings.Contains(string(playlist), "\n0.m4s\n") {
+		t.Errorf("Expected playlist to reference init section and m4s segments, got:\n%s", playlist)
+	}
+}
+
+func TestParameterChangesAddDiscontinuities(t *testing.T) {
+	w := NewWindow(FormatFMP4, 3)
+	w.SetInit([]byte("first"))
+	w.Add([]byte{0}, time.Second)
+	w.SetInit([]byte("second"))
+	w.Add([]byte{1}, time.Second)
+
+	// The segment before the change is kept along with its init section
+	playlist, _ := w.Playlist()
+	expected := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:1.000,\n0.m4s\n" +
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init-1.mp4\"\n#EXTINF:1.000,\n1.m4s\n"
+	if string(playlist) != expected {
+		t.Errorf("Expected playlist:\n%s\nbut got:\n%s", expected, playlist)
+	}
+	for name, expected := range map[string]string{"init.mp4": "first", "init-1.mp4": "second"} {
+		if data, ok := w.Init(name); !ok || string(data) != expected {
+			t.Errorf("Expected %s to be %q, got %q", name, expected, data)
+		}
+	}
+
+	// Once the segment before the change is dropped, the discontinuity is counted instead of listed
+	for i := 0; i < 6; i++ {
+		w.Add([]byte{byte(i + 2)}, time.Second)
+	}
+	playlist, _ = w.Playlist()
+	if !strings.Contains(string(playlist), "#EXT-X-DISCONTINUITY-SEQUENCE:1\n#EXT-X-MAP:URI=\"init-1.mp4\"\n") ||
+		strings.Contains(string(playlist), "#EXT-X-DISCONTINUITY\n") {
+		t.Errorf("Expected the discontinuity to be counted, got:\n%s", playlist)
+	}
+	if _, ok := w.Init(InitName); ok {
+		t.Error("Expected the first init section to be dropped along with its segments")
+	}
+}
+
+func TestServerServesStreams(t *testing.T) {
+	w := NewWindow(FormatTS, 3)
+	w.Add([]byte("segment"), time.Second)
+	s := NewServer()
+	s.SetWindow("site/2", w)
+
+	for _, test := range []struct {
+		path        string
+		status      int
+		contentType string
+	}{
+		{"/live/site/2/index.m3u8", http.StatusOK, "application/vnd.apple.mpegurl"},
+		{"/live/site/2/0.ts", http.StatusOK, "video/mp2t"},
+		{"/live/site/2/0.m4s", http.StatusNotFound, ""},
+		{"/live/site/2/1.ts", http.StatusNotFound, ""},
+		{"/live/site/2/init.mp4", http.StatusNotFound, ""},
+		{"/live/site/3/index.m3u8", http.StatusNotFound, ""},
+		{"/live/2/index.m3u8", http.StatusNotFound, ""},
+		{"/live/index.m3u8", http.StatusNotFound, ""},
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("Expected status %d for %s but got %d", test.status, test.path, rec.Code)
+		}
+		if test.contentType != "" && rec.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("Expected content type %s for %s but got %s", test.contentType, test.path,
+				rec.Header().Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package hls
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PathPrefix is the path under which streams are served, as /live/<name>/index.m3u8 where names may contain slashes
+const PathPrefix = "/live/"
+
+// PlaylistName is the name of the media playlist of each stream
+const PlaylistName = "index.m3u8"
+
+// Server serves the playlists and segments of each stream over HTTP
+type Server struct {
+	mu      sync.RWMutex
+	windows map[string]*Window // windows are the live windows of each stream by name
+}
+
+// NewServer creates a Server with no streams
+func NewServer() *Server {
+	return &Server{windows: make(map[string]*Window)}
+}
+
+// SetWindow serves the window as the stream with the name
+func (s *Server) SetWindow(name string, w *Window) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.windows[name] = w
+}
+
+// ServeHTTP serves the playlist, init section and segments of a stream
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Split the path into the stream and file name
+	path := strings.TrimPrefix(r.URL.Path, PathPrefix)
+	slash := strings.LastIndexByte(path, '/')
+	if slash < 0 {
+		http.NotFound(rw, r)
+		return
+	}
+	s.mu.RLock()
+	w := s.windows[path[:slash]]
+	s.mu.RUnlock()
+	if w == nil {
+		http.NotFound(rw, r)
+		return
+	}
+
+	// Allow browser players on other origins to fetch the stream
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var data []byte
+	var ok bool
+	name := path[slash+1:]
+	switch {
+	case name == PlaylistName:
+		// Playlists change with every segment so must not be cached
+		data, ok = w.Playlist()
+		rw.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		rw.Header().Set("Cache-Control", "no-cache")
+	case strings.HasPrefix(name, "init") && w.Format() == FormatFMP4:
+		data, ok = w.Init(name)
+		rw.Header().Set("Content-Type", "video/mp4")
+	default:
+		// Segments are named by their sequence number
+		var sequence uint64
+		sequence, ok = parseSegmentName(w, name)
+		if ok {
+			data, ok = w.Segment(sequence)
+		}
+		if w.Format() == FormatFMP4 {
+			rw.Header().Set("Content-Type", "video/iso.segment")
+		} else {
+			rw.Header().Set("Content-Type", "video/mp2t")
+		}
+	}
+
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodGet {
+		rw.Write(data)
+	}
+}
+
+// parseSegmentName returns the sequence number of a segment name, or false if it is not a segment of the window
+func parseSegmentName(w *Window, name string) (uint64, bool) {
+	dot := strings.LastIndexByte(name, '.')
+	if dot < 0 {
+		return 0, false
+	}
+	sequence, err := strconv.ParseUint(name[:dot], 10, 64)
+	if err != nil || w.SegmentName(sequence) != name {
+		return 0, false
+	}
+	return sequence, true
+}
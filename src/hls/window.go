@@ -0,0 +1,204 @@
+// Package hls serves live streams as HTTP Live Streaming media playlists with a rolling window of segments held in
+// memory.
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Segment formats
+const (
+	FormatTS   = "ts"   // FormatTS serves MPEG-TS segments
+	FormatFMP4 = "fmp4" // FormatFMP4 serves fragmented MP4 segments after an init section
+)
+
+// InitName is the name of the first init section of fragmented MP4 playlists. The init sections which follow changes
+// to the stream parameters are named init-<number>.mp4.
+const InitName = "init.mp4"
+
+// segment is a media segment in the window
+type segment struct {
+	sequence      uint64        // sequence is the media sequence number of the segment
+	duration      time.Duration // duration is the playback duration of the segment
+	data          []byte        // data is the media of the segment
+	init          uint64        // init is the number of the init section of the segment
+	discontinuity uint64        // discontinuity is the number of discontinuities before the segment
+	discontinuous bool          // discontinuous is set if the stream parameters changed before the segment
+}
+
+// initSection is an init section of fragmented MP4 segments
+type initSection struct {
+	number uint64 // number is the number of the init section, counting from 0
+	data   []byte // data is the init section
+}
+
+// Window holds the most recent segments of a live stream. It is safe to add segments while playlists and segments
+// are being served.
+type Window struct {
+	mu            sync.RWMutex
+	format        string        // format is either FormatTS or FormatFMP4
+	size          int           // size is the number of segments listed in the playlist
+	inits         []initSection // inits are the init sections used by the segments, oldest first
+	segments      []segment     // segments are the segments in the window, oldest first
+	next          uint64        // next is the media sequence number of the next segment
+	discontinuity uint64        // discontinuity is the number of discontinuities before the next segment
+	discontinuous bool          // discontinuous is set if the next segment follows a change of stream parameters
+}
+
+// NewWindow creates a Window listing up to size segments of the format
+func NewWindow(format string, size int) *Window {
+	if size < 1 {
+		size = 1
+	}
+	return &Window{format: format, size: size}
+}
+
+// Format returns the segment format of the window
+func (w *Window) Format() string {
+	return w.format
+}
+
+// SetInit sets the init section of the following segments, which is needed when the stream starts and whenever its
+// parameters change. Segments which follow a change are listed after a discontinuity so that players reset their
+// decoders, while the segments before it stay in the window along with their init section. The init section is nil
+// for MPEG-TS segments.
+func (w *Window) SetInit(init []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.next > 0 && !w.discontinuous {
+		w.discontinuous = true
+		w.discontinuity++
+	}
+	if init == nil {
+		return
+	}
+
+	// Replace the current init section if no segment uses it yet
+	number := uint64(0)
+	if n := len(w.inits); n > 0 {
+		number = w.inits[n-1].number
+		if len(w.segments) > 0 && w.segments[len(w.segments)-1].init == number {
+			number++
+		} else {
+			w.inits = w.inits[:n-1]
+		}
+	}
+	w.inits = append(w.inits, initSection{number: number, data: init})
+}
+
+// Add appends a segment to the window, dropping the oldest segment once the window is full. Segments are kept for
+// one extra playlist length so that players which have just loaded the playlist can still fetch them.
+func (w *Window) Add(data []byte, duration time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := segment{sequence: w.next, duration: duration, data: data, discontinuity: w.discontinuity,
+		discontinuous: w.discontinuous}
+	if n := len(w.inits); n > 0 {
+		s.init = w.inits[n-1].number
+	}
+	w.segments = append(w.segments, s)
+	w.next++
+	w.discontinuous = false
+	if len(w.segments) > 2*w.size {
+		w.segments = w.segments[len(w.segments)-2*w.size:]
+	}
+
+	// Drop the init sections which no segment uses any more
+	for len(w.inits) > 1 && w.inits[0].number < w.segments[0].init {
+		w.inits = w.inits[1:]
+	}
+}
+
+// Playlist returns the media playlist, or false if no segments are ready
+func (w *Window) Playlist() ([]byte, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if len(w.segments) == 0 {
+		return nil, false
+	}
+
+	// Only the newest segments are listed
+	listed := w.segments
+	if len(listed) > w.size {
+		listed = listed[len(listed)-w.size:]
+	}
+
+	// The target duration is the longest segment rounded up to whole seconds
+	target := 1
+	for _, s := range listed {
+		if d := int(math.Ceil(s.duration.Seconds())); d > target {
+			target = d
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("#EXTM3U\n")
+	if w.format == FormatFMP4 {
+		// Fragmented MP4 segments need version 7
+		fmt.Fprintf(buf, "#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n",
+			target, listed[0].sequence)
+	} else {
+		fmt.Fprintf(buf, "#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n",
+			target, listed[0].sequence)
+	}
+
+	// Players match up discontinuities across playlists by counting those which are no longer listed
+	if listed[0].discontinuity > 0 {
+		fmt.Fprintf(buf, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", listed[0].discontinuity)
+	}
+	for i, s := range listed {
+		if s.discontinuous && i > 0 {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		// Segments refer to the init section in force since the last discontinuity
+		if w.format == FormatFMP4 && (i == 0 || s.init != listed[i-1].init) {
+			fmt.Fprintf(buf, "#EXT-X-MAP:URI=\"%s\"\n", initName(s.init))
+		}
+		fmt.Fprintf(buf, "#EXTINF:%.3f,\n%s\n", s.duration.Seconds(), w.SegmentName(s.sequence))
+	}
+	return buf.Bytes(), true
+}
+
+// Segment returns the data of the segment with the sequence number, or false if it is no longer in the window
+func (w *Window) Segment(sequence uint64) ([]byte, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, s := range w.segments {
+		if s.sequence == sequence {
+			return s.data, true
+		}
+	}
+	return nil, false
+}
+
+// Init returns the init section of fragmented MP4 segments with the name, or false if it is no longer in the window
+func (w *Window) Init(name string) ([]byte, bool) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, init := range w.inits {
+		if initName(init.number) == name {
+			return init.data, true
+		}
+	}
+	return nil, false
+}
+
+// initName returns the name of the init section with the number as listed in the playlist
+func initName(number uint64) string {
+	if number == 0 {
+		return InitName
+	}
+	return fmt.Sprintf("init-%d.mp4", number)
+}
+
+// SegmentName returns the name of the segment with the sequence number as listed in the playlist
+func (w *Window) SegmentName(sequence uint64) string {
+	if w.format == FormatFMP4 {
+		return fmt.Sprintf("%d.m4s", sequence)
+	}
+	return fmt.Sprintf("%d.ts", sequence)
+}
@@ -0,0 +1,63 @@
+package jsonfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempPath returns the path of a file in a temporary folder which is removed after the test
+func tempPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "jsonfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "state.json")
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := tempPath(t)
+	if err := Save(path, map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(path, map[string]int{"b": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var state map[string]int
+	if err := Load(path, &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state) != 1 || state["b"] != 2 {
+		t.Errorf("Expected the file to be replaced, got %v", state)
+	}
+
+	// Only the file itself is left behind, readable by its owner alone
+	entries, _ := ioutil.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 || entries[0].Mode().Perm() != 0600 {
+		t.Errorf("Expected a single file with mode 0600, got %v", entries)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	state := map[string]int{"kept": 1}
+	if err := Load(tempPath(t), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state["kept"] != 1 {
+		t.Errorf("Expected the value to be unchanged, got %v", state)
+	}
+}
+
+func TestLoadReportsInvalidFiles(t *testing.T) {
+	path := tempPath(t)
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var state map[string]int
+	if err := Load(path, &state); err == nil {
+		t.Error("Expected an error for an invalid file")
+	}
+}
@@ -3,20 +3,10 @@ package main
 import (
 	"flag"
 	"os"
-	"encoding/hex"
-	"strconv"
+	"io"
 	"fmt"
 	"net"
-	"bytes"
-)
-
-// Declare values of the byte arrays required in string form
-const (
-	IntentValues          = "00000000000000000000010000000aXX000000292300000000001c010000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
-	IntentResponseValues  = "000000010000000aXX000000292300000000001c010000000100961200000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
-	AuthValues            = "000000000000000000000100000019YY0000000000000000000054000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
-	SuccessfulLoginValues = "0800000002000000"
-	FailedLoginValues     = "08000000FFFFFFFF"
+	"github.com/kz/swanntools/src/dvr"
 )
 
 // Initialize flag variables
@@ -31,53 +21,29 @@ func init() {
 	flag.StringVar(&pass, "pass", "", "Password to authenticate with")
 }
 
-func getIntentMessage(intentValue string) []byte {
-	hexValues := IntentValues[:30] + intentValue + IntentValues[32:]
-	byteArray, err := hex.DecodeString(hexValues)
+func getIntentMessage(intentValue uint8) []byte {
+	byteArray, err := (&dvr.IntentRequest{Sequence: intentValue}).MarshalBinary()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Unable to decode intent message to byte array: ", err.Error())
+		fmt.Fprintln(os.Stderr, "Unable to encode intent message to byte array: ", err.Error())
 		os.Exit(1)
 	}
 	return byteArray
 }
 
-func getIntentResponseMessage(intentValue string) []byte {
-	hexValues := IntentResponseValues[:16] + intentValue + IntentResponseValues[18:]
-	byteArray, err := hex.DecodeString(hexValues)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Unable to decode intent response message to byte array: ", err.Error())
-		os.Exit(1)
+func checkIntentResponseMessage(intentValue uint8, reply []byte) bool {
+	var res dvr.IntentResponse
+	if err := res.UnmarshalBinary(reply); err != nil {
+		return false
 	}
-	return byteArray
+	return res.Sequence == intentValue
 }
 
-func getLoginMessage(user string, pass string, intentValue string) []byte {
-	// Add incremented intent value to hex values
-	parsedIntentValue, err := strconv.ParseInt(intentValue, 16, 8)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Unable to parse intent value to inty: ", err.Error())
-		os.Exit(1)
-	}
-	incIntentHexValue := fmt.Sprintf("%x", parsedIntentValue+1)
-	hexValues := AuthValues[:30] + incIntentHexValue + AuthValues[32:]
-
-	// Add username to hex values
-	for i, v := range user {
-		startPos := 54 + 2*i
-		endPos := 56 + 2*i
-		hexValues = hexValues[:startPos] + fmt.Sprintf("%x", int(v)) + hexValues[endPos:]
-	}
-
-	// Add password to hex values
-	for i, v := range pass {
-		startPos := 118 + 2*i
-		endPos := 120 + 2*i
-		hexValues = hexValues[:startPos] + fmt.Sprintf("%x", int(v)) + hexValues[endPos:]
-	}
-
-	byteArray, err := hex.DecodeString(hexValues)
+func getLoginMessage(user string, pass string, intentValue uint8) []byte {
+	// The login sequence value is always one greater than the intent value
+	req := &dvr.LoginRequest{Sequence: intentValue + 1, User: user, Pass: pass}
+	byteArray, err := req.MarshalBinary()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Unable to decode login message to byte array: ", err.Error())
+		fmt.Fprintln(os.Stderr, "Unable to encode login message to byte array: ", err.Error())
 		os.Exit(1)
 	}
 	return byteArray
@@ -85,9 +51,8 @@ func getLoginMessage(user string, pass string, intentValue string) []byte {
 }
 
 // Reference: https://gist.github.com/iwanbk/2295233
-func sendIntent(intentValue string, tcpAddr *net.TCPAddr) {
+func sendIntent(intentValue uint8, tcpAddr *net.TCPAddr) {
 	intentMessage := getIntentMessage(intentValue)
-	intentResponseMessage := getIntentResponseMessage(intentValue)
 
 	// Set up the intent connection
 	intentConn, err := net.DialTCP("tcp", nil, tcpAddr)
@@ -107,8 +72,8 @@ func sendIntent(intentValue string, tcpAddr *net.TCPAddr) {
 
 	// Receive the intent response message
 	fmt.Fprintln(os.Stdout, "Receiving intent response message.")
-	intentReply := make([]byte, 500)
-	_, err = intentConn.Read(intentReply)
+	intentReply := make([]byte, dvr.ResponseSize)
+	_, err = io.ReadFull(intentConn, intentReply)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Connection read of intent message response failed:", err.Error())
 		os.Exit(1)
@@ -116,16 +81,14 @@ func sendIntent(intentValue string, tcpAddr *net.TCPAddr) {
 
 	// Check whether the intent message response is as expected
 	fmt.Fprintln(os.Stdout, "Checking intent response message.")
-	if !bytes.Equal(intentReply, intentResponseMessage) {
+	if !checkIntentResponseMessage(intentValue, intentReply) {
 		fmt.Fprintln(os.Stderr, "Intent message response not as expected: ", string(intentReply))
 		os.Exit(1)
 	}
 }
 
-func sendLogin(intentValue string, tcpAddr *net.TCPAddr) {
+func sendLogin(intentValue uint8, tcpAddr *net.TCPAddr) {
 	loginMessage := getLoginMessage(user, pass, intentValue)
-	successfulLoginMessage, _ := hex.DecodeString(SuccessfulLoginValues)
-	failedLoginMessage, _ := hex.DecodeString(FailedLoginValues)
 
 	// Set up the login connection
 	loginConn, err := net.DialTCP("tcp", nil, tcpAddr)
@@ -145,8 +108,7 @@ func sendLogin(intentValue string, tcpAddr *net.TCPAddr) {
 
 	// Receive the login response message
 	fmt.Fprintln(os.Stdout, "Receiving login response message.")
-	loginReply := make([]byte, 8)
-	_, err = loginConn.Read(loginReply)
+	loginReply, err := dvr.ReadReply(loginConn)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Connection read of intent message response failed:", err.Error())
 		os.Exit(1)
@@ -154,9 +116,9 @@ func sendLogin(intentValue string, tcpAddr *net.TCPAddr) {
 
 	// Check the login response message status
 	fmt.Fprintln(os.Stdout, "Checking login response message.")
-	if bytes.Equal(loginReply, successfulLoginMessage) {
+	if loginReply == dvr.LoginAccepted {
 		fmt.Fprintln(os.Stdout, "Successfully logged in!")
-	} else if bytes.Equal(loginReply, failedLoginMessage) {
+	} else if loginReply == dvr.LoginRejected {
 		fmt.Fprintln(os.Stderr, "Authentication failed due to invalid credentials.")
 		os.Exit(1)
 	} else {
@@ -167,8 +129,11 @@ func sendLogin(intentValue string, tcpAddr *net.TCPAddr) {
 
 func sendSettings(tcpAddr *net.TCPAddr) {
 	// Send the DVR setup message request
-	SetupMessageValues := "00000000000000000000010000000e1c0000000000000000000014000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
-	setupMessage, _ := hex.DecodeString(SetupMessageValues)
+	setupMessage, err := (&dvr.SettingsRequest{Sequence: 0x1c}).MarshalBinary()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to encode setup message to byte array: ", err.Error())
+		os.Exit(1)
+	}
 	setupConn, err := net.DialTCP("tcp", nil, tcpAddr)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Dial failed:", err.Error())
@@ -193,7 +158,7 @@ func sendSettings(tcpAddr *net.TCPAddr) {
 		os.Exit(1)
 	}
 
-	println(string(setupRead))
+	println(string(setupReply[:setupRead]))
 }
 
 func main() {
@@ -217,7 +182,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	sendIntent("1a", tcpAddr)
-	sendLogin("1a", tcpAddr)
+	sendIntent(0x1a, tcpAddr)
+	sendLogin(0x1a, tcpAddr)
 	sendSettings(tcpAddr)
 }
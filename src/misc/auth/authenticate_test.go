@@ -5,7 +5,7 @@ import (
 	"os"
 	"encoding/hex"
 	"bytes"
-	"fmt"
+	"github.com/kz/swanntools/src/dvr"
 )
 
 func setUpEnvVars() {
@@ -16,20 +16,26 @@ func setUpEnvVars() {
 }
 
 func TestLoginValuesCanBeDecoded(t *testing.T) {
-	_, err := hex.DecodeString(SuccessfulLoginValues)
+	successfulLoginMessage, err := hex.DecodeString("0800000002000000")
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Unable to decode successful login values to byte array: ", err.Error())
+		t.Fatal("Unable to decode successful login values to byte array: ", err.Error())
+	}
+	if reply, err := dvr.ReadReply(bytes.NewReader(successfulLoginMessage)); err != nil || reply != dvr.LoginAccepted {
+		t.Errorf("Successful login values decoded as %+v, %v", reply, err)
 	}
 
-	_, err = hex.DecodeString(FailedLoginValues)
+	failedLoginMessage, err := hex.DecodeString("08000000FFFFFFFF")
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Unable to decode failed login values to byte array: ", err.Error())
+		t.Fatal("Unable to decode failed login values to byte array: ", err.Error())
+	}
+	if reply, err := dvr.ReadReply(bytes.NewReader(failedLoginMessage)); err != nil || reply != dvr.LoginRejected {
+		t.Errorf("Failed login values decoded as %+v, %v", reply, err)
 	}
 }
 
 func TestIntentMessageCorrectlySetsIntentValue(t *testing.T) {
 	expected, _ := hex.DecodeString("00000000000000000000010000000a7b000000292300000000001c010000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-	res := getIntentMessage("7b")
+	res := getIntentMessage(0x7b)
 
 	if !bytes.Equal(expected, res) {
 		t.Error("Intent message not as expected")
@@ -37,17 +43,20 @@ func TestIntentMessageCorrectlySetsIntentValue(t *testing.T) {
 }
 
 func TestIntentMessageResponseCorrectlySetsIntentValue(t *testing.T) {
-	expected, _ := hex.DecodeString("000000010000000a7b000000292300000000001c010000000100961200000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-	res := getIntentResponseMessage("7b")
+	reply, _ := hex.DecodeString("000000010000000a7b000000292300000000001c010000000100961200000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
 
-	if !bytes.Equal(expected, res) {
+	if !checkIntentResponseMessage(0x7b, reply) {
 		t.Error("Intent message response not as expected")
 	}
+
+	if checkIntentResponseMessage(0x7c, reply) {
+		t.Error("Intent message response accepted for the wrong intent value")
+	}
 }
 
 func TestLoginMessageCorrectlySetsValues(t *testing.T) {
 	expected, _ := hex.DecodeString("0000000000000000000001000000197c000000000000000000005461646d696e00000000000000000000000000000000000000000000000000000070617373776400000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
-	res := getLoginMessage("admin", "passwd", "7b")
+	res := getLoginMessage("admin", "passwd", 0x7b)
 
 	if !bytes.Equal(expected, res) {
 		t.Error("Login message not as expected")
@@ -0,0 +1,62 @@
+// Package mp4 writes fragmented MP4 (ISO BMFF) files containing a single H264 video track, so recordings can be
+// played and seeked in browsers and players without knowing the length of the recording up front.
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+// box encodes an ISO BMFF box of the given type around the payloads
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b[0:4], uint32(size))
+	copy(b[4:8], typ)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox encodes a box with a version and flags preceding the payloads
+func fullBox(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	header := u32(nil, uint32(version)<<24|flags&0x00ffffff)
+	return box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// u8 appends an 8 bit integer to b
+func u8(b []byte, v uint8) []byte {
+	return append(b, v)
+}
+
+// u16 appends a big-endian 16 bit integer to b
+func u16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// u32 appends a big-endian 32 bit integer to b
+func u32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// u64 appends a big-endian 64 bit integer to b
+func u64(b []byte, v uint64) []byte {
+	return u32(u32(b, uint32(v>>32)), uint32(v))
+}
+
+// zeros appends n zero bytes to b
+func zeros(b []byte, n int) []byte {
+	return append(b, make([]byte, n)...)
+}
+
+// matrix appends the unity transformation matrix used by mvhd and tkhd to b
+func matrix(b []byte) []byte {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b = u32(b, v)
+	}
+	return b
+}
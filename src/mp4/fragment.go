@@ -0,0 +1,84 @@
+package mp4
+
+import (
+	"github.com/kz/swanntools/src/h264"
+)
+
+// Sample flags, as stored in the trun box
+const (
+	keyframeFlags    = 0x02000000 // keyframeFlags marks a sample which does not depend on others
+	nonKeyframeFlags = 0x01010000 // nonKeyframeFlags marks a sample which depends on others and is not a sync sample
+)
+
+// trun flags stating which fields are present
+const (
+	trunDataOffset     = 0x000001
+	trunSampleDuration = 0x000100
+	trunSampleSize     = 0x000200
+	trunSampleFlags    = 0x000400
+)
+
+// tfhdDefaultBaseIsMoof makes sample data offsets relative to the start of the moof box
+const tfhdDefaultBaseIsMoof = 0x020000
+
+// Sample is a single access unit of video
+type Sample struct {
+	Data     []byte // Data is the access unit with each NAL unit prefixed by its four byte length
+	Duration uint32 // Duration is the duration of the sample in Timescale ticks
+	Keyframe bool   // Keyframe is true if the sample is an IDR picture
+}
+
+// NewSample creates a sample from the NAL units of a frame. Parameter sets and access unit delimiters are left out
+// as the decoder configuration already holds the parameter sets.
+func NewSample(units []h264.NALUnit, duration uint32) Sample {
+	s := Sample{Duration: duration}
+	for _, u := range units {
+		switch u.Type {
+		case h264.NALSPS, h264.NALPPS, h264.NALAUD:
+			continue
+		case h264.NALIDR:
+			s.Keyframe = true
+		}
+		s.Data = u32(s.Data, uint32(len(u.Data)))
+		s.Data = append(s.Data, u.Data...)
+	}
+	return s
+}
+
+// Fragment returns the moof and mdat boxes holding the samples, starting at the base decode time. Fragments can be
+// served on their own after the init segment, such as for HLS.
+func Fragment(sequence uint32, baseDecodeTime uint64, samples []Sample) []byte {
+	// The data offset depends on the size of the moof box, which does not depend on the offset itself
+	moofSize := len(moof(sequence, baseDecodeTime, samples, 0))
+	data := moof(sequence, baseDecodeTime, samples, uint32(moofSize+8))
+
+	// Append the mdat box holding the sample data
+	mdat := make([][]byte, 0, len(samples))
+	for _, s := range samples {
+		mdat = append(mdat, s.Data)
+	}
+	return append(data, box("mdat", mdat...)...)
+}
+
+// moof returns the movie fragment box describing the samples, whose data starts dataOffset bytes into the box
+func moof(sequence uint32, baseDecodeTime uint64, samples []Sample, dataOffset uint32) []byte {
+	var entries []byte
+	for _, s := range samples {
+		flags := uint32(nonKeyframeFlags)
+		if s.Keyframe {
+			flags = keyframeFlags
+		}
+		entries = u32(entries, s.Duration)
+		entries = u32(entries, uint32(len(s.Data)))
+		entries = u32(entries, flags)
+	}
+
+	trun := fullBox("trun", 0, trunDataOffset|trunSampleDuration|trunSampleSize|trunSampleFlags,
+		u32(nil, uint32(len(samples))), u32(nil, dataOffset), entries)
+	traf := box("traf",
+		fullBox("tfhd", 0, tfhdDefaultBaseIsMoof, u32(nil, trackID)),
+		fullBox("tfdt", 1, 0, u64(nil, baseDecodeTime)),
+		trun,
+	)
+	return box("moof", fullBox("mfhd", 0, 0, u32(nil, sequence)), traf)
+}
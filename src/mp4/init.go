@@ -0,0 +1,151 @@
+package mp4
+
+import (
+	"errors"
+	"github.com/kz/swanntools/src/h264"
+)
+
+// Track constants
+const (
+	Timescale = 90000 // Timescale is the number of ticks per second used for sample timing
+	trackID   = 1     // trackID is the ID of the only track in the file
+)
+
+// ErrMissingParameterSets is returned when an init segment is requested without an SPS and PPS
+var ErrMissingParameterSets = errors.New("mp4: SPS and PPS are required")
+
+// InitSegment returns the ftyp and moov boxes describing a fragmented file with a single H264 track
+func InitSegment(params h264.ParameterSets) ([]byte, error) {
+	if !params.Ready() || len(params.SPSData) < 4 {
+		return nil, ErrMissingParameterSets
+	}
+
+	ftyp := box("ftyp", []byte("iso5"), u32(nil, 0x200), []byte("iso5iso6avc1mp41"))
+	moov := box("moov", mvhd(), trak(params), box("mvex", trex()))
+	return append(ftyp, moov...), nil
+}
+
+// mvhd returns the movie header box
+func mvhd() []byte {
+	var b []byte
+	b = u32(b, 0)          // creation_time
+	b = u32(b, 0)          // modification_time
+	b = u32(b, Timescale)  // timescale
+	b = u32(b, 0)          // duration, unknown as the file is fragmented
+	b = u32(b, 0x00010000) // rate
+	b = u16(b, 0x0100)     // volume
+	b = zeros(b, 10)       // reserved
+	b = matrix(b)
+	b = zeros(b, 24)      // pre_defined
+	b = u32(b, trackID+1) // next_track_ID
+	return fullBox("mvhd", 0, 0, b)
+}
+
+// trak returns the track box for the video track
+func trak(params h264.ParameterSets) []byte {
+	return box("trak", tkhd(params.SPS), box("mdia", mdhd(), hdlr(), minf(params)))
+}
+
+// tkhd returns the track header box
+func tkhd(sps *h264.SPS) []byte {
+	var b []byte
+	b = u32(b, 0)       // creation_time
+	b = u32(b, 0)       // modification_time
+	b = u32(b, trackID) // track_ID
+	b = zeros(b, 4)     // reserved
+	b = u32(b, 0)       // duration
+	b = zeros(b, 8)     // reserved
+	b = u16(b, 0)       // layer
+	b = u16(b, 0)       // alternate_group
+	b = u16(b, 0)       // volume, which is zero for video
+	b = zeros(b, 2)     // reserved
+	b = matrix(b)
+	b = u32(b, uint32(sps.Width)<<16)  // width as 16.16 fixed point
+	b = u32(b, uint32(sps.Height)<<16) // height as 16.16 fixed point
+	// Flag the track as enabled and in the movie
+	return fullBox("tkhd", 0, 0x000003, b)
+}
+
+// mdhd returns the media header box
+func mdhd() []byte {
+	var b []byte
+	b = u32(b, 0)         // creation_time
+	b = u32(b, 0)         // modification_time
+	b = u32(b, Timescale) // timescale
+	b = u32(b, 0)         // duration
+	b = u16(b, 0x55c4)    // language, which is "und"
+	b = u16(b, 0)         // pre_defined
+	return fullBox("mdhd", 0, 0, b)
+}
+
+// hdlr returns the handler reference box for a video track
+func hdlr() []byte {
+	var b []byte
+	b = u32(b, 0) // pre_defined
+	b = append(b, "vide"...)
+	b = zeros(b, 12) // reserved
+	b = append(b, "VideoHandler\x00"...)
+	return fullBox("hdlr", 0, 0, b)
+}
+
+// minf returns the media information box, with an empty sample table as samples are stored in fragments
+func minf(params h264.ParameterSets) []byte {
+	vmhd := fullBox("vmhd", 0, 1, zeros(nil, 8))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(nil, 1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(nil, 1), avc1(params)),
+		fullBox("stts", 0, 0, u32(nil, 0)),
+		fullBox("stsc", 0, 0, u32(nil, 0)),
+		fullBox("stsz", 0, 0, u32(nil, 0), u32(nil, 0)),
+		fullBox("stco", 0, 0, u32(nil, 0)),
+	)
+	return box("minf", vmhd, dinf, stbl)
+}
+
+// avc1 returns the H264 sample entry, including the decoder configuration
+func avc1(params h264.ParameterSets) []byte {
+	var b []byte
+	b = zeros(b, 6)                       // reserved
+	b = u16(b, 1)                         // data_reference_index
+	b = zeros(b, 16)                      // pre_defined and reserved
+	b = u16(b, uint16(params.SPS.Width))  // width
+	b = u16(b, uint16(params.SPS.Height)) // height
+	b = u32(b, 0x00480000)                // horizresolution, 72 dpi
+	b = u32(b, 0x00480000)                // vertresolution, 72 dpi
+	b = zeros(b, 4)                       // reserved
+	b = u16(b, 1)                         // frame_count
+	b = zeros(b, 32)                      // compressorname
+	b = u16(b, 0x0018)                    // depth
+	b = u16(b, 0xffff)                    // pre_defined
+	return box("avc1", b, avcC(params))
+}
+
+// avcC returns the AVC decoder configuration record
+func avcC(params h264.ParameterSets) []byte {
+	sps, pps := params.SPSData, params.PPSData
+
+	var b []byte
+	b = u8(b, 1)      // configurationVersion
+	b = u8(b, sps[1]) // AVCProfileIndication
+	b = u8(b, sps[2]) // profile_compatibility
+	b = u8(b, sps[3]) // AVCLevelIndication
+	b = u8(b, 0xff)   // lengthSizeMinusOne of 3, so NAL units are prefixed by four byte lengths
+	b = u8(b, 0xe1)   // one SPS
+	b = u16(b, uint16(len(sps)))
+	b = append(b, sps...)
+	b = u8(b, 1) // one PPS
+	b = u16(b, uint16(len(pps)))
+	b = append(b, pps...)
+	return box("avcC", b)
+}
+
+// trex returns the track extends box, which sets no sample defaults as every fragment states them
+func trex() []byte {
+	var b []byte
+	b = u32(b, trackID) // track_ID
+	b = u32(b, 1)       // default_sample_description_index
+	b = u32(b, 0)       // default_sample_duration
+	b = u32(b, 0)       // default_sample_size
+	b = u32(b, 0)       // default_sample_flags
+	return fullBox("trex", 0, 0, b)
+}
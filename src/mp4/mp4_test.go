@@ -0,0 +1,90 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/kz/swanntools/src/h264"
+	"testing"
+)
+
+// testParams returns the parameter sets of a 704x480 baseline stream
+func testParams(t *testing.T) h264.ParameterSets {
+	sps, _ := hex.DecodeString("6742c01eda02c0f640")
+	var p h264.ParameterSets
+	p.Update(h264.ParseAnnexB(h264.AppendAnnexB(nil, sps, []byte{0x68, 0xce, 0x38, 0x80})))
+	if !p.Ready() {
+		t.Fatal("Unable to create parameter sets")
+	}
+	return p
+}
+
+// topLevelBoxes returns the types and offsets of the top level boxes in data
+func topLevelBoxes(t *testing.T, data []byte) ([]string, []int) {
+	var types []string
+	var offsets []int
+	for i := 0; i < len(data); {
+		if i+8 > len(data) {
+			t.Fatalf("Truncated box at offset %d", i)
+		}
+		size := int(binary.BigEndian.Uint32(data[i:]))
+		if size < 8 || i+size > len(data) {
+			t.Fatalf("Invalid box size %d at offset %d", size, i)
+		}
+		types = append(types, string(data[i+4:i+8]))
+		offsets = append(offsets, i)
+		i += size
+	}
+	return types, offsets
+}
+
+func TestWriterProducesFragmentsStartingOnKeyframes(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, testParams(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idr := []h264.NALUnit{{Type: h264.NALIDR, Data: []byte{0x65, 0x88, 0x84}}}
+	slice := []h264.NALUnit{{Type: h264.NALSlice, Data: []byte{0x41, 0x9a}}}
+	for _, units := range [][]h264.NALUnit{idr, slice, slice, idr, slice} {
+		if err := w.WriteSample(NewSample(units, 3000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	types, offsets := topLevelBoxes(t, buf.Bytes())
+	expected := []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat", "mfra"}
+	if len(types) != len(expected) {
+		t.Fatalf("Expected boxes %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("Expected boxes %v, got %v", expected, types)
+		}
+	}
+
+	// The first sample of the second fragment should be found at its trun data offset
+	data := buf.Bytes()
+	moof := offsets[4]
+	dataOffset := binary.BigEndian.Uint32(data[moof+8+16+8+16+20+16:])
+	sample := data[moof+int(dataOffset):]
+	if !bytes.Equal(sample[:7], []byte{0, 0, 0, 3, 0x65, 0x88, 0x84}) {
+		t.Errorf("Sample data not found at data offset, got %x", sample[:7])
+	}
+
+	// The second fragment starts after three samples
+	tfdt := data[moof+8+16+8+16+12:]
+	if binary.BigEndian.Uint64(tfdt) != 9000 {
+		t.Errorf("Expected a base decode time of 9000, got %d", binary.BigEndian.Uint64(tfdt))
+	}
+}
+
+func TestInitSegmentRequiresParameterSets(t *testing.T) {
+	if _, err := InitSegment(h264.ParameterSets{}); err != ErrMissingParameterSets {
+		t.Errorf("Expected ErrMissingParameterSets, got %v", err)
+	}
+}
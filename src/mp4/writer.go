@@ -0,0 +1,102 @@
+package mp4
+
+import (
+	"github.com/kz/swanntools/src/h264"
+	"io"
+)
+
+// fragmentEntry records where a fragment starts so that players can seek to it
+type fragmentEntry struct {
+	time   uint64 // time is the decode time of the first sample
+	offset uint64 // offset is the position of the moof box in the file
+}
+
+// Writer writes a fragmented MP4 file. Samples are grouped into fragments which each start on a keyframe, and a
+// random access index is written when the Writer is closed.
+type Writer struct {
+	w          io.Writer
+	written    uint64          // written is the number of bytes written so far
+	sequence   uint32          // sequence is the sequence number of the last fragment
+	decodeTime uint64          // decodeTime is the decode time of the next fragment
+	pending    []Sample        // pending are the samples of the fragment being built
+	index      []fragmentEntry // index holds the start of each fragment beginning with a keyframe
+}
+
+// NewWriter creates a Writer and writes the init segment described by the parameter sets to w
+func NewWriter(w io.Writer, params h264.ParameterSets) (*Writer, error) {
+	init, err := InitSegment(params)
+	if err != nil {
+		return nil, err
+	}
+
+	mw := &Writer{w: w}
+	if err := mw.write(init); err != nil {
+		return nil, err
+	}
+	return mw, nil
+}
+
+// WriteSample adds a sample to the file, first flushing the current fragment if the sample is a keyframe
+func (w *Writer) WriteSample(s Sample) error {
+	if s.Keyframe && len(w.pending) > 0 {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	w.pending = append(w.pending, s)
+	return nil
+}
+
+// Flush writes the pending samples as a fragment
+func (w *Writer) Flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	// Index fragments which can be decoded from their start
+	if w.pending[0].Keyframe {
+		w.index = append(w.index, fragmentEntry{time: w.decodeTime, offset: w.written})
+	}
+
+	w.sequence++
+	if err := w.write(Fragment(w.sequence, w.decodeTime, w.pending)); err != nil {
+		return err
+	}
+
+	// Advance the decode time past the written samples
+	for _, s := range w.pending {
+		w.decodeTime += uint64(s.Duration)
+	}
+	w.pending = nil
+	return nil
+}
+
+// Close flushes the pending samples and writes the random access index. The underlying writer is not closed.
+func (w *Writer) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return w.write(w.mfra())
+}
+
+// write writes data to the underlying writer, counting the bytes written
+func (w *Writer) write(data []byte) error {
+	n, err := w.w.Write(data)
+	w.written += uint64(n)
+	return err
+}
+
+// mfra returns the movie fragment random access box indexing each fragment
+func (w *Writer) mfra() []byte {
+	var entries []byte
+	for _, e := range w.index {
+		entries = u64(entries, e.time)
+		entries = u64(entries, e.offset)
+		// traf_number, trun_number and sample_number, each stored in one byte
+		entries = append(entries, 1, 1, 1)
+	}
+
+	tfra := fullBox("tfra", 1, 0, u32(nil, trackID), u32(nil, 0), u32(nil, uint32(len(w.index))), entries)
+	// The mfro box at the end of the file holds the size of the whole mfra box
+	return box("mfra", tfra, fullBox("mfro", 0, 0, u32(nil, uint32(len(tfra)+8+16))))
+}
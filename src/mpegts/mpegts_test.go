@@ -0,0 +1,88 @@
+package mpegts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/kz/swanntools/src/h264"
+	"testing"
+)
+
+func TestPATMatchesKnownSection(t *testing.T) {
+	expected, _ := hex.DecodeString("00b00d0001c100000001f0002ab104b2")
+	if actual := pat(); !bytes.Equal(actual, expected) {
+		t.Errorf("Expected PAT %x but got %x", expected, actual)
+	}
+}
+
+func TestMuxerWritesWholePackets(t *testing.T) {
+	buf := new(bytes.Buffer)
+	m := NewMuxer(buf)
+
+	// Access units of different sizes exercise the stuffing of the last packet
+	for i, size := range []int{0, 1, 2, 170, 171, 183, 184, 1000} {
+		au := append(h264.AppendAnnexB(nil, []byte{0x65}), make([]byte, size)...)
+		if err := m.WriteAccessUnit(au, uint64(i)*3000, i == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := buf.Bytes()
+	if len(data)%PacketSize != 0 {
+		t.Fatalf("Expected whole packets but got %d bytes", len(data))
+	}
+
+	// Every packet starts with the sync byte and continuity counters increase on each PID
+	last := make(map[int]int)
+	for i := 0; i < len(data); i += PacketSize {
+		pkt := data[i : i+PacketSize]
+		if pkt[0] != syncByte {
+			t.Fatalf("Expected sync byte at offset %d but got %#x", i, pkt[0])
+		}
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		cc := int(pkt[3] & 0x0f)
+		if prev, ok := last[pid]; ok && cc != (prev+1)&0x0f {
+			t.Errorf("Expected continuity counter %d on PID %#x but got %d", (prev+1)&0x0f, pid, cc)
+		}
+		last[pid] = cc
+	}
+
+	// The stream starts with the PAT and PMT followed by a keyframe carrying the PCR
+	if pid := int(data[1]&0x1f)<<8 | int(data[2]); pid != PATPID {
+		t.Errorf("Expected first packet on PID %#x but got %#x", PATPID, pid)
+	}
+	if pid := int(data[PacketSize+1]&0x1f)<<8 | int(data[PacketSize+2]); pid != PMTPID {
+		t.Errorf("Expected second packet on PID %#x but got %#x", PMTPID, pid)
+	}
+	video := data[2*PacketSize:]
+	if video[3]&0x20 == 0 || video[5]&0x50 != 0x50 {
+		t.Errorf("Expected random access indicator and PCR in first video packet, got %x", video[:12])
+	}
+}
+
+func TestPESHeaderEncodesPTS(t *testing.T) {
+	header := pesHeader(0x1fedcba98)
+	pts := uint64(header[9]&0x0e)<<29 | uint64(header[10])<<22 | uint64(header[11]&0xfe)<<14 |
+		uint64(header[12])<<7 | uint64(header[13])>>1
+	if pts != 0x1fedcba98 {
+		t.Errorf("Expected PTS %#x but got %#x", 0x1fedcba98, pts)
+	}
+}
+
+func TestAccessUnitRepeatsParameterSets(t *testing.T) {
+	sps, _ := hex.DecodeString("6742c01eda02c0f640")
+	pps := []byte{0x68, 0xce, 0x38, 0x80}
+	var params h264.ParameterSets
+	params.Update(h264.ParseAnnexB(h264.AppendAnnexB(nil, sps, pps)))
+
+	idr := []h264.NALUnit{{Type: h264.NALIDR, Data: []byte{0x65, 0x88}}}
+	expected := h264.AppendAnnexB(nil, []byte{0x09, 0xf0}, sps, pps, []byte{0x65, 0x88})
+	if actual := AccessUnit(idr, params); !bytes.Equal(actual, expected) {
+		t.Errorf("Expected access unit %x but got %x", expected, actual)
+	}
+
+	slice := []h264.NALUnit{{Type: h264.NALSlice, Data: []byte{0x41, 0x9a}}}
+	expected = h264.AppendAnnexB(nil, []byte{0x09, 0xf0}, []byte{0x41, 0x9a})
+	if actual := AccessUnit(slice, params); !bytes.Equal(actual, expected) {
+		t.Errorf("Expected access unit %x but got %x", expected, actual)
+	}
+}
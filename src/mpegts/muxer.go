@@ -0,0 +1,171 @@
+package mpegts
+
+import (
+	"bytes"
+	"github.com/kz/swanntools/src/h264"
+	"io"
+)
+
+// Transport stream constants
+const (
+	PacketSize   = 188  // PacketSize is the size of every transport stream packet
+	syncByte     = 0x47 // syncByte starts every packet
+	payloadSize  = 184  // payloadSize is the space left after the packet header
+	ptsDelay     = 9000 // ptsDelay is how far the PTS is ahead of the PCR, giving players 100ms to decode
+	videoStream  = 0xe0 // videoStream is the PES stream_id of the video stream
+	maxTimestamp = 1<<33 - 1
+)
+
+// Muxer writes access units to a transport stream. PAT and PMT are written before every keyframe so that players
+// can start from any keyframe, and every access unit carries a PCR.
+type Muxer struct {
+	w             io.Writer
+	continuity    map[uint16]uint8 // continuity holds the continuity counter of each PID
+	tablesWritten bool             // tablesWritten is true once PAT and PMT have been written
+}
+
+// NewMuxer creates a Muxer writing to w
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w, continuity: make(map[uint16]uint8)}
+}
+
+// WriteTables writes the PAT and PMT
+func (m *Muxer) WriteTables() error {
+	buf := new(bytes.Buffer)
+	for _, t := range []struct {
+		pid     uint16
+		section []byte
+	}{{PATPID, pat()}, {PMTPID, pmt()}} {
+		// Sections are preceded by a pointer field and padded with 0xff
+		pkt := m.header(t.pid, true, false)
+		pkt = append(pkt, 0x00)
+		pkt = append(pkt, t.section...)
+		pkt = append(pkt, bytes.Repeat([]byte{0xff}, PacketSize-len(pkt))...)
+		buf.Write(pkt)
+	}
+
+	m.tablesWritten = true
+	_, err := m.w.Write(buf.Bytes())
+	return err
+}
+
+// WriteAccessUnit writes an Annex B access unit presented at pts, in 90kHz ticks
+func (m *Muxer) WriteAccessUnit(au []byte, pts uint64, keyframe bool) error {
+	if keyframe || !m.tablesWritten {
+		if err := m.WriteTables(); err != nil {
+			return err
+		}
+	}
+
+	pes := append(pesHeader((pts+ptsDelay)&maxTimestamp), au...)
+	_, err := m.w.Write(m.packetize(VideoPID, pes, pts&maxTimestamp, keyframe))
+	return err
+}
+
+// header returns the four byte packet header, incrementing the continuity counter of the PID
+func (m *Muxer) header(pid uint16, unitStart bool, adaptation bool) []byte {
+	b1 := byte(pid>>8) & 0x1f
+	if unitStart {
+		b1 |= 0x40
+	}
+	control := byte(0x10) // payload only
+	if adaptation {
+		control = 0x30 // adaptation field followed by payload
+	}
+
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0f
+	return []byte{syncByte, b1, byte(pid), control | cc}
+}
+
+// packetize splits a PES packet into transport stream packets, adding the PCR to the first packet and stuffing
+// the last packet with an adaptation field
+func (m *Muxer) packetize(pid uint16, pes []byte, pcr uint64, randomAccess bool) []byte {
+	var out []byte
+	for first := true; len(pes) > 0; first = false {
+		// The first packet carries the PCR and marks keyframes as random access points
+		var af []byte
+		hasAF := first
+		if first {
+			flags := byte(0x10) // PCR_flag
+			if randomAccess {
+				flags |= 0x40 // random_access_indicator
+			}
+			af = appendPCR(append(af, flags), pcr)
+		}
+
+		// Stuff the adaptation field when the remaining payload does not fill the packet
+		space := payloadSize
+		if hasAF {
+			space -= 1 + len(af)
+		}
+		if stuffing := space - len(pes); stuffing > 0 {
+			if !hasAF {
+				// The adaptation field length byte is the only stuffing needed for a single byte
+				hasAF = true
+				stuffing--
+				if stuffing > 0 {
+					af = append(af, 0x00)
+					stuffing--
+				}
+			}
+			af = append(af, bytes.Repeat([]byte{0xff}, stuffing)...)
+		}
+
+		pkt := m.header(pid, first, hasAF)
+		if hasAF {
+			pkt = append(pkt, byte(len(af)))
+			pkt = append(pkt, af...)
+		}
+		n := PacketSize - len(pkt)
+		pkt = append(pkt, pes[:n]...)
+		pes = pes[n:]
+		out = append(out, pkt...)
+	}
+	return out
+}
+
+// appendPCR appends a PCR with the given base and no extension
+func appendPCR(b []byte, base uint64) []byte {
+	return append(b, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7e, 0x00)
+}
+
+// pesHeader returns the header of a video PES packet with a PTS
+func pesHeader(pts uint64) []byte {
+	return []byte{
+		0x00, 0x00, 0x01, videoStream,
+		0x00, 0x00, // PES_packet_length, which is unbounded for video
+		0x80, // marker bits
+		0x80, // PTS_DTS_flags, PTS only
+		0x05, // PES_header_data_length
+		0x21 | byte(pts>>29)&0x0e,
+		byte(pts >> 22),
+		0x01 | byte(pts>>14)&0xfe,
+		byte(pts >> 7),
+		0x01 | byte(pts<<1)&0xfe,
+	}
+}
+
+// AccessUnit builds the Annex B access unit for the NAL units of a frame. H264 in a transport stream needs an
+// access unit delimiter at the start of each access unit, and the parameter sets are repeated before keyframes.
+func AccessUnit(units []h264.NALUnit, params h264.ParameterSets) []byte {
+	au := h264.AppendAnnexB(nil, []byte{0x09, 0xf0})
+
+	// Repeat the parameter sets unless the frame carries its own
+	hasSPS := false
+	for _, u := range units {
+		if u.Type == h264.NALSPS {
+			hasSPS = true
+		}
+	}
+	if h264.ContainsKeyframe(units) && !hasSPS && params.Ready() {
+		au = h264.AppendAnnexB(au, params.SPSData, params.PPSData)
+	}
+
+	for _, u := range units {
+		if u.Type != h264.NALAUD {
+			au = h264.AppendAnnexB(au, u.Data)
+		}
+	}
+	return au
+}
@@ -0,0 +1,75 @@
+// Package mpegts muxes an H264 elementary stream into an MPEG-2 transport stream with a single program, as
+// expected by ffmpeg pipelines and HLS players.
+package mpegts
+
+// Packet identifiers and stream types
+const (
+	PATPID        = 0x0000 // PATPID is the PID of the program association table
+	PMTPID        = 0x1000 // PMTPID is the PID of the program map table
+	VideoPID      = 0x0100 // VideoPID is the PID of the video stream, which also carries the PCR
+	streamTypeAVC = 0x1b   // streamTypeAVC is the PMT stream type of H264 video
+	programNumber = 1      // programNumber is the number of the only program
+)
+
+// crcTable is the lookup table for the MPEG-2 CRC32
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32 calculates the MPEG-2 CRC32 used by PSI sections
+func crc32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// section completes a PSI section by filling in its length and appending its CRC
+func section(tableID byte, tableIDExtension uint16, body []byte) []byte {
+	// The section length counts the bytes after it, including the CRC
+	length := 5 + len(body) + 4
+	s := []byte{
+		tableID,
+		0xb0 | byte(length>>8), byte(length), // section_syntax_indicator, reserved bits and section_length
+		byte(tableIDExtension >> 8), byte(tableIDExtension),
+		0xc1, // reserved bits, version 0 and current_next_indicator
+		0x00, // section_number
+		0x00, // last_section_number
+	}
+	s = append(s, body...)
+
+	crc := crc32(s)
+	return append(s, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// pat returns the program association table section pointing at the PMT
+func pat() []byte {
+	return section(0x00, 1, []byte{
+		0x00, programNumber,
+		0xe0 | PMTPID>>8, PMTPID & 0xff,
+	})
+}
+
+// pmt returns the program map table section describing the video stream
+func pmt() []byte {
+	return section(0x02, programNumber, []byte{
+		0xe0 | VideoPID>>8, VideoPID & 0xff, // PCR_PID
+		0xf0, 0x00, // program_info_length
+		streamTypeAVC,
+		0xe0 | VideoPID>>8, VideoPID & 0xff, // elementary_PID
+		0xf0, 0x00, // ES_info_length
+	})
+}
@@ -0,0 +1,284 @@
+// Package pki provides a small certificate authority which issues the certificates used between the client and the
+// server, along with one-time tokens which let new clients enroll without copying keys around by hand.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// Default validity periods
+const (
+	CAValidity   = 10 * 365 * 24 * time.Hour // CAValidity is how long a new CA is valid for
+	CertValidity = 825 * 24 * time.Hour      // CertValidity is how long issued certificates are valid for
+)
+
+// PEM block types
+const (
+	certificateBlock = "CERTIFICATE"
+	keyBlock         = "EC PRIVATE KEY"
+	requestBlock     = "CERTIFICATE REQUEST"
+)
+
+// Errors returned when decoding PEM files
+var (
+	ErrNoCertificate = errors.New("pki: no certificate found")
+	ErrNoKey         = errors.New("pki: no EC private key found")
+	ErrNoRequest     = errors.New("pki: no certificate request found")
+)
+
+// CA is a certificate authority which issues server and client certificates
+type CA struct {
+	Cert *x509.Certificate // Cert is the certificate of the CA
+	Key  crypto.Signer     // Key is the private key of the CA
+}
+
+// NewCA creates a self-signed certificate authority with the common name
+func NewCA(name string, validity time.Duration) (*CA, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// LoadCA loads a certificate authority from its PEM encoded certificate and key files
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ParseCertificate(data)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = ioutil.ReadFile(keyFile); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != keyBlock {
+		return nil, ErrNoKey
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// CertPEM returns the PEM encoded certificate of the CA
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: certificateBlock, Bytes: ca.Cert.Raw})
+}
+
+// KeyPEM returns the PEM encoded private key of the CA
+func (ca *CA) KeyPEM() ([]byte, error) {
+	return encodeKey(ca.Key)
+}
+
+// IssueServer creates a key pair and a server certificate valid for the hosts, which are host names or IP addresses.
+// The certificate and key are returned PEM encoded.
+func (ca *CA) IssueServer(hosts []string, validity time.Duration) ([]byte, []byte, error) {
+	if len(hosts) == 0 {
+		return nil, nil, fmt.Errorf("pki: a server certificate needs at least one host")
+	}
+	key, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(hosts[0], validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return ca.issue(template, key)
+}
+
+// IssueClient creates a key pair and a client certificate with the name as its common name. The certificate and key
+// are returned PEM encoded.
+func (ca *CA) IssueClient(name string, validity time.Duration) ([]byte, []byte, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.issue(template, key)
+}
+
+// SignClient signs a PEM encoded certificate request as a client certificate. The name replaces the subject of the
+// request, so that clients cannot choose their own identity.
+func (ca *CA) SignClient(request []byte, name string, validity time.Duration) ([]byte, error) {
+	csr, err := ParseRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(name, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, csr.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: certificateBlock, Bytes: der}), nil
+}
+
+// issue signs the template for the key, returning the PEM encoded certificate and key
+func (ca *CA) issue(template *x509.Certificate, key crypto.Signer) ([]byte, []byte, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: certificateBlock, Bytes: der}), keyPEM, nil
+}
+
+// NewRequest creates a key pair and a certificate request for it, returning the PEM encoded request and key
+func NewRequest(name string) ([]byte, []byte, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: name},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: requestBlock, Bytes: der}), keyPEM, nil
+}
+
+// ParseRequest decodes a PEM encoded certificate request, checking that it is signed by the key it is for
+func ParseRequest(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != requestBlock {
+		return nil, ErrNoRequest
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+// ParseCertificate decodes the first certificate of a PEM file
+func ParseCertificate(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, ErrNoCertificate
+		}
+		if block.Type == certificateBlock {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate in hex with colons between bytes, as
+// printed by openssl
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// ParseFingerprint decodes a SHA-256 fingerprint written in hex, optionally with colons between bytes
+func ParseFingerprint(s string) ([]byte, error) {
+	sum, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("the fingerprint needs to be a SHA-256 hash written in hex")
+	}
+	return sum, nil
+}
+
+// newKey generates a P-256 private key
+func newKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// encodeKey PEM encodes an EC private key
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrNoKey
+	}
+	der, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: keyBlock, Bytes: der}), nil
+}
+
+// newTemplate creates a certificate template with a random serial number, valid from an hour ago to allow for clock
+// differences
+func newTemplate(name string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
@@ -0,0 +1,140 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIssue(t *testing.T) {
+	ca, err := NewCA("test-ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	// Server certificates are valid for each host name and IP address
+	certPEM, keyPEM, err := ca.IssueServer([]string{"server.example.com", "10.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"server.example.com", "10.0.0.1"} {
+		opts := x509.VerifyOptions{Roots: roots, DNSName: host,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+		if _, err := cert.Verify(opts); err != nil {
+			t.Errorf("Expected the server certificate to be valid for %s: %v", host, err)
+		}
+	}
+
+	// Client certificates can only be used by clients
+	certPEM, _, err = ca.IssueClient("site-a", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = ParseCertificate(certPEM)
+	opts := x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if _, err := cert.Verify(opts); err != nil || cert.Subject.CommonName != "site-a" {
+		t.Errorf("Expected a client certificate for site-a, got %q (%v)", cert.Subject.CommonName, err)
+	}
+	opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if _, err := cert.Verify(opts); err == nil {
+		t.Errorf("Expected the client certificate not to be valid for servers")
+	}
+}
+
+func TestSignClientReplacesName(t *testing.T) {
+	ca, _ := NewCA("test-ca", time.Hour)
+	request, keyPEM, err := NewRequest("chosen-by-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := ca.SignClient(request, "site-b", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Errorf("Expected the certificate to match the key of the request: %v", err)
+	}
+	if cert, _ := ParseCertificate(certPEM); cert.Subject.CommonName != "site-b" {
+		t.Errorf("Expected the certificate to be issued to site-b, got %q", cert.Subject.CommonName)
+	}
+	if _, err := ca.SignClient(keyPEM, "site-b", time.Hour); err != ErrNoRequest {
+		t.Errorf("Expected ErrNoRequest, got %v", err)
+	}
+}
+
+func TestLoadCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, _ := NewCA("test-ca", time.Hour)
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), ca.CertPEM(), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "ca.key"), keyPEM, 0600)
+
+	loaded, err := LoadCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Cert.Equal(ca.Cert) {
+		t.Errorf("Expected the loaded CA certificate to match")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokens := OpenTokens(filepath.Join(dir, "tokens.json"))
+
+	secret, err := tokens.Create("site-a", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := tokens.Create("site-b", -time.Second)
+
+	// Tokens can only be redeemed once and before they expire
+	if name, err := tokens.Redeem(secret); err != nil || name != "site-a" {
+		t.Errorf("Expected the token to be for site-a, got %q (%v)", name, err)
+	}
+	for _, s := range []string{secret, expired, "unknown"} {
+		if _, err := tokens.Redeem(s); err != ErrInvalidToken {
+			t.Errorf("Expected ErrInvalidToken for %q, got %v", s, err)
+		}
+	}
+}
+
+func TestEnrollmentCode(t *testing.T) {
+	der := []byte("certificate")
+	code := EnrollmentCode("00112233445566778899aabbccddeeff", der)
+	secret, pin, err := ParseEnrollmentCode(code)
+	if err != nil || secret != "00112233445566778899aabbccddeeff" {
+		t.Fatalf("Expected the secret back, got %q (%v)", secret, err)
+	}
+	if sum, _ := ParseFingerprint(Fingerprint(der)); string(sum) != string(pin) {
+		t.Errorf("Expected the fingerprint of the certificate, got %x", pin)
+	}
+	if _, _, err := ParseEnrollmentCode("secret"); err == nil {
+		t.Errorf("Expected malformed codes to be rejected")
+	}
+}
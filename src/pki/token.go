@@ -0,0 +1,126 @@
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/kz/swanntools/src/jsonfile"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is returned when redeeming a token which does not exist, was already used or has expired
+var ErrInvalidToken = errors.New("pki: invalid or expired enrollment token")
+
+// tokenSize is the number of random bytes in a token
+const tokenSize = 16
+
+// token is an enrollment token as stored in the tokens file
+type token struct {
+	Name    string    `json:"name"`    // Name is the name the client certificate is issued to
+	Expires time.Time `json:"expires"` // Expires is when the token can no longer be redeemed
+}
+
+// Tokens is a file of one-time enrollment tokens, each allowing a client to receive a certificate for a name. Only
+// hashes of the tokens are stored, and the file is read on every change so that tokens can be created while the
+// server is running.
+type Tokens struct {
+	mu   sync.Mutex
+	path string // path is the path of the tokens file
+}
+
+// OpenTokens returns the tokens stored in the file at path, which is created when the first token is
+func OpenTokens(path string) *Tokens {
+	return &Tokens{path: path}
+}
+
+// Create creates a token which can be redeemed once for a certificate with the name until the ttl has passed
+func (t *Tokens) Create(name string, ttl time.Duration) (string, error) {
+	b := make([]byte, tokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tokens, err := t.load()
+	if err != nil {
+		return "", err
+	}
+	tokens[hashToken(secret)] = token{Name: name, Expires: time.Now().Add(ttl)}
+	return secret, t.save(tokens)
+}
+
+// Redeem uses up a token, returning the name it was created for. Expired tokens are removed at the same time.
+func (t *Tokens) Redeem(secret string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tokens, err := t.load()
+	if err != nil {
+		return "", err
+	}
+
+	hash := hashToken(secret)
+	name := ""
+	now := time.Now()
+	for h, tok := range tokens {
+		match := subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1
+		if match && now.Before(tok.Expires) {
+			name = tok.Name
+		}
+		if match || !now.Before(tok.Expires) {
+			delete(tokens, h)
+		}
+	}
+	if err := t.save(tokens); err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", ErrInvalidToken
+	}
+	return name, nil
+}
+
+// load reads the tokens file, which is empty if it does not exist
+func (t *Tokens) load() (map[string]token, error) {
+	tokens := make(map[string]token)
+	if err := jsonfile.Load(t.path, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// save replaces the tokens file, which holds the hashes of the tokens rather than the tokens themselves
+func (t *Tokens) save(tokens map[string]token) error {
+	return jsonfile.Save(t.path, tokens)
+}
+
+// hashToken returns the hash of a token as stored in the tokens file
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// EnrollmentCode combines a token with the fingerprint of the DER encoded server certificate, so that a new client
+// can verify the server before it has the CA certificate
+func EnrollmentCode(secret string, serverCert []byte) string {
+	sum := sha256.Sum256(serverCert)
+	return secret + "." + hex.EncodeToString(sum[:])
+}
+
+// ParseEnrollmentCode splits an enrollment code into the token and the fingerprint of the server certificate
+func ParseEnrollmentCode(code string) (string, []byte, error) {
+	parts := strings.Split(code, ".")
+	if len(parts) != 2 || len(parts[0]) != 2*tokenSize {
+		return "", nil, errors.New("pki: the enrollment code is malformed")
+	}
+	pin, err := ParseFingerprint(parts[1])
+	if err != nil {
+		return "", nil, err
+	}
+	return parts[0], pin, nil
+}
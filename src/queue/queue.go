@@ -0,0 +1,155 @@
+// Package queue provides bounded frame queues which decouple a producer from a slow consumer, with a choice of what
+// happens when the queue is full.
+package queue
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Policy decides what happens when a frame is pushed to a full queue
+type Policy string
+
+// Overflow policies
+const (
+	Block             Policy = "block"               // Block waits until there is room in the queue
+	DropOldest        Policy = "drop-oldest"         // DropOldest drops the oldest frame in the queue
+	DropUntilKeyframe Policy = "drop-until-keyframe" // DropUntilKeyframe drops frames of the stream until its next keyframe
+)
+
+// ParsePolicy returns the policy with the name
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case Block, DropOldest, DropUntilKeyframe:
+		return p, nil
+	}
+	return "", fmt.Errorf("the queue policy needs to be one of %s, %s or %s", Block, DropOldest, DropUntilKeyframe)
+}
+
+// Item is a frame in the queue
+type Item struct {
+	Value    interface{} // Value is the frame itself
+	Stream   interface{} // Stream identifies the stream of the frame, such as its channel, and must be comparable
+	Size     int         // Size is the size of the frame in bytes, used for counters
+	Keyframe bool        // Keyframe is true if the stream can be decoded from the frame
+}
+
+// Stats counts the frames passing through a queue
+type Stats struct {
+	Frames        uint64 // Frames is the number of frames pushed
+	Bytes         uint64 // Bytes is the number of bytes pushed
+	DroppedFrames uint64 // DroppedFrames is the number of frames dropped because the queue was full
+	DroppedBytes  uint64 // DroppedBytes is the number of bytes dropped because the queue was full
+}
+
+// Queue is a bounded first-in first-out queue of frames which is safe for concurrent use
+type Queue struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond           // notEmpty is signalled when an item is pushed or the queue is closed
+	notFull  *sync.Cond           // notFull is signalled when an item is popped or the queue is closed
+	items    []Item               // items are the queued frames, oldest first
+	capacity int                  // capacity is the maximum number of queued frames
+	policy   Policy               // policy decides what happens when the queue is full
+	dropping map[interface{}]bool // dropping holds the streams whose frames are dropped until their next keyframe
+	closed   bool                 // closed is true once no more items will be pushed
+	stats    Stats                // stats count the frames passing through the queue
+}
+
+// New creates a queue holding up to capacity frames
+func New(capacity int, policy Policy) *Queue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	q := &Queue{capacity: capacity, policy: policy, dropping: make(map[interface{}]bool)}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// Push adds a frame to the queue, applying the overflow policy if the queue is full. Frames pushed after the queue
+// is closed are dropped.
+func (q *Queue) Push(item Item) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.Frames++
+	q.stats.Bytes += uint64(item.Size)
+
+	switch q.policy {
+	case DropOldest:
+		if len(q.items) >= q.capacity && !q.closed {
+			q.drop(q.items[0])
+			q.items = q.items[1:]
+		}
+	case DropUntilKeyframe:
+		// Resume the stream on a keyframe if there is room for it
+		if q.dropping[item.Stream] && (!item.Keyframe || len(q.items) >= q.capacity) {
+			q.drop(item)
+			return
+		}
+		delete(q.dropping, item.Stream)
+		if len(q.items) >= q.capacity {
+			q.dropping[item.Stream] = true
+			q.drop(item)
+			return
+		}
+	default:
+		for len(q.items) >= q.capacity && !q.closed {
+			q.notFull.Wait()
+		}
+	}
+
+	if q.closed {
+		q.drop(item)
+		return
+	}
+	q.items = append(q.items, item)
+	q.notEmpty.Signal()
+}
+
+// Pop removes the oldest frame from the queue, waiting until there is one. It returns false once the queue is closed
+// and empty.
+func (q *Queue) Pop() (Item, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if len(q.items) == 0 {
+		return Item{}, false
+	}
+
+	item := q.items[0]
+	q.items[0] = Item{}
+	q.items = q.items[1:]
+	q.notFull.Signal()
+	return item, true
+}
+
+// Close stops the queue accepting frames. Frames already queued can still be popped.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// Len returns the number of queued frames
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Stats returns the counters of the queue
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+// drop counts a dropped frame
+func (q *Queue) drop(item Item) {
+	q.stats.DroppedFrames++
+	q.stats.DroppedBytes += uint64(item.Size)
+}
@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+// popAll pops the values of every queued item
+func popAll(q *Queue) []int {
+	var values []int
+	for q.Len() > 0 {
+		item, _ := q.Pop()
+		values = append(values, item.Value.(int))
+	}
+	return values
+}
+
+// equal reports whether two slices of values are equal
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDropOldest(t *testing.T) {
+	q := New(2, DropOldest)
+	for i := 0; i < 4; i++ {
+		q.Push(Item{Value: i, Size: 10})
+	}
+
+	if values := popAll(q); !equal(values, []int{2, 3}) {
+		t.Errorf("Expected the newest frames to be kept, got %v", values)
+	}
+	stats := q.Stats()
+	if stats.Frames != 4 || stats.Bytes != 40 || stats.DroppedFrames != 2 || stats.DroppedBytes != 20 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestDropUntilKeyframe(t *testing.T) {
+	q := New(2, DropUntilKeyframe)
+	q.Push(Item{Value: 0, Stream: 1, Keyframe: true})
+	q.Push(Item{Value: 1, Stream: 1})
+	// The queue is full, so stream 1 drops frames until its next keyframe
+	q.Push(Item{Value: 2, Stream: 1})
+	q.Pop()
+	q.Push(Item{Value: 3, Stream: 1})
+	q.Push(Item{Value: 4, Stream: 2})
+	q.Push(Item{Value: 5, Stream: 1, Keyframe: true})
+
+	if values := popAll(q); !equal(values, []int{1, 4}) {
+		t.Errorf("Expected frames 1 and 4, got %v", values)
+	}
+	q.Push(Item{Value: 6, Stream: 1})
+	q.Push(Item{Value: 7, Stream: 1, Keyframe: true})
+	q.Push(Item{Value: 8, Stream: 1})
+	if values := popAll(q); !equal(values, []int{7, 8}) {
+		t.Errorf("Expected stream to resume from keyframe 7, got %v", values)
+	}
+	if stats := q.Stats(); stats.DroppedFrames != 4 {
+		t.Errorf("Expected 4 dropped frames but got %d", stats.DroppedFrames)
+	}
+}
+
+func TestBlockWaitsForRoom(t *testing.T) {
+	q := New(1, Block)
+	q.Push(Item{Value: 0})
+
+	pushed := make(chan bool)
+	go func() {
+		q.Push(Item{Value: 1})
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("Expected push to block while the queue is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.Pop()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected push to complete once there was room")
+	}
+}
+
+func TestCloseDrainsQueue(t *testing.T) {
+	q := New(4, Block)
+	q.Push(Item{Value: 0})
+	q.Close()
+	q.Push(Item{Value: 1})
+
+	if item, ok := q.Pop(); !ok || item.Value.(int) != 0 {
+		t.Error("Expected queued frame to be popped after close")
+	}
+	if _, ok := q.Pop(); ok {
+		t.Error("Expected no more frames after close")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	if p, err := ParsePolicy("drop-oldest"); err != nil || p != DropOldest {
+		t.Errorf("Expected drop-oldest policy, got %v %v", p, err)
+	}
+	if _, err := ParsePolicy("drop-newest"); err == nil {
+		t.Error("Expected unknown policy to be rejected")
+	}
+}
@@ -0,0 +1,216 @@
+// Package registry keeps the clients which are allowed to connect to the server, how each of them authenticates and
+// which streams each of them may publish. The registry is a JSON file which is read on every lookup, so that changes
+// such as revoking a client take effect on its next handshake without restarting the server.
+package registry
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/kz/swanntools/src/jsonfile"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Errors returned when looking up and changing clients
+var (
+	ErrUnknownClient      = errors.New("registry: unknown client")
+	ErrInvalidCredentials = errors.New("registry: invalid credentials")
+	ErrRevoked            = errors.New("registry: client has been revoked")
+	ErrExists             = errors.New("registry: client already exists")
+)
+
+// Wildcard matches any site or channel in a stream pattern
+const Wildcard = "*"
+
+// Client is a client which is allowed to connect to the server. A client authenticates with its key, its certificate
+// or both, and can only publish the streams matching its patterns.
+type Client struct {
+	Name    string   `json:"name"`                 // Name is the ID the client identifies itself with
+	KeyHash string   `json:"key_sha256,omitempty"` // KeyHash is the SHA-256 hash of the key of the client, if any
+	Cert    string   `json:"cert,omitempty"`       // Cert is the common name of the certificate of the client, if any
+	Publish []string `json:"publish"`              // Publish are the streams the client may publish as site/channel
+	Revoked bool     `json:"revoked,omitempty"`    // Revoked is set once the client may no longer connect
+}
+
+// SetKey sets the key the client authenticates with, storing only its hash
+func (c *Client) SetKey(key string) {
+	c.KeyHash = hashKey(key)
+}
+
+// Validate checks that the client can authenticate and that its stream patterns are well formed
+func (c *Client) Validate() error {
+	if c.Name == "" {
+		return errors.New("registry: clients need a name")
+	}
+	if c.KeyHash == "" && c.Cert == "" {
+		return fmt.Errorf("registry: the client %s needs a key or a certificate to authenticate with", c.Name)
+	}
+	for _, pattern := range c.Publish {
+		if _, _, err := parsePattern(pattern); err != nil {
+			return fmt.Errorf("registry: the client %s has an invalid stream %q: %s", c.Name, pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// CanPublish reports whether the client may publish the channel of the site
+func (c *Client) CanPublish(site string, channel int) bool {
+	for _, pattern := range c.Publish {
+		patternSite, patternChannel, err := parsePattern(pattern)
+		if err != nil {
+			continue
+		}
+		if (patternSite == Wildcard || patternSite == site) && (patternChannel == 0 || patternChannel == channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePattern splits a stream pattern into its site and channel, where a channel of zero matches any channel
+func parsePattern(pattern string) (string, int, error) {
+	i := strings.LastIndex(pattern, "/")
+	if i <= 0 {
+		return "", 0, errors.New("streams are written as site/channel")
+	}
+	site, channel := pattern[:i], pattern[i+1:]
+	if channel == Wildcard {
+		return site, 0, nil
+	}
+	n, err := strconv.Atoi(channel)
+	if err != nil || n < 1 {
+		return "", 0, errors.New("channels are positive numbers or " + Wildcard)
+	}
+	return site, n, nil
+}
+
+// Registry is a file of the clients allowed to connect to the server
+type Registry struct {
+	mu   sync.Mutex
+	path string // path is the path of the registry file
+}
+
+// Open returns the registry stored in the file at path, which is created when the first client is added
+func Open(path string) *Registry {
+	return &Registry{path: path}
+}
+
+// Authenticate looks up the client with the ID, checking the common name of its certificate, if it presented one,
+// and its key against those registered. Revoked clients are only reported once they have authenticated.
+func (r *Registry) Authenticate(id, cert, key string) (*Client, error) {
+	clients, err := r.Clients()
+	if err != nil {
+		return nil, err
+	}
+	i := sort.Search(len(clients), func(i int) bool { return clients[i].Name >= id })
+	if i == len(clients) || clients[i].Name != id {
+		return nil, ErrUnknownClient
+	}
+	c := clients[i]
+
+	if c.Cert != "" && c.Cert != cert {
+		return nil, ErrInvalidCredentials
+	}
+	if c.KeyHash != "" && subtle.ConstantTimeCompare([]byte(c.KeyHash), []byte(hashKey(key))) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	if c.Revoked {
+		return nil, ErrRevoked
+	}
+	return c, nil
+}
+
+// Clients returns every registered client, sorted by name
+func (r *Registry) Clients() ([]*Client, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load()
+}
+
+// Add registers a new client
+func (r *Registry) Add(c *Client) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients, err := r.load()
+	if err != nil {
+		return err
+	}
+	for _, existing := range clients {
+		if existing.Name == c.Name {
+			return ErrExists
+		}
+	}
+	return r.save(append(clients, c))
+}
+
+// Revoke stops the client from connecting from its next handshake on, keeping it in the registry as a record
+func (r *Registry) Revoke(name string) error {
+	return r.update(name, func(clients []*Client, i int) []*Client {
+		clients[i].Revoked = true
+		return clients
+	})
+}
+
+// Remove deletes the client from the registry
+func (r *Registry) Remove(name string) error {
+	return r.update(name, func(clients []*Client, i int) []*Client {
+		return append(clients[:i], clients[i+1:]...)
+	})
+}
+
+// update changes the registered clients with the function, which is given the position of the client with the name
+func (r *Registry) update(name string, change func([]*Client, int) []*Client) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients, err := r.load()
+	if err != nil {
+		return err
+	}
+	for i, c := range clients {
+		if c.Name == name {
+			return r.save(change(clients, i))
+		}
+	}
+	return ErrUnknownClient
+}
+
+// load reads the registry file, which is empty if it does not exist, ensuring that every client is valid and
+// registered once
+func (r *Registry) load() ([]*Client, error) {
+	var clients []*Client
+	if err := jsonfile.Load(r.path, &clients); err != nil {
+		return nil, err
+	}
+	for _, c := range clients {
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	for i := 1; i < len(clients); i++ {
+		if clients[i].Name == clients[i-1].Name {
+			return nil, fmt.Errorf("registry: the client %s is registered more than once", clients[i].Name)
+		}
+	}
+	return clients, nil
+}
+
+// save replaces the registry file with the clients sorted by name, so that the file is easy to read and compare
+func (r *Registry) save(clients []*Client) error {
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return jsonfile.Save(r.path, clients)
+}
+
+// hashKey returns the hash of a key as stored in the registry file
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
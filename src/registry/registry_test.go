@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempRegistry opens a registry in a directory which is removed at the end of the test
+func tempRegistry(t *testing.T) *Registry {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return Open(filepath.Join(dir, "clients.json"))
+}
+
+func TestAuthenticate(t *testing.T) {
+	r := tempRegistry(t)
+	withKey := &Client{Name: "site-a", Publish: []string{"site-a/*"}}
+	withKey.SetKey("secret")
+	withCert := &Client{Name: "site-b", Cert: "site-b", Publish: []string{"site-b/1"}}
+	for _, c := range []*Client{withKey, withCert} {
+		if err := r.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Add(&Client{Name: "site-a", Cert: "site-a"}); err != ErrExists {
+		t.Errorf("Expected ErrExists, got %v", err)
+	}
+
+	tests := []struct {
+		id, cert, key string
+		err           error
+	}{
+		{"site-a", "any", "secret", nil},
+		{"site-a", "any", "wrong", ErrInvalidCredentials},
+		{"site-b", "site-b", "", nil},
+		{"site-b", "site-a", "", ErrInvalidCredentials},
+		{"site-c", "site-c", "", ErrUnknownClient},
+	}
+	for _, test := range tests {
+		if _, err := r.Authenticate(test.id, test.cert, test.key); err != test.err {
+			t.Errorf("Expected %v for %s with cert %s, got %v", test.err, test.id, test.cert, err)
+		}
+	}
+
+	// Revoked clients are rejected from the next lookup on, but only once they have authenticated
+	if err := r.Revoke("site-b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Authenticate("site-b", "site-b", ""); err != ErrRevoked {
+		t.Errorf("Expected ErrRevoked, got %v", err)
+	}
+	if _, err := r.Authenticate("site-b", "site-a", ""); err != ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+	}
+
+	if err := r.Remove("site-b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Revoke("site-b"); err != ErrUnknownClient {
+		t.Errorf("Expected ErrUnknownClient, got %v", err)
+	}
+}
+
+func TestCanPublish(t *testing.T) {
+	c := &Client{Name: "a", Cert: "a", Publish: []string{"garage/*", "*/3", "office/1"}}
+	tests := []struct {
+		site    string
+		channel int
+		allowed bool
+	}{
+		{"garage", 4, true},
+		{"office", 1, true},
+		{"office", 2, false},
+		{"shed", 3, true},
+		{"shed", 1, false},
+	}
+	for _, test := range tests {
+		if c.CanPublish(test.site, test.channel) != test.allowed {
+			t.Errorf("Expected publishing %s/%d to be allowed: %v", test.site, test.channel, test.allowed)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []*Client{
+		{Name: "", Cert: "a"},
+		{Name: "a"},
+		{Name: "a", Cert: "a", Publish: []string{"1"}},
+		{Name: "a", Cert: "a", Publish: []string{"site/0"}},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", c)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package rtsp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// protocolVersion is the only supported version of RTSP
+const protocolVersion = "RTSP/1.0"
+
+// maxContentLength limits the body of requests, which are not expected to carry one
+const maxContentLength = 64 << 10
+
+// ErrMalformedRequest is returned when a request cannot be parsed
+var ErrMalformedRequest = errors.New("rtsp: malformed request")
+
+// Status codes used by the server
+const (
+	StatusOK                    = 200
+	StatusBadRequest            = 400
+	StatusNotFound              = 404
+	StatusSessionNotFound       = 454
+	StatusMethodNotValidInState = 455
+	StatusUnsupportedTransport  = 461
+	StatusNotImplemented        = 501
+	StatusServiceUnavailable    = 503
+)
+
+// statusText holds the reason phrase of each status code
+var statusText = map[int]string{
+	StatusOK:                    "OK",
+	StatusBadRequest:            "Bad Request",
+	StatusNotFound:              "Not Found",
+	StatusSessionNotFound:       "Session Not Found",
+	StatusMethodNotValidInState: "Method Not Valid in This State",
+	StatusUnsupportedTransport:  "Unsupported Transport",
+	StatusNotImplemented:        "Not Implemented",
+	StatusServiceUnavailable:    "Service Unavailable",
+}
+
+// Request is an RTSP request sent by a client
+type Request struct {
+	Method string               // Method is the method of the request, such as DESCRIBE
+	URL    string               // URL is the request URL, such as rtsp://host/channel1
+	Header textproto.MIMEHeader // Header holds the header fields of the request
+}
+
+// ReadRequest reads a request from r, discarding any body
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	tp := textproto.NewReader(r)
+
+	// Parse the request line, such as "DESCRIBE rtsp://host/channel1 RTSP/1.0"
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[2] != protocolVersion {
+		return nil, ErrMalformedRequest
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Discard the body so that the next request can be read
+	if value := header.Get("Content-Length"); value != "" {
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 || length > maxContentLength {
+			return nil, ErrMalformedRequest
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(length)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Request{Method: parts[0], URL: parts[1], Header: header}, nil
+}
+
+// Response is an RTSP response to a request
+type Response struct {
+	Status int      // Status is the status code of the response
+	Header []string // Header holds the header fields in order, each as "Name: value"
+	Body   []byte   // Body is the content of the response
+}
+
+// marshal encodes the response, answering the request with the sequence number cseq
+func (r *Response) marshal(cseq string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %d %s\r\n", protocolVersion, r.Status, statusText[r.Status])
+	fmt.Fprintf(&b, "CSeq: %s\r\n", cseq)
+	for _, h := range r.Header {
+		b.WriteString(h + "\r\n")
+	}
+	if len(r.Body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(r.Body))
+	}
+	b.WriteString("\r\n")
+	return append([]byte(b.String()), r.Body...)
+}
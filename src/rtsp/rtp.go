@@ -0,0 +1,78 @@
+// Package rtsp serves H264 streams over RTSP, sending RTP packets interleaved on the RTSP connection as described by
+// RFC 2326 and packetized as described by RFC 6184.
+package rtsp
+
+import (
+	"encoding/binary"
+)
+
+// RTP constants
+const (
+	PayloadType    = 96    // PayloadType is the dynamic payload type used for H264
+	ClockRate      = 90000 // ClockRate is the RTP clock rate of H264 video
+	rtpHeaderSize  = 12    // rtpHeaderSize is the size of an RTP header without CSRCs or extensions
+	maxPayloadSize = 1400  // maxPayloadSize keeps packets within a typical MTU if they are relayed over UDP
+	nalTypeFUA     = 28    // nalTypeFUA is the NAL unit type of fragmentation units
+)
+
+// Packetizer splits access units into RTP packets for a single receiver
+type Packetizer struct {
+	SSRC     uint32 // SSRC identifies the stream to the receiver
+	sequence uint16 // sequence is the sequence number of the next packet
+}
+
+// Packetize returns the RTP packets carrying the NAL units of an access unit. NAL units which are too large for a
+// single packet are split into FU-A fragments, and the marker bit is set on the last packet of the access unit.
+func (p *Packetizer) Packetize(nals [][]byte, timestamp uint32) [][]byte {
+	var packets [][]byte
+	for i, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+		last := i == len(nals)-1
+
+		// Small NAL units are sent as they are
+		if len(nal) <= maxPayloadSize {
+			packets = append(packets, p.packet(nal, timestamp, last))
+			continue
+		}
+
+		// The FU indicator keeps the NRI of the NAL unit and the FU header carries its type
+		indicator := nal[0]&0xe0 | nalTypeFUA
+		header := nal[0] & 0x1f
+		data := nal[1:]
+		for start := true; len(data) > 0; start = false {
+			n := len(data)
+			if n > maxPayloadSize-2 {
+				n = maxPayloadSize - 2
+			}
+
+			fu := header
+			if start {
+				fu |= 0x80
+			}
+			if n == len(data) {
+				fu |= 0x40
+			}
+			payload := append([]byte{indicator, fu}, data[:n]...)
+			data = data[n:]
+			packets = append(packets, p.packet(payload, timestamp, last && len(data) == 0))
+		}
+	}
+	return packets
+}
+
+// packet returns an RTP packet carrying the payload
+func (p *Packetizer) packet(payload []byte, timestamp uint32, marker bool) []byte {
+	b := make([]byte, rtpHeaderSize, rtpHeaderSize+len(payload))
+	b[0] = 0x80 // version 2, without padding, extensions or CSRCs
+	b[1] = PayloadType
+	if marker {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], p.sequence)
+	binary.BigEndian.PutUint32(b[4:], timestamp)
+	binary.BigEndian.PutUint32(b[8:], p.SSRC)
+	p.sequence++
+	return append(b, payload...)
+}
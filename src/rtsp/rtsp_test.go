@@ -0,0 +1,242 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/kz/swanntools/src/h264"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testParams returns the parameter sets of a 704x480 baseline stream
+func testParams(t *testing.T) h264.ParameterSets {
+	sps, _ := hex.DecodeString("6742c01eda02c0f640")
+	var p h264.ParameterSets
+	p.Update(h264.ParseAnnexB(h264.AppendAnnexB(nil, sps, []byte{0x68, 0xce, 0x38, 0x80})))
+	if !p.Ready() {
+		t.Fatal("Unable to create parameter sets")
+	}
+	return p
+}
+
+func TestPacketizeSmallNALUnits(t *testing.T) {
+	p := Packetizer{SSRC: 0x11223344}
+	packets := p.Packetize([][]byte{{0x67, 0x42}, {0x65, 0x88}}, 3000)
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 packets but got %d", len(packets))
+	}
+
+	expected, _ := hex.DecodeString("80e0000100000bb8112233446588")
+	if !bytes.Equal(packets[1], expected) {
+		t.Errorf("Expected packet %x but got %x", expected, packets[1])
+	}
+	if packets[0][1]&0x80 != 0 {
+		t.Error("Expected marker bit only on the last packet")
+	}
+}
+
+func TestPacketizeFragmentsLargeNALUnits(t *testing.T) {
+	nal := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	var p Packetizer
+	packets := p.Packetize([][]byte{nal}, 0)
+	if len(packets) != 3 {
+		t.Fatalf("Expected 3 packets but got %d", len(packets))
+	}
+
+	// Reassemble the fragments and check the FU headers
+	reassembled := []byte{packets[0][12]&0xe0 | packets[0][13]&0x1f}
+	for i, pkt := range packets {
+		if len(pkt) > rtpHeaderSize+maxPayloadSize {
+			t.Errorf("Packet %d is larger than the maximum payload size", i)
+		}
+		if pkt[12] != 0x7c {
+			t.Errorf("Expected FU indicator 7c in packet %d but got %x", i, pkt[12])
+		}
+		start, end := pkt[13]&0x80 != 0, pkt[13]&0x40 != 0
+		if start != (i == 0) || end != (i == len(packets)-1) {
+			t.Errorf("Unexpected start or end bit in packet %d", i)
+		}
+		if marker := pkt[1]&0x80 != 0; marker != end {
+			t.Errorf("Unexpected marker bit in packet %d", i)
+		}
+		if seq := binary.BigEndian.Uint16(pkt[2:]); seq != uint16(i) {
+			t.Errorf("Expected sequence %d but got %d", i, seq)
+		}
+		reassembled = append(reassembled, pkt[14:]...)
+	}
+	if !bytes.Equal(reassembled, nal) {
+		t.Error("Reassembled fragments do not match the NAL unit")
+	}
+}
+
+func TestSDPDescribesParameterSets(t *testing.T) {
+	sdp := string(SDP(testParams(t)))
+	expected := "a=fmtp:96 packetization-mode=1;profile-level-id=42c01e;sprop-parameter-sets=Z0LAHtoCwPZA,aM44gA==\r\n"
+	if !strings.Contains(sdp, expected) {
+		t.Errorf("Expected SDP to contain %q, got:\n%s", expected, sdp)
+	}
+}
+
+func TestInterleavedChannel(t *testing.T) {
+	for transport, expected := range map[string]int{
+		"RTP/AVP/TCP;unicast;interleaved=2-3":                     2,
+		"RTP/AVP;unicast;client_port=5000-5001,RTP/AVP/TCP":       0,
+		"RTP/AVP;unicast;client_port=5000-5001":                   -1,
+		"RTP/AVP/TCP;unicast;interleaved=x":                       -1,
+		"RTP/AVP/UDP;unicast,RTP/AVP/TCP;interleaved=4-5;unicast": 4,
+	} {
+		channel, ok := interleavedChannel(transport)
+		if expected < 0 && ok || expected >= 0 && (!ok || int(channel) != expected) {
+			t.Errorf("Unexpected channel %d (%v) for %q", channel, ok, transport)
+		}
+	}
+}
+
+// request sends a request on the connection and returns the response status line and headers
+func request(t *testing.T, nc net.Conn, r *bufio.Reader, method, url string, header ...string) (string, string) {
+	msg := method + " " + url + " RTSP/1.0\r\nCSeq: 1\r\n" + strings.Join(append(header, ""), "\r\n") + "\r\n"
+	if _, err := nc.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	var head []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		head = append(head, strings.TrimSpace(line))
+	}
+	return head[0], strings.Join(head[1:], "\n")
+}
+
+func TestServerStreamsInterleavedRTP(t *testing.T) {
+	server := NewServer()
+	stream := server.Stream("channel1")
+	stream.WriteAccessUnit(nil, testParams(t), 0)
+
+	client, nc := net.Pipe()
+	defer client.Close()
+	go server.handleConn(nc)
+	r := bufio.NewReader(client)
+
+	if status, _ := request(t, client, r, "DESCRIBE", "rtsp://host/channel2"); status != "RTSP/1.0 404 Not Found" {
+		t.Errorf("Expected unknown stream to be not found, got %s", status)
+	}
+	status, header := request(t, client, r, "DESCRIBE", "rtsp://host/channel1")
+	if status != "RTSP/1.0 200 OK" || !strings.Contains(header, "Content-Type: application/sdp") {
+		t.Fatalf("Unexpected DESCRIBE response %s\n%s", status, header)
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(len(SDP(testParams(t))))); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ = request(t, client, r, "SETUP", "rtsp://host/channel1/trackID=0", "Transport: RTP/AVP;unicast")
+	if status != "RTSP/1.0 461 Unsupported Transport" {
+		t.Errorf("Expected UDP transport to be unsupported, got %s", status)
+	}
+	status, header = request(t, client, r, "SETUP", "rtsp://host/channel1/trackID=0",
+		"Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+	if status != "RTSP/1.0 200 OK" {
+		t.Fatalf("Unexpected SETUP response %s", status)
+	}
+	var session string
+	for _, h := range strings.Split(header, "\n") {
+		if strings.HasPrefix(h, "Session: ") {
+			session = strings.SplitN(strings.TrimPrefix(h, "Session: "), ";", 2)[0]
+		}
+	}
+	if status, _ = request(t, client, r, "PLAY", "rtsp://host/channel1", "Session: "+session); status != "RTSP/1.0 200 OK" {
+		t.Fatalf("Unexpected PLAY response %s", status)
+	}
+
+	// Slices are dropped until the first keyframe, which is preceded by the parameter sets
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stream.WriteAccessUnit([]h264.NALUnit{{Type: h264.NALSlice, Data: []byte{0x41, 0x9a}}}, testParams(t), 3000)
+		stream.WriteAccessUnit([]h264.NALUnit{{Type: h264.NALIDR, Data: []byte{0x65, 0x88}}}, testParams(t), 6000)
+	}()
+	for _, nalType := range []h264.NALType{h264.NALSPS, h264.NALPPS, h264.NALIDR} {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			t.Fatal(err)
+		}
+		if header[0] != '$' || header[1] != 0 {
+			t.Fatalf("Expected interleaved packet on channel 0 but got %x", header)
+		}
+		pkt := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			t.Fatal(err)
+		}
+		if h264.NALType(pkt[12]&0x1f) != nalType {
+			t.Errorf("Expected NAL unit type %d but got %d", nalType, pkt[12]&0x1f)
+		}
+	}
+}
+
+func TestServerClosesIdleConnections(t *testing.T) {
+	server := NewServer()
+	server.readTimeout = 50 * time.Millisecond
+
+	client, nc := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		server.handleConn(nc)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the idle connection to be closed")
+	}
+	if _, err := client.Write([]byte("OPTIONS")); err == nil {
+		t.Error("Expected writing to the closed connection to fail")
+	}
+}
+
+func TestCloseClosesClientConnections(t *testing.T) {
+	server := NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if status, _ := request(t, client, bufio.NewReader(client), "OPTIONS", "rtsp://host/channel1"); status != "RTSP/1.0 200 OK" {
+		t.Fatalf("Unexpected OPTIONS response %s", status)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Serve to return once the server is closed")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the client connection to be closed, got %v", err)
+	}
+}
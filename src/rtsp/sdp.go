@@ -0,0 +1,32 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/kz/swanntools/src/h264"
+)
+
+// TrackName is the control path of the only track of each stream
+const TrackName = "trackID=0"
+
+// SDP returns the session description of an H264 stream with the parameter sets
+func SDP(params h264.ParameterSets) []byte {
+	sps, pps := params.SPSData, params.PPSData
+
+	// The profile-level-id is the three bytes following the NAL unit header of the SPS
+	var profileLevelID string
+	if len(sps) >= 4 {
+		profileLevelID = fmt.Sprintf(";profile-level-id=%02x%02x%02x", sps[1], sps[2], sps[3])
+	}
+
+	return []byte("v=0\r\n" +
+		"o=- 0 0 IN IP4 0.0.0.0\r\n" +
+		"s=swanntools\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"t=0 0\r\n" +
+		fmt.Sprintf("m=video 0 RTP/AVP %d\r\n", PayloadType) +
+		fmt.Sprintf("a=rtpmap:%d H264/%d\r\n", PayloadType, ClockRate) +
+		fmt.Sprintf("a=fmtp:%d packetization-mode=1%s;sprop-parameter-sets=%s,%s\r\n", PayloadType, profileLevelID,
+			base64.StdEncoding.EncodeToString(sps), base64.StdEncoding.EncodeToString(pps)) +
+		"a=control:" + TrackName + "\r\n")
+}
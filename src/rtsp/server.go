@@ -0,0 +1,469 @@
+package rtsp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/kz/swanntools/src/h264"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server limits
+const (
+	sessionTimeout = 60  // sessionTimeout is the number of seconds a session is kept without requests
+	queueSize      = 128 // queueSize is the number of access units buffered for each session
+)
+
+// ErrServerClosed is returned by Serve once the server has been closed
+var ErrServerClosed = errors.New("rtsp: server closed")
+
+// Server serves streams to RTSP clients. Streams are named by the path of their URL, such as channel1 for
+// rtsp://host/channel1.
+type Server struct {
+	mu          sync.RWMutex
+	streams     map[string]*Stream    // streams holds each stream by name
+	readTimeout time.Duration         // readTimeout is how long a connection is kept without the client sending anything
+	listeners   map[net.Listener]bool // listeners are the listeners being served
+	conns       map[net.Conn]bool     // conns are the open client connections
+	closed      bool                  // closed is set once the server has been closed
+}
+
+// NewServer creates a Server with no streams. Connections are closed once the client has sent nothing for the session
+// timeout advertised to clients, so that they send keep-alive requests or RTCP reports in time.
+func NewServer() *Server {
+	return &Server{
+		streams:     make(map[string]*Stream),
+		readTimeout: sessionTimeout * time.Second,
+		listeners:   make(map[net.Listener]bool),
+		conns:       make(map[net.Conn]bool),
+	}
+}
+
+// Stream returns the stream with the name, creating it if it does not exist
+func (s *Server) Stream(name string) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.streams[name]
+	if st == nil {
+		st = &Stream{sessions: make(map[*session]bool)}
+		s.streams[name] = st
+	}
+	return st
+}
+
+// lookup returns the stream with the name, or nil if it does not exist
+func (s *Server) lookup(name string) *Stream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.streams[name]
+}
+
+// ListenAndServe listens on the TCP address and serves clients
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves clients connecting to the listener until it fails or the server is closed, in which case it returns
+// ErrServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	if !s.track(l, nil) {
+		return ErrServerClosed
+	}
+	defer s.untrack(l, nil)
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.track(nil, nc) {
+			nc.Close()
+			return ErrServerClosed
+		}
+		go s.handleConn(nc)
+	}
+}
+
+// Close closes the listeners being served and every open client connection
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for nc := range s.conns {
+		nc.Close()
+	}
+	return err
+}
+
+// track registers a listener or a connection so that Close closes it, returning false if the server is closed
+func (s *Server) track(l net.Listener, nc net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if l != nil {
+		s.listeners[l] = true
+	}
+	if nc != nil {
+		s.conns[nc] = true
+	}
+	return true
+}
+
+// untrack removes a listener or a connection registered by track
+func (s *Server) untrack(l net.Listener, nc net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+	delete(s.conns, nc)
+}
+
+// isClosed returns whether the server has been closed
+func (s *Server) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// Stream is a live H264 stream which is sent to every playing session
+type Stream struct {
+	mu       sync.RWMutex
+	params   h264.ParameterSets // params are the latest parameter sets, used for the session description
+	sessions map[*session]bool  // sessions are the playing sessions
+}
+
+// WriteAccessUnit sends the NAL units of an access unit, timed in 90kHz ticks, to every playing session. The
+// parameter sets are sent before keyframes so that clients can start decoding from them.
+func (st *Stream) WriteAccessUnit(units []h264.NALUnit, params h264.ParameterSets, timestamp uint32) {
+	keyframe := h264.ContainsKeyframe(units)
+	hasSPS := false
+	for _, u := range units {
+		if u.Type == h264.NALSPS {
+			hasSPS = true
+		}
+	}
+
+	var nals [][]byte
+	if keyframe && !hasSPS && params.Ready() {
+		nals = append(nals, params.SPSData, params.PPSData)
+	}
+	for _, u := range units {
+		if u.Type != h264.NALAUD {
+			nals = append(nals, u.Data)
+		}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.params = params
+	for s := range st.sessions {
+		s.send(nals, timestamp, keyframe)
+	}
+}
+
+// parameterSets returns the latest parameter sets of the stream
+func (st *Stream) parameterSets() h264.ParameterSets {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.params
+}
+
+// add starts sending the stream to a session
+func (st *Stream) add(s *session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sessions[s] = true
+}
+
+// remove stops sending the stream to a session
+func (st *Stream) remove(s *session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, s)
+}
+
+// session is the playback of a stream by a client
+type session struct {
+	id         string        // id is the session identifier sent in the Session header
+	stream     *Stream       // stream is the stream set up by the client
+	channel    byte          // channel is the interleaved channel that RTP packets are sent on
+	packetizer Packetizer    // packetizer splits access units into RTP packets
+	offset     uint32        // offset is added to timestamps so that they start at a random value
+	queue      chan [][]byte // queue holds the packets of access units waiting to be sent
+	playing    bool          // playing is true once the session has been added to the stream
+	resync     bool          // resync is true while access units are dropped until the next keyframe
+}
+
+// send queues an access unit for the session. Access units are dropped until the next keyframe if the client
+// cannot keep up, so that a slow client never stalls the stream.
+func (s *session) send(nals [][]byte, timestamp uint32, keyframe bool) {
+	if s.resync && !keyframe {
+		return
+	}
+	s.resync = false
+
+	select {
+	case s.queue <- s.packetizer.Packetize(nals, timestamp+s.offset):
+	default:
+		s.resync = true
+	}
+}
+
+// conn is a connection from an RTSP client
+type conn struct {
+	server  *Server
+	nc      net.Conn
+	r       *bufio.Reader
+	wmu     sync.Mutex // wmu serialises responses and interleaved packets
+	session *session   // session is the session set up on the connection
+}
+
+// handleConn serves requests on a connection until it is closed
+func (s *Server) handleConn(nc net.Conn) {
+	c := &conn{server: s, nc: nc, r: bufio.NewReader(nc)}
+	defer c.close()
+	defer s.untrack(nil, nc)
+
+	for {
+		// Close connections which have stopped sending requests and reports, as the client is gone
+		c.nc.SetReadDeadline(time.Now().Add(s.readTimeout))
+
+		// Skip interleaved packets sent by the client, such as RTCP receiver reports
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return
+		}
+		if b[0] == '$' {
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(c.r, header); err != nil {
+				return
+			}
+			if _, err := c.r.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+
+		req, err := ReadRequest(c.r)
+		if err != nil {
+			return
+		}
+		res := c.handle(req)
+		if err := c.write(res.marshal(req.Header.Get("CSeq"))); err != nil {
+			return
+		}
+		if req.Method == "TEARDOWN" {
+			return
+		}
+	}
+}
+
+// handle answers a request
+func (c *conn) handle(req *Request) *Response {
+	switch req.Method {
+	case "OPTIONS":
+		return &Response{Status: StatusOK, Header: []string{
+			"Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER",
+		}}
+	case "DESCRIBE":
+		return c.describe(req)
+	case "SETUP":
+		return c.setup(req)
+	case "PLAY":
+		return c.play(req)
+	case "TEARDOWN", "GET_PARAMETER":
+		if res := c.checkSession(req); res != nil {
+			return res
+		}
+		return &Response{Status: StatusOK}
+	default:
+		return &Response{Status: StatusNotImplemented}
+	}
+}
+
+// describe answers a DESCRIBE request with the session description of the stream
+func (c *conn) describe(req *Request) *Response {
+	name, ok := streamName(req.URL)
+	if !ok {
+		return &Response{Status: StatusBadRequest}
+	}
+	st := c.server.lookup(name)
+	if st == nil {
+		return &Response{Status: StatusNotFound}
+	}
+
+	// The session description needs the parameter sets, which are known once the stream has sent them
+	params := st.parameterSets()
+	if !params.Ready() {
+		return &Response{Status: StatusServiceUnavailable}
+	}
+	return &Response{
+		Status: StatusOK,
+		Header: []string{"Content-Type: application/sdp", "Content-Base: " + strings.TrimSuffix(req.URL, "/") + "/"},
+		Body:   SDP(params),
+	}
+}
+
+// setup answers a SETUP request, creating a session which sends RTP packets interleaved on the connection
+func (c *conn) setup(req *Request) *Response {
+	if c.session != nil {
+		return &Response{Status: StatusMethodNotValidInState}
+	}
+	name, ok := streamName(req.URL)
+	if !ok {
+		return &Response{Status: StatusBadRequest}
+	}
+	st := c.server.lookup(name)
+	if st == nil {
+		return &Response{Status: StatusNotFound}
+	}
+
+	// Only TCP interleaved transport is supported
+	channel, ok := interleavedChannel(req.Header.Get("Transport"))
+	if !ok {
+		return &Response{Status: StatusUnsupportedTransport}
+	}
+
+	// Draw the session ID, the SSRC and the timestamp offset from separate random bytes, so that the ID sent to the
+	// client reveals nothing about the others
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return &Response{Status: StatusServiceUnavailable}
+	}
+	c.session = &session{
+		id:         hex.EncodeToString(random[:8]),
+		stream:     st,
+		channel:    channel,
+		packetizer: Packetizer{SSRC: binary.BigEndian.Uint32(random[8:12])},
+		offset:     binary.BigEndian.Uint32(random[12:16]),
+		queue:      make(chan [][]byte, queueSize),
+		resync:     true,
+	}
+
+	return &Response{Status: StatusOK, Header: []string{
+		"Transport: RTP/AVP/TCP;unicast;interleaved=" + strconv.Itoa(int(channel)) + "-" + strconv.Itoa(int(channel)+1),
+		"Session: " + c.session.id + ";timeout=" + strconv.Itoa(sessionTimeout),
+	}}
+}
+
+// play answers a PLAY request, starting to send the stream to the session
+func (c *conn) play(req *Request) *Response {
+	if res := c.checkSession(req); res != nil {
+		return res
+	}
+
+	if !c.session.playing {
+		c.session.playing = true
+		go c.writePackets(c.session)
+		c.session.stream.add(c.session)
+	}
+	return &Response{Status: StatusOK, Header: []string{"Session: " + c.session.id, "Range: npt=0.000-"}}
+}
+
+// checkSession returns an error response unless the request refers to the session of the connection
+func (c *conn) checkSession(req *Request) *Response {
+	if c.session == nil {
+		return &Response{Status: StatusMethodNotValidInState}
+	}
+	id := strings.SplitN(req.Header.Get("Session"), ";", 2)[0]
+	if strings.TrimSpace(id) != c.session.id {
+		return &Response{Status: StatusSessionNotFound}
+	}
+	return nil
+}
+
+// writePackets sends queued packets to the client until the queue is closed
+func (c *conn) writePackets(s *session) {
+	for packets := range s.queue {
+		for _, p := range packets {
+			frame := make([]byte, 4, 4+len(p))
+			frame[0] = '$'
+			frame[1] = s.channel
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(p)))
+			if err := c.write(append(frame, p...)); err != nil {
+				// Closing the connection stops the request loop, which removes the session
+				c.nc.Close()
+				return
+			}
+		}
+	}
+}
+
+// write writes data to the client
+func (c *conn) write(data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.nc.Write(data)
+	return err
+}
+
+// close removes the session from its stream and closes the connection
+func (c *conn) close() {
+	if s := c.session; s != nil && s.playing {
+		// The stream no longer sends to the session once removed, so its queue can be closed
+		s.stream.remove(s)
+		close(s.queue)
+	}
+	c.nc.Close()
+}
+
+// streamName returns the name of the stream from a request URL, removing the track name used by SETUP
+func streamName(rawurl string) (string, bool) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", false
+	}
+	name := strings.Trim(u.Path, "/")
+	name = strings.Trim(strings.TrimSuffix(name, TrackName), "/")
+	return name, name != ""
+}
+
+// interleavedChannel returns the RTP channel from a Transport header requesting TCP interleaved transport
+func interleavedChannel(transport string) (byte, bool) {
+	// Clients may offer several transports, so use the first acceptable one
+	for _, spec := range strings.Split(transport, ",") {
+		fields := strings.Split(spec, ";")
+		if strings.TrimSpace(fields[0]) != "RTP/AVP/TCP" {
+			continue
+		}
+
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "interleaved=") {
+				continue
+			}
+			channels := strings.SplitN(strings.TrimPrefix(f, "interleaved="), "-", 2)
+			channel, err := strconv.Atoi(channels[0])
+			if err != nil || channel < 0 || channel > 254 {
+				return 0, false
+			}
+			return byte(channel), true
+		}
+		// Use the first channels if the client leaves them to the server
+		return 0, true
+	}
+	return 0, false
+}
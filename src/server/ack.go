@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"github.com/kz/swanntools/src/tunnel"
+)
+
+// acker acknowledges the frames of a session once every consumer has written them. The frames of a stream are
+// acknowledged in order, so a frame which is never written, such as one a consumer dropped, holds back the
+// acknowledgements of the frames after it until the client resends them on its next session.
+type acker struct {
+	mu      sync.Mutex
+	streams map[uint16]*ackedStream // streams holds the frames being written on each stream, by stream ID
+	written chan bool               // written is signalled once every consumer has written more frames
+}
+
+// ackedStream holds the frames of a stream which have not been acknowledged yet
+type ackedStream struct {
+	key     streamKey      // key identifies the stream across sessions
+	seqs    *sequenceStore // seqs records the last frame written on the stream across sessions
+	pending []*delivery    // pending are the frames being written, oldest first
+	written uint64         // written is the sequence number of the last frame written after every frame before it
+	acked   uint64         // acked is the sequence number of the last frame acknowledged to the client
+}
+
+// delivery is a frame which the consumers are writing
+type delivery struct {
+	acker     *acker       // acker acknowledges the frame once it is written
+	stream    *ackedStream // stream is the stream of the frame
+	sequence  uint64       // sequence is the sequence number of the frame
+	remaining int          // remaining is the number of consumers which still need to write the frame
+}
+
+// newAcker creates an acker for a session
+func newAcker() *acker {
+	return &acker{streams: make(map[uint16]*ackedStream), written: make(chan bool, 1)}
+}
+
+// track returns the delivery of a frame of the stream to the consumers, which is complete once each of them has
+// called written. Frames sent to no consumer are complete straight away.
+func (a *acker) track(id uint16, st *stream, sequence uint64, consumers int) *delivery {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.streams[id]
+	if s == nil || s.key != st.key {
+		s = &ackedStream{key: st.key, seqs: st.seqs}
+		a.streams[id] = s
+	}
+	d := &delivery{acker: a, stream: s, sequence: sequence, remaining: consumers}
+	s.pending = append(s.pending, d)
+	if consumers == 0 {
+		a.advance(s)
+	}
+	return d
+}
+
+// written records that a consumer has written the frame. It does nothing for frames which are not acknowledged.
+func (d *delivery) written() {
+	if d == nil {
+		return
+	}
+	a := d.acker
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d.remaining--
+	if d.remaining == 0 {
+		a.advance(d.stream)
+	}
+}
+
+// advance moves past the frames at the start of the stream which every consumer has written, recording the last of
+// them and signalling that it can be acknowledged
+func (a *acker) advance(s *ackedStream) {
+	advanced := false
+	for len(s.pending) > 0 && s.pending[0].remaining == 0 {
+		s.written = s.pending[0].sequence
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		advanced = true
+	}
+	if !advanced {
+		return
+	}
+	s.seqs.setWritten(s.key, s.written)
+	select {
+	case a.written <- true:
+	default:
+	}
+}
+
+// run sends the acknowledgements of the frames written by every consumer on the connection until ended is closed or
+// the connection fails. Frames written while an acknowledgement is being sent are acknowledged together.
+func (a *acker) run(tc *tunnel.Conn, ended <-chan bool) error {
+	for {
+		select {
+		case <-a.written:
+		case <-ended:
+			return nil
+		}
+		for _, m := range a.acks() {
+			if err := tc.Send(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// acks returns the acknowledgements of the frames written since the last acknowledgements
+func (a *acker) acks() []*tunnel.Message {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var acks []*tunnel.Message
+	for id, s := range a.streams {
+		if s.written > s.acked {
+			acks = append(acks, tunnel.AckMessage(id, s.written))
+			s.acked = s.written
+		}
+	}
+	return acks
+}
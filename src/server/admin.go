@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	log "github.com/Sirupsen/logrus"
+)
+
+// adminShutdownTimeout is how long requests to the admin API are given to finish once the server shuts down
+const adminShutdownTimeout = 5 * time.Second
+
+// adminAddress returns the address to serve the admin API on. Addresses without a host are bound to the loopback
+// interface, and addresses reachable by others need a token to authenticate requests with.
+func adminAddress(addr, token string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	ip := net.ParseIP(host)
+	if token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", errors.New("the admin API needs --admin-token unless it is bound to a loopback address")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// serveAdmin serves the admin API on the address until the context is cancelled. The API lists the streams being
+// published at /streams and reloads the configuration when /reload is posted to. Requests need to carry the token as
+// a bearer token if one is given.
+func serveAdmin(ctx context.Context, addr, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/streams", handleStreams)
+	mux.HandleFunc("/reload", func(rw http.ResponseWriter, r *http.Request) {
+		handleReload(ctx, rw, r)
+	})
+
+	server := &http.Server{Addr: addr, Handler: requireToken(token, mux)}
+
+	// Stop serving once the server shuts down, letting requests in progress finish
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warnln("Unable to stop the admin API: ", err.Error())
+		}
+	}()
+
+	log.WithField("Address", addr).Infoln("Admin API listening")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalln("Admin API stopped: ", err.Error())
+	}
+}
+
+// requireToken wraps the handler so that requests without the token as a bearer token are refused. Every request is
+// let through if the token is empty.
+func requireToken(token string, handler http.Handler) http.Handler {
+	if token == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// handleStreams responds with the status of every stream being published as JSON
+func handleStreams(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(published.list()); err != nil {
+		log.Warnln("Unable to write the streams to the admin API: ", err.Error())
+	}
+}
+
+// handleReload reloads the configuration, responding with the error if it cannot be applied. If it applies but some
+// consumers fail to start, the response lists them one per line.
+func handleReload(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	log.Infoln("Reload requested through the admin API")
+	failed, err := reload(ctx)
+	if err != nil {
+		log.Warnln("Unable to reload the configuration: ", err.Error())
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if len(failed) == 0 {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, err := range failed {
+		fmt.Fprintln(rw, err.Error())
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAddress(t *testing.T) {
+	tests := []struct {
+		addr, token, expected string
+		valid                 bool
+	}{
+		{":9100", "", "127.0.0.1:9100", true},
+		{"127.0.0.1:9100", "", "127.0.0.1:9100", true},
+		{"localhost:9100", "", "localhost:9100", true},
+		{"[::1]:9100", "", "[::1]:9100", true},
+		{"0.0.0.0:9100", "", "", false},
+		{"192.168.1.10:9100", "", "", false},
+		{"0.0.0.0:9100", "secret", "0.0.0.0:9100", true},
+		{"9100", "", "", false},
+	}
+	for _, test := range tests {
+		addr, err := adminAddress(test.addr, test.token)
+		if (err == nil) != test.valid {
+			t.Errorf("Expected %q with token %q to be valid: %t, got %v", test.addr, test.token, test.valid, err)
+			continue
+		}
+		if addr != test.expected {
+			t.Errorf("Expected %q to be served on %q, got %q", test.addr, test.expected, addr)
+		}
+	}
+}
+
+func TestRequireTokenRefusesOtherTokens(t *testing.T) {
+	handler := requireToken("secret", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		auth     string
+		expected int
+	}{
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/reload", nil)
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		if rw.Code != test.expected {
+			t.Errorf("Expected Authorization %q to respond with %d, got %d", test.auth, test.expected, rw.Code)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/pki"
+	"github.com/urfave/cli"
+)
+
+const (
+	tokensFile      = "tokens.json"  // tokensFile is the file in the certificate folder holding enrollment tokens
+	defaultTokenTTL = 24 * time.Hour // defaultTokenTTL is how long enrollment tokens can be redeemed for by default
+)
+
+// certsCommand manages the CA and the certificates in the certificate folder
+var certsCommand = cli.Command{
+	Name:  "certs",
+	Usage: "Manage the CA and certificates in the folder given by --certs",
+	Subcommands: []cli.Command{
+		{
+			Name:  "init",
+			Usage: "Create a CA to sign the server and client certificates with",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "name", Value: "swanntools CA", Usage: "Common name of the CA"},
+			},
+			Action: initCA,
+		},
+		{
+			Name:  "server",
+			Usage: "Issue the server certificate",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{Name: "host", Usage: "Host name or IP address clients reach the server at, " +
+					"which can be repeated"},
+				cli.DurationFlag{Name: "validity", Value: pki.CertValidity, Usage: "How long the certificate is valid"},
+			},
+			Action: issueServer,
+		},
+		{
+			Name:  "client",
+			Usage: "Issue a client certificate, writing it to a folder to copy to the client",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "name", Value: "", Usage: "Name of the client the certificate is issued to"},
+				cli.StringFlag{Name: "out", Value: "", Usage: "Folder to write the client certificate folder to"},
+				cli.DurationFlag{Name: "validity", Value: pki.CertValidity, Usage: "How long the certificate is valid"},
+			},
+			Action: issueClient,
+		},
+		{
+			Name:  "token",
+			Usage: "Create a one-time enrollment code for a client, which is redeemed with swanntools-client enroll",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "name", Value: "", Usage: "Name of the client the certificate is issued to"},
+				cli.DurationFlag{Name: "ttl", Value: defaultTokenTTL, Usage: "How long the code can be redeemed for"},
+			},
+			Action: createToken,
+		},
+	},
+}
+
+// initCA creates the CA in the certificate folder
+func initCA(c *cli.Context) error {
+	certs := certsFolder()
+	ca, err := pki.NewCA(c.String("name"), pki.CAValidity)
+	if err != nil {
+		log.Fatalln("Unable to create the CA: ", err.Error())
+	}
+	key, err := ca.KeyPEM()
+	if err != nil {
+		log.Fatalln("Unable to encode the CA key: ", err.Error())
+	}
+	checkNotExist(filepath.Join(certs, "ca.key"), filepath.Join(certs, "ca.pem"))
+	writeNewFile(filepath.Join(certs, "ca.key"), key, 0600)
+	writeNewFile(filepath.Join(certs, "ca.pem"), ca.CertPEM(), 0644)
+	log.WithField("fingerprint", pki.Fingerprint(ca.Cert.Raw)).Infoln("Created CA")
+	return nil
+}
+
+// issueServer issues the server certificate into the certificate folder
+func issueServer(c *cli.Context) error {
+	certs := certsFolder()
+	hosts := c.StringSlice("host")
+	if len(hosts) == 0 {
+		log.Fatalln("You need at least one --host which clients reach the server at")
+	}
+	cert, key, err := loadCA(certs).IssueServer(hosts, c.Duration("validity"))
+	if err != nil {
+		log.Fatalln("Unable to issue the server certificate: ", err.Error())
+	}
+	checkNotExist(filepath.Join(certs, "server.key"), filepath.Join(certs, "server.pem"))
+	writeNewFile(filepath.Join(certs, "server.key"), key, 0600)
+	writeNewFile(filepath.Join(certs, "server.pem"), cert, 0644)
+	log.WithField("hosts", hosts).Infoln("Issued server certificate")
+	return nil
+}
+
+// issueClient issues a client certificate into a new folder along with the CA certificate the server is verified with
+func issueClient(c *cli.Context) error {
+	certs := certsFolder()
+	name, out := c.String("name"), c.String("out")
+	if name == "" || out == "" {
+		log.Fatalln("You need both --name and --out to issue a client certificate")
+	}
+	ca := loadCA(certs)
+	cert, key, err := ca.IssueClient(name, c.Duration("validity"))
+	if err != nil {
+		log.Fatalln("Unable to issue the client certificate: ", err.Error())
+	}
+	if err := os.MkdirAll(out, 0700); err != nil {
+		log.Fatalln("Unable to create the folder: ", err.Error())
+	}
+	checkNotExist(filepath.Join(out, "client.key"), filepath.Join(out, "client.pem"), filepath.Join(out, "ca.pem"))
+	writeNewFile(filepath.Join(out, "client.key"), key, 0600)
+	writeNewFile(filepath.Join(out, "client.pem"), cert, 0644)
+	writeNewFile(filepath.Join(out, "ca.pem"), ca.CertPEM(), 0644)
+	log.WithFields(log.Fields{"cert": name, "folder": out}).Infoln("Issued client certificate")
+	return nil
+}
+
+// createToken creates an enrollment token and prints the code the client enrolls with, which also pins the server
+// certificate so that the client can trust the server before it has the CA certificate
+func createToken(c *cli.Context) error {
+	certs := certsFolder()
+	name := c.String("name")
+	if name == "" {
+		log.Fatalln("You need a --name to create an enrollment token for")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(certs, "server.pem"))
+	if err != nil {
+		log.Fatalln("Unable to read the server certificate: ", err.Error())
+	}
+	serverCert, err := pki.ParseCertificate(data)
+	if err != nil {
+		log.Fatalln("Unable to parse the server certificate: ", err.Error())
+	}
+
+	secret, err := pki.OpenTokens(filepath.Join(certs, tokensFile)).Create(name, c.Duration("ttl"))
+	if err != nil {
+		log.Fatalln("Unable to create the enrollment token: ", err.Error())
+	}
+	log.WithFields(log.Fields{"cert": name, "expires": time.Now().Add(c.Duration("ttl")).Format(time.RFC3339)}).
+		Infoln("Created enrollment token, which the server accepts when run with --enroll")
+	fmt.Println(pki.EnrollmentCode(secret, serverCert.Raw))
+	return nil
+}
+
+// certsFolder returns the certificate folder, exiting if none is given
+func certsFolder() string {
+	if flags.certs == "" {
+		log.Fatalln("You are missing the --certs flag. Run --help for more details.")
+	}
+	return flags.certs
+}
+
+// loadCA loads the CA created by certs init from the certificate folder, exiting if it cannot be loaded
+func loadCA(certs string) *pki.CA {
+	ca, err := pki.LoadCA(filepath.Join(certs, "ca.pem"), filepath.Join(certs, "ca.key"))
+	if err != nil {
+		log.Fatalln("Unable to load the CA, run certs init first: ", err.Error())
+	}
+	return ca
+}
+
+// checkNotExist exits if any of the files exist, so that a set of files is either written in full or not at all
+func checkNotExist(paths ...string) {
+	for _, path := range paths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			log.Fatalf("The file %s already exists, remove it first to replace it", path)
+		}
+	}
+}
+
+// writeNewFile writes data to a file which does not exist yet, exiting rather than replacing an existing file
+func writeNewFile(path string, data []byte, perm os.FileMode) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		log.Fatalln("Unable to create file, remove it first to replace it: ", err.Error())
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		log.Fatalln("Unable to write file: ", err.Error())
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalln("Unable to write file: ", err.Error())
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/registry"
+	"github.com/urfave/cli"
+)
+
+// clientsCommand manages the client registry given by --clients. Changes take effect on the next handshake of each
+// client, without restarting the server.
+var clientsCommand = cli.Command{
+	Name:  "clients",
+	Usage: "Manage the client registry given by --clients",
+	Subcommands: []cli.Command{
+		{
+			Name:  "add",
+			Usage: "Register a client, which authenticates with a key, a certificate or both",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "name", Value: "", Usage: "ID the client identifies itself with using --id"},
+				cli.StringFlag{Name: "key", Value: "", Usage: "Passphrase the client authenticates with using --key"},
+				cli.StringFlag{Name: "cert", Value: "", Usage: "Common name of the certificate the client presents"},
+				cli.StringSliceFlag{Name: "publish", Usage: "Stream the client may publish as site/channel, where " +
+					"either may be " + registry.Wildcard + " and the site is the name of a DVR of the client or its ID, " +
+						"which can be repeated"},
+			},
+			Action: addClient,
+		},
+		{
+			Name:   "revoke",
+			Usage:  "Stop a client from connecting, keeping it in the registry",
+			Flags:  []cli.Flag{cli.StringFlag{Name: "name", Value: "", Usage: "ID of the client"}},
+			Action: revokeClient,
+		},
+		{
+			Name:   "remove",
+			Usage:  "Remove a client from the registry",
+			Flags:  []cli.Flag{cli.StringFlag{Name: "name", Value: "", Usage: "ID of the client"}},
+			Action: removeClient,
+		},
+		{
+			Name:   "list",
+			Usage:  "List the registered clients",
+			Action: listClients,
+		},
+	},
+}
+
+// addClient registers a client
+func addClient(c *cli.Context) error {
+	client := &registry.Client{Name: c.String("name"), Cert: c.String("cert"), Publish: c.StringSlice("publish")}
+	if key := c.String("key"); key != "" {
+		client.SetKey(key)
+	}
+	if len(client.Publish) == 0 {
+		log.Warnln("The client cannot publish any streams until it is added with --publish")
+	}
+	if err := clientRegistry().Add(client); err != nil {
+		log.Fatalln("Unable to add the client: ", err.Error())
+	}
+	log.WithField("client", client.Name).Infoln("Client added")
+	return nil
+}
+
+// revokeClient stops a client from connecting
+func revokeClient(c *cli.Context) error {
+	if err := clientRegistry().Revoke(c.String("name")); err != nil {
+		log.Fatalln("Unable to revoke the client: ", err.Error())
+	}
+	log.WithField("client", c.String("name")).Infoln("Client revoked, which takes effect on its next handshake")
+	return nil
+}
+
+// removeClient removes a client from the registry
+func removeClient(c *cli.Context) error {
+	if err := clientRegistry().Remove(c.String("name")); err != nil {
+		log.Fatalln("Unable to remove the client: ", err.Error())
+	}
+	log.WithField("client", c.String("name")).Infoln("Client removed")
+	return nil
+}
+
+// listClients prints a line for each registered client
+func listClients(c *cli.Context) error {
+	clients, err := clientRegistry().Clients()
+	if err != nil {
+		log.Fatalln("Unable to load the client registry: ", err.Error())
+	}
+	for _, client := range clients {
+		var auth []string
+		if client.KeyHash != "" {
+			auth = append(auth, "key")
+		}
+		if client.Cert != "" {
+			auth = append(auth, "cert="+client.Cert)
+		}
+		status := "active"
+		if client.Revoked {
+			status = "revoked"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", client.Name, status, strings.Join(auth, ","), strings.Join(client.Publish, ","))
+	}
+	return nil
+}
+
+// clientRegistry returns the client registry, exiting if none is given
+func clientRegistry() *registry.Registry {
+	if flags.clients == "" {
+		log.Fatalln("You are missing the --clients flag. Run --help for more details.")
+	}
+	return registry.Open(flags.clients)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/configfile"
+	"github.com/kz/swanntools/src/hls"
+	"github.com/kz/swanntools/src/queue"
+	"github.com/urfave/cli"
+)
+
+// ConfigFile is the YAML or TOML file given by --config. Flags and environment variables take precedence over the
+// settings in the file.
+type ConfigFile struct {
+	Bind       string `config:"bind"`        // Bind is the address to listen on in the format host:port
+	Key        string `config:"key"`         // Key is the passphrase clients authenticate with without a client registry
+	Clients    string `config:"clients"`     // Clients is the file path to the client registry
+	Admin      string `config:"admin"`       // Admin is the address to serve the admin API on
+	AdminToken string `config:"admin_token"` // AdminToken is the bearer token requests to the admin API need
+	State      string `config:"state"`       // State is the file path to save the stream sequence numbers to
+	Timing     string `config:"timing"`      // Timing is the source of frame timing
+	Certs      struct {
+		Folder string `config:"folder"` // Folder is the certificate folder
+		CA     string `config:"ca"`     // CA is the file path to the CA certificate which signs client certificates
+		Enroll bool   `config:"enroll"` // Enroll lets clients without a certificate enroll with a token
+	} `config:"certs"`
+	Streams struct {
+		Takeover     string        `config:"takeover"`      // Takeover is the takeover policy
+		StaleTimeout time.Duration `config:"stale_timeout"` // StaleTimeout is the time after which streams are stale
+	} `config:"streams"`
+	Queue struct {
+		Size   int    `config:"size"`   // Size is the number of frames queued for each consumer
+		Policy string `config:"policy"` // Policy decides what happens when a consumer falls behind
+	} `config:"queue"`
+	Recordings struct {
+		Disk      string        `config:"disk"`      // Disk is the folder to save raw H264 recordings to
+		MP4       string        `config:"mp4"`       // MP4 is the folder to save fragmented MP4 recordings to
+		TS        string        `config:"ts"`        // TS is the folder to save MPEG-TS recordings to
+		Segment   time.Duration `config:"segment"`   // Segment is the duration of each recording segment
+		Retention time.Duration `config:"retention"` // Retention is the age after which recordings are removed
+	} `config:"recordings"`
+	Live struct {
+		Address string        `config:"address"` // Address is the address to serve HLS live streams on
+		Format  string        `config:"format"`  // Format is the format of live segments
+		Segment time.Duration `config:"segment"` // Segment is the duration of each live segment
+		Window  int           `config:"window"`  // Window is the number of segments in each live playlist
+	} `config:"live"`
+	RTSP struct {
+		Address string `config:"address"` // Address is the address to serve RTSP streams on
+	} `config:"rtsp"`
+}
+
+// Initialize the state needed to read the configuration file again when reloading
+var (
+	appContext  *cli.Context // appContext tells which flags were set on the command line or by environment variables
+	commandLine Flags        // commandLine holds the flags before the configuration file was applied
+)
+
+// loadConfigFile reads the file given by --config, if any, into the flags which were not set on the command line or
+// by environment variables
+func loadConfigFile(c *cli.Context) error {
+	appContext = c
+	commandLine = flags
+	if err := applyConfigFile(); err != nil {
+		log.WithField("Path", flags.config).Fatalln("Invalid configuration file: ", err.Error())
+	}
+	return nil
+}
+
+// applyConfigFile reads the file given by --config, if any, into the flags which were not set on the command line or
+// by environment variables, returning an error naming the offending key if the file is invalid
+func applyConfigFile() error {
+	if flags.config == "" {
+		return nil
+	}
+	file := &ConfigFile{}
+	err := configfile.Load(flags.config, file)
+	if err == nil {
+		err = file.validate()
+	}
+	if err != nil {
+		return err
+	}
+	c := appContext
+
+	setString(c, "bind", &flags.bindAddr, file.Bind)
+	setString(c, "key", &flags.key, file.Key)
+	setString(c, "clients", &flags.clients, file.Clients)
+	setString(c, "admin", &flags.admin, file.Admin)
+	setString(c, "admin-token", &flags.adminToken, file.AdminToken)
+	setString(c, "state", &flags.state, file.State)
+	setString(c, "timing", &flags.timing, file.Timing)
+	setString(c, "certs", &flags.certs, file.Certs.Folder)
+	setString(c, "ca", &flags.ca, file.Certs.CA)
+	if file.Certs.Enroll && !c.IsSet("enroll") {
+		flags.enroll = true
+	}
+	setString(c, "takeover", &flags.takeover, file.Streams.Takeover)
+	setDuration(c, "stale-timeout", &flags.staleTimeout, file.Streams.StaleTimeout)
+	setInt(c, "queue-size", &flags.queueSize, file.Queue.Size)
+	setString(c, "queue-policy", &flags.queuePolicy, file.Queue.Policy)
+	setString(c, "save-disk", &flags.saveDisk, file.Recordings.Disk)
+	setString(c, "save-mp4", &flags.saveMP4, file.Recordings.MP4)
+	setString(c, "save-ts", &flags.saveTS, file.Recordings.TS)
+	setDuration(c, "segment", &flags.segment, file.Recordings.Segment)
+	setDuration(c, "retention", &flags.retention, file.Recordings.Retention)
+	setString(c, "live", &flags.live, file.Live.Address)
+	setString(c, "live-format", &flags.liveFormat, file.Live.Format)
+	setDuration(c, "live-segment", &flags.liveSegment, file.Live.Segment)
+	setInt(c, "live-window", &flags.liveWindow, file.Live.Window)
+	setString(c, "rtsp", &flags.rtsp, file.RTSP.Address)
+	return nil
+}
+
+// validate checks the settings of the file, returning an error naming the offending key
+func (f *ConfigFile) validate() error {
+	addresses := []struct {
+		key, value string
+	}{{"bind", f.Bind}, {"admin", f.Admin}, {"live.address", f.Live.Address}, {"rtsp.address", f.RTSP.Address}}
+	for _, addr := range addresses {
+		if addr.value == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr.value); err != nil {
+			return configfile.Errorf(addr.key, "needs to be in the format host:port")
+		}
+	}
+	if f.Timing != "" {
+		if err := checkTiming(f.Timing); err != nil {
+			return configfile.Errorf("timing", "%s", err.Error())
+		}
+	}
+	if f.Streams.Takeover != "" {
+		if err := checkTakeover(f.Streams.Takeover); err != nil {
+			return configfile.Errorf("streams.takeover", "%s", err.Error())
+		}
+	}
+	if f.Queue.Policy != "" {
+		if _, err := queue.ParsePolicy(f.Queue.Policy); err != nil {
+			return configfile.Errorf("queue.policy", "%s", err.Error())
+		}
+	}
+	if f.Live.Format != "" && f.Live.Format != hls.FormatTS && f.Live.Format != hls.FormatFMP4 {
+		return configfile.Errorf("live.format", "needs to be either %s or %s", hls.FormatTS, hls.FormatFMP4)
+	}
+	amounts := []struct {
+		key   string
+		value int64
+	}{{"streams.stale_timeout", int64(f.Streams.StaleTimeout)}, {"queue.size", int64(f.Queue.Size)},
+		{"recordings.segment", int64(f.Recordings.Segment)}, {"recordings.retention", int64(f.Recordings.Retention)},
+		{"live.segment", int64(f.Live.Segment)}, {"live.window", int64(f.Live.Window)}}
+	for _, amount := range amounts {
+		if amount.value < 0 {
+			return configfile.Errorf(amount.key, "cannot be negative")
+		}
+	}
+	return nil
+}
+
+// setString sets the flag with the name to the value from the configuration file unless the value is empty or the
+// flag was set on the command line or by an environment variable
+func setString(c *cli.Context, name string, flag *string, value string) {
+	if value != "" && !c.IsSet(name) {
+		*flag = value
+	}
+}
+
+// setInt sets the flag with the name to the value from the configuration file unless the value is zero or the flag
+// was set on the command line or by an environment variable
+func setInt(c *cli.Context, name string, flag *int, value int) {
+	if value != 0 && !c.IsSet(name) {
+		*flag = value
+	}
+}
+
+// setDuration sets the flag with the name to the value from the configuration file unless the value is zero or the
+// flag was set on the command line or by an environment variable
+func setDuration(c *cli.Context, name string, flag *time.Duration, value time.Duration) {
+	if value != 0 && !c.IsSet(name) {
+		*flag = value
+	}
+}
@@ -1,65 +1,204 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	log "github.com/Sirupsen/logrus"
 	"time"
-	"os"
-	"strconv"
-)
-
-const (
-	SaveDiskHandlerType = 1
+	"github.com/kz/swanntools/src/dvr"
+	"github.com/kz/swanntools/src/h264"
+	"github.com/kz/swanntools/src/queue"
 )
 
-// Data is a struct which contains the channel number and stream of the data being sent
+// Data is a struct which contains the stream and a frame of the stream being sent
 type Data struct {
-	channel int
-	stream  []byte
+	stream   streamKey          // stream identifies the stream by its site and channel number
+	frame    *dvr.Frame         // frame is a complete frame of the stream
+	units    []h264.NALUnit     // units are the NAL units of a video frame
+	keyframe bool               // keyframe is true if the frame contains an IDR slice
+	params   h264.ParameterSets // params are the most recent parameter sets of the stream
+	received time.Time          // received is the time the frame was captured by the client, or arrived at the server
+	delivery *delivery          // delivery acknowledges the frame once every consumer wrote it, or nil if it is not
+}
+
+// newData creates the Data for a frame of the stream received at the time, tagging video frames with their NAL units
+// and updating params
+func newData(stream streamKey, frame *dvr.Frame, params *h264.ParameterSets, received time.Time) Data {
+	data := Data{stream: stream, frame: frame, received: received}
+
+	// Only video frames contain H264
+	if frame.IsVideo() {
+		data.units = h264.ParseAnnexB(frame.Payload)
+		data.keyframe = h264.ContainsKeyframe(data.units)
+		if params.Update(data.units) && params.SPS != nil {
+			log.WithFields(log.Fields{
+				"stream": stream, "width": params.SPS.Width, "height": params.SPS.Height,
+				"profile": params.SPS.ProfileIdc, "level": params.SPS.LevelIdc,
+			}).Infoln("Stream parameters updated")
+		}
+	}
+
+	// Copy the parameter sets so that consumers are unaffected by later updates
+	data.params = *params
+	return data
+}
+
+// Consumer performs an operation on the streams received by the server, such as saving them to disk
+type Consumer interface {
+	// Start prepares the consumer, such as by opening listeners, before any data is written
+	Start() error
+	// Write performs the operation of the consumer on a frame of a stream
+	Write(data Data) error
+	// Close releases the resources of the consumer, such as open files and listeners
+	Close() error
 }
 
-// Consumer is a type which consumes a DVR stream and performs an operation on it
-type Consumer struct {
-	// Receiver is the channel which receives a byte stream of DVR video
-	Receiver chan Data
-	// Handler is used to figure out which handler to use
-	HandlerType int
-	// Destination is the destination (e.g., file path to directory) of the stream
+// ConsumerOptions configures a consumer. Each consumer uses the options which apply to it.
+type ConsumerOptions struct {
+	// Destination is the destination (e.g., file path to directory or listen address) of the stream
 	Destination string
+	// SegmentDuration is the minimum duration of each segment before it is split at the next keyframe
+	SegmentDuration time.Duration
+	// Timing is the source of frame timing for consumers which need it, either ArrivalTiming or DVRTiming
+	Timing string
+	// Format is the segment format of live streams, either hls.FormatTS or hls.FormatFMP4
+	Format string
+	// Window is the number of segments listed in live playlists
+	Window int
+	// QueueSize is the number of frames queued for the consumer before the queue policy applies
+	QueueSize int
+	// QueuePolicy decides what happens to frames when the queue of the consumer is full
+	QueuePolicy queue.Policy
 }
 
-func (c *Consumer) Handle() {
-	switch c.HandlerType {
-	// Sends data to be saved on disk
-	case SaveDiskHandlerType:
-		for {
-			select {
-			case data := <-c.Receiver:
-				c.saveDisk(data)
-			}
+// withDestination returns a copy of the options with the destination set
+func (o ConsumerOptions) withDestination(destination string) ConsumerOptions {
+	o.Destination = destination
+	return o
+}
+
+// ConsumerFactory creates a consumer from its options, returning an error if the options are invalid
+type ConsumerFactory func(options ConsumerOptions) (Consumer, error)
+
+// consumerFactories holds the factory of each consumer by name
+var consumerFactories = make(map[string]ConsumerFactory)
+
+// RegisterConsumer makes a consumer available by name. Consumers register themselves when the server starts.
+func RegisterConsumer(name string, factory ConsumerFactory) {
+	if _, exists := consumerFactories[name]; exists {
+		log.Fatalf("The consumer %s is registered twice", name)
+	}
+	consumerFactories[name] = factory
+}
+
+// NewConsumer creates the consumer registered with the name
+func NewConsumer(name string, options ConsumerOptions) (Consumer, error) {
+	factory, ok := consumerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown consumer %s", name)
+	}
+	return factory(options)
+}
+
+// statsInterval is how often the queue counters of each consumer are logged when frames have been dropped
+const statsInterval = time.Minute
+
+// runner feeds a consumer with data from its own goroutine, through a bounded queue so that a slow consumer does
+// not stall the streams
+type runner struct {
+	name     string          // name is the registered name of the consumer
+	options  ConsumerOptions // options are the options the consumer was created with
+	consumer Consumer        // consumer performs the operation
+	queue    *queue.Queue    // queue holds the frames waiting for the consumer
+	done     chan bool       // done is closed once the consumer has been closed
+}
+
+// newRunner creates a runner for a started consumer
+func newRunner(name string, consumer Consumer, options ConsumerOptions) *runner {
+	return &runner{
+		name:     name,
+		options:  options,
+		consumer: consumer,
+		queue:    queue.New(options.QueueSize, options.QueuePolicy),
+		done:     make(chan bool),
+	}
+}
+
+// send queues data for the consumer, applying the overflow policy if the consumer has fallen behind
+func (r *runner) send(data Data) {
+	r.queue.Push(queue.Item{Value: data, Stream: data.stream, Size: len(data.frame.Payload), Keyframe: data.keyframe})
+}
+
+// run writes data to the consumer until the queue is closed and drained, then closes the consumer
+func (r *runner) run() {
+	defer close(r.done)
+	go r.report()
+
+	for {
+		item, ok := r.queue.Pop()
+		if !ok {
+			break
+		}
+		data := item.Value.(Data)
+		if err := r.consumer.Write(data); err != nil {
+			log.WithFields(log.Fields{"consumer": r.name, "stream": data.stream}).
+				Warnln("Consumer failed to handle data: ", err.Error())
 		}
-	default:
-		log.Fatalf("Unknown handler type used: %d\n", c.HandlerType)
+		// Frames which fail to be written are acknowledged as well, as writing them again would fail too
+		data.delivery.written()
+	}
+
+	if err := r.consumer.Close(); err != nil {
+		log.WithField("consumer", r.name).Warnln("Consumer failed to close: ", err.Error())
 	}
 }
 
-// saveDisk saves the stream to a file which rotates every hour
-func (c *Consumer) saveDisk(data Data) {
-	// Generate file name
-	fileName := time.Now().Format("2006-01-02-15-") + strconv.Itoa(data.channel) + ".h264"
+// stop closes the queue of the consumer and waits until the consumer has written the queued frames and closed
+func (r *runner) stop() {
+	r.queue.Close()
+	<-r.done
+}
 
-	// Generate file path
-	path := c.Destination + "/" + fileName
+// report logs the queue counters whenever more frames have been dropped, until the consumer is closed
+func (r *runner) report() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
 
-	// Open file path
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		log.WithField("Path", path).Fatalln("Unable to open file: ", err.Error())
+	var reported uint64
+	for {
+		select {
+		case <-ticker.C:
+			stats := r.queue.Stats()
+			if stats.DroppedFrames == reported {
+				continue
+			}
+			reported = stats.DroppedFrames
+			log.WithFields(log.Fields{
+				"consumer": r.name, "frames": stats.Frames, "bytes": stats.Bytes,
+				"droppedFrames": stats.DroppedFrames, "droppedBytes": stats.DroppedBytes, "queued": r.queue.Len(),
+			}).Warnln("Consumer is falling behind and frames have been dropped")
+		case <-r.done:
+			return
+		}
 	}
-	defer f.Close()
+}
 
-	// Write to file
-	_, err = f.Write(data.stream)
+// checkTiming returns an error unless the timing source is known
+func checkTiming(timing string) error {
+	if timing != ArrivalTiming && timing != DVRTiming {
+		return fmt.Errorf("the timing source needs to be either %s or %s", ArrivalTiming, DVRTiming)
+	}
+	return nil
+}
+
+// checkDirectory returns an error unless the directory exists
+func checkDirectory(dir string) error {
+	info, err := os.Stat(dir)
 	if err != nil {
-		log.WithField("Path", path).Fatalln("Error when writing to file: ", err.Error())
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
 	}
+	return nil
 }
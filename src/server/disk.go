@@ -0,0 +1,69 @@
+package main
+
+// diskConsumer saves the raw H264 stream of each channel to files which are split at the first keyframe after each
+// segment duration
+type diskConsumer struct {
+	options  ConsumerOptions        // options configure the consumer
+	segments map[streamKey]*segment // segments are the open recordings of each stream
+}
+
+func init() {
+	RegisterConsumer("disk", newDiskConsumer)
+}
+
+// newDiskConsumer creates a diskConsumer saving to the directory in options
+func newDiskConsumer(options ConsumerOptions) (Consumer, error) {
+	if err := checkDirectory(options.Destination); err != nil {
+		return nil, err
+	}
+	return &diskConsumer{options: options, segments: make(map[streamKey]*segment)}, nil
+}
+
+// Start does nothing as segments are opened when the first keyframe of each channel arrives
+func (c *diskConsumer) Start() error {
+	return nil
+}
+
+// Write saves a frame to the segment of its channel
+func (c *diskConsumer) Write(data Data) error {
+	// Only video frames are saved
+	if !data.frame.IsVideo() {
+		return nil
+	}
+	seg := c.segments[data.stream]
+
+	// Start a new segment on a keyframe once the segment duration has passed
+	if shouldRotate(seg, data, c.options.SegmentDuration) {
+		if seg != nil {
+			seg.close()
+			delete(c.segments, data.stream)
+		}
+		var err error
+		if seg, err = openSegment(c.options.Destination, data.stream, ".h264", data.received); err != nil {
+			return err
+		}
+		c.segments[data.stream] = seg
+
+		// Repeat the parameter sets so that the segment can be decoded from its start
+		if err := seg.write(parameterSetsFor(data)); err != nil {
+			return err
+		}
+	}
+
+	// Drop frames until the first keyframe so that the segment is playable from its start
+	if seg == nil {
+		return nil
+	}
+
+	// Write to file
+	return seg.write(data.frame.Payload)
+}
+
+// Close closes the open segments
+func (c *diskConsumer) Close() error {
+	for stream, seg := range c.segments {
+		seg.close()
+		delete(c.segments, stream)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/pki"
+	"github.com/kz/swanntools/src/tunnel"
+)
+
+// enroll handles a session from a client without a certificate, which may only redeem an enrollment token for one.
+// Clients which say hello instead are told that they need a certificate.
+func enroll(tc *tunnel.Conn, logger *log.Entry) {
+	msg, err := tc.Receive()
+	if err != nil {
+		logger.Warnln("Unable to retrieve enrollment message: ", err.Error())
+		return
+	}
+	if msg.Type != tunnel.MsgEnroll {
+		logger.Warnln("Rejected client without a certificate")
+		reply := &tunnel.HelloReply{Status: tunnel.StatusUnauthorized, Version: tunnel.Version,
+			Reason: "a client certificate is required"}
+		if msg, err = reply.Message(); err == nil {
+			err = tc.Send(msg)
+		}
+		if err != nil {
+			logger.Warnln("Unable to write response to client: ", err.Error())
+		}
+		return
+	}
+
+	reply := signRequest(msg, logger)
+	if msg, err = reply.Message(); err == nil {
+		err = tc.Send(msg)
+	}
+	if err != nil {
+		logger.Warnln("Unable to write response to client: ", err.Error())
+	}
+}
+
+// signRequest redeems the token of an enrollment and signs the certificate request of the client
+func signRequest(msg *tunnel.Message, logger *log.Entry) *tunnel.EnrollmentReply {
+	e := &tunnel.Enrollment{}
+	if err := e.UnmarshalBinary(msg.Payload); err != nil {
+		return &tunnel.EnrollmentReply{Status: tunnel.StatusUnauthorized, Reason: "malformed enrollment"}
+	}
+
+	// Check the request before using up the token, so that a broken client can try again
+	if _, err := pki.ParseRequest(e.Request); err != nil {
+		logger.Warnln("Rejected enrollment with an invalid certificate request: ", err.Error())
+		return &tunnel.EnrollmentReply{Status: tunnel.StatusUnauthorized, Reason: "invalid certificate request"}
+	}
+	name, err := config.tokens.Redeem(e.Token)
+	if err != nil {
+		logger.Warnln("Rejected enrollment: ", err.Error())
+		return &tunnel.EnrollmentReply{Status: tunnel.StatusUnauthorized, Reason: "invalid or expired token"}
+	}
+
+	cert, err := config.authority.SignClient(e.Request, name, pki.CertValidity)
+	if err != nil {
+		logger.WithField("cert", name).Warnln("Unable to sign client certificate: ", err.Error())
+		return &tunnel.EnrollmentReply{Status: tunnel.StatusUnauthorized, Reason: "unable to sign certificate"}
+	}
+	logger.WithField("cert", name).Infoln("Enrolled client")
+	return &tunnel.EnrollmentReply{Status: tunnel.StatusOK, Certificate: cert, CA: config.authority.CertPEM()}
+}
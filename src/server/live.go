@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/hls"
+	"github.com/kz/swanntools/src/mp4"
+	"github.com/kz/swanntools/src/mpegts"
+)
+
+// Defaults of the live stream
+const (
+	defaultLiveSegmentDuration = 2 * time.Second // defaultLiveSegmentDuration is the target duration of live segments
+	defaultLiveWindow          = 6               // defaultLiveWindow is the number of segments in each playlist
+)
+
+// liveStream builds the live segments of a single channel
+type liveStream struct {
+	window       *hls.Window   // window holds the finished segments
+	buf          *bytes.Buffer // buf holds the MPEG-TS segment being built
+	muxer        *mpegts.Muxer // muxer packetizes frames into buf
+	samples      []mp4.Sample  // samples are the fragmented MP4 samples of the segment being built
+	sequence     uint32        // sequence is the sequence number of the last MP4 fragment
+	decodeTime   uint64        // decodeTime is the decode time of the next MP4 fragment
+	sps          []byte        // sps is the SPS the stream was started with
+	pts          uint64        // pts is the presentation time of the last frame in 90kHz ticks
+	segmentStart uint64        // segmentStart is the presentation time of the first frame of the segment
+	last         *Data         // last is the last added frame, used to time the next one
+}
+
+// liveConsumer serves the stream of each channel over HLS from a rolling window of segments
+type liveConsumer struct {
+	options ConsumerOptions           // options configure the consumer
+	server  *hls.Server               // server serves the windows over HTTP
+	http    *http.Server              // http serves the windows and tracks the client connections
+	streams map[streamKey]*liveStream // streams are the live streams by site and channel
+}
+
+func init() {
+	RegisterConsumer("live", newLiveConsumer)
+}
+
+// newLiveConsumer creates a liveConsumer listening on the address in options
+func newLiveConsumer(options ConsumerOptions) (Consumer, error) {
+	if options.Format != hls.FormatTS && options.Format != hls.FormatFMP4 {
+		return nil, fmt.Errorf("the live format needs to be either %s or %s", hls.FormatTS, hls.FormatFMP4)
+	}
+	if err := checkTiming(options.Timing); err != nil {
+		return nil, err
+	}
+	if options.SegmentDuration <= 0 {
+		options.SegmentDuration = defaultLiveSegmentDuration
+	}
+	return &liveConsumer{options: options, server: hls.NewServer(), streams: make(map[streamKey]*liveStream)}, nil
+}
+
+// Start starts the HTTP server for the live streams
+func (c *liveConsumer) Start() error {
+	l, err := net.Listen("tcp", c.options.Destination)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(hls.PathPrefix, c.server)
+	c.http = &http.Server{Handler: mux}
+	go func() {
+		log.WithField("Address", c.options.Destination).Infoln("Live stream server listening")
+		if err := c.http.Serve(l); err != http.ErrServerClosed {
+			log.Warnln("Live stream server stopped: ", err.Error())
+		}
+	}()
+	return nil
+}
+
+// Close stops the HTTP server and closes the connections of its clients
+func (c *liveConsumer) Close() error {
+	return c.http.Close()
+}
+
+// Write adds a frame to the rolling window of segments of its channel
+func (c *liveConsumer) Write(data Data) error {
+	// Only video frames are streamed
+	if !data.frame.IsVideo() {
+		return nil
+	}
+	s := c.streams[data.stream]
+
+	// Finish the duration of the last frame now that the next one has arrived
+	if s != nil && s.last != nil {
+		d := sampleDuration(c.options.Timing, *s.last, data)
+		s.pts += uint64(d)
+		if len(s.samples) > 0 {
+			s.samples[len(s.samples)-1].Duration = d
+		}
+	}
+
+	// Segments start on keyframes once the parameter sets are known
+	if data.keyframe && data.params.Ready() {
+		paramsChanged := s != nil && !bytes.Equal(s.sps, data.params.SPSData)
+
+		// Finish the segment once it is long enough, or when the stream changes as players need a new init section
+		if s != nil && (paramsChanged || s.elapsed() >= c.options.SegmentDuration) {
+			c.finishSegment(s)
+		}
+
+		if s == nil {
+			s = c.newLiveStream(data.stream)
+		}
+		if s.sps == nil || paramsChanged {
+			if err := c.resetLiveStream(s, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Drop frames until the first keyframe so that the first segment is playable from its start
+	if s == nil || s.sps == nil {
+		return nil
+	}
+	s.last = &data
+
+	// Add the frame to the segment being built
+	if c.options.Format == hls.FormatFMP4 {
+		s.samples = append(s.samples, mp4.NewSample(data.units, defaultSampleDuration))
+		return nil
+	}
+	au := mpegts.AccessUnit(data.units, data.params)
+	return s.muxer.WriteAccessUnit(au, s.pts, data.keyframe)
+}
+
+// newLiveStream creates the live stream of a channel and starts serving it at the site and channel
+func (c *liveConsumer) newLiveStream(stream streamKey) *liveStream {
+	s := &liveStream{window: hls.NewWindow(c.options.Format, c.options.Window), buf: new(bytes.Buffer)}
+	s.muxer = mpegts.NewMuxer(s.buf)
+	c.streams[stream] = s
+	c.server.SetWindow(stream.String(), s.window)
+
+	log.WithField("stream", stream).Infoln("Live stream available at " + hls.PathPrefix + stream.String() + "/" +
+		hls.PlaylistName)
+	return s
+}
+
+// resetLiveStream continues the live stream with the parameter sets of data, after a discontinuity if they changed
+func (c *liveConsumer) resetLiveStream(s *liveStream, data Data) error {
+	var init []byte
+	if c.options.Format == hls.FormatFMP4 {
+		var err error
+		if init, err = mp4.InitSegment(data.params); err != nil {
+			return err
+		}
+	}
+	s.window.SetInit(init)
+	s.sps = data.params.SPSData
+	s.segmentStart = s.pts
+	return nil
+}
+
+// finishSegment adds the segment being built to the window
+func (c *liveConsumer) finishSegment(s *liveStream) {
+	duration := s.elapsed()
+	s.segmentStart = s.pts
+
+	if c.options.Format == hls.FormatFMP4 {
+		if len(s.samples) == 0 {
+			return
+		}
+		s.sequence++
+		s.window.Add(mp4.Fragment(s.sequence, s.decodeTime, s.samples), duration)
+		for _, sample := range s.samples {
+			s.decodeTime += uint64(sample.Duration)
+		}
+		s.samples = nil
+		return
+	}
+
+	if s.buf.Len() == 0 {
+		return
+	}
+	// Copy the segment as the buffer is reused for the next one
+	s.window.Add(append([]byte(nil), s.buf.Bytes()...), duration)
+	s.buf.Reset()
+}
+
+// elapsed returns the duration of the segment being built
+func (s *liveStream) elapsed() time.Duration {
+	return time.Duration(s.pts-s.segmentStart) * time.Second / mp4.Timescale
+}
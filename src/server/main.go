@@ -1,38 +1,71 @@
 package main
 
 import (
+	"context"
 	"os"
 	"github.com/urfave/cli"
 	"net"
+	"time"
 	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/hls"
+	"github.com/kz/swanntools/src/pki"
+	"github.com/kz/swanntools/src/queue"
+	"github.com/kz/swanntools/src/shutdown"
 )
 
 const (
-	maxChannels      = 4    // maxChannels is the maximum number of channels supported
-	socketBufferSize = 1460 // socketBufferSize is the maximum buffer size for DVR data
+	defaultQueueSize = 256 // defaultQueueSize is the number of frames queued for each consumer if none is configured
 )
 
-// Config is a struct of all the configuration variables after user input is processed
+// Config is a struct of all the configuration variables after user input is processed. Settings which can change
+// while the server is running are kept apart in Settings.
 type Config struct {
-	bindAddr  *net.TCPAddr // bindAddr is the TCP address for the server to bind to
-	key       string       // key is the passphrase to authenticate the client with
-	certs     string       // certs is the file path to the server certificates
-	consumers []Consumer   // consumer is a byte array of consumers which performs actions on the stream
+	bindAddr *net.TCPAddr // bindAddr is the TCP address for the server to bind to
+	certs    string       // certs is the file path to the server certificates
+	ca       string       // ca is the file path to the CA certificate which signs client certificates, if not the default
+
+	authority *pki.CA     // authority signs the certificates of enrolling clients, or is nil if enrollment is disabled
+	tokens    *pki.Tokens // tokens are the enrollment tokens clients redeem for a certificate
 }
 
 // Flags is a struct of all flags after user input is processed
 type Flags struct {
 	bindAddr string
 	key      string
+	clients  string
 	certs    string
+	ca       string
+	enroll   bool
 	saveDisk string
+	saveMP4  string
+	saveTS   string
+	segment   time.Duration
+	retention time.Duration
+	timing    string
+
+	live        string
+	liveFormat  string
+	liveSegment time.Duration
+	liveWindow  int
+
+	rtsp       string
+	admin      string
+	adminToken string
+	state      string
+
+	takeover     string
+	staleTimeout time.Duration
+
+	queueSize   int
+	queuePolicy string
+
+	config string
 }
 
 // Initialize global variables
 var (
-	flags         Flags  // flags stores the CLI flags
-	config        Config // config stores the configuration values
-	channelsInUse []int  // channelsInUse prevents the same channel from receiving multiple streams at once
+	flags  Flags  // flags stores the CLI flags
+	config Config // config stores the configuration values
 )
 
 // main defines how the command line application works
@@ -46,14 +79,74 @@ func main() {
 			Destination: &flags.bindAddr, EnvVar: "SWANN_BIND", },
 		cli.StringFlag{Name: "key", Value: "", Usage: "Passphrase to authenticate the client",
 			Destination: &flags.key, EnvVar: "SWANN_KEY"},
+		cli.StringFlag{Name: "clients", Value: "", Usage: "File path to the client registry, which replaces --key " +
+			"with per-client credentials and the streams each client may publish",
+			Destination: &flags.clients, EnvVar: "SWANN_CLIENTS"},
 		cli.StringFlag{Name: "certs", Value: "", Usage: "Absolute file path to the certificate folder",
 			Destination: &flags.certs, EnvVar: "SWANN_CERTS", },
+		cli.StringFlag{Name: "ca", Value: "", Usage: "File path to the CA certificate which signs client " +
+			"certificates, defaulting to ca.pem or else client.pem in the certificate folder",
+			Destination: &flags.ca, EnvVar: "SWANN_CA", },
+		cli.BoolFlag{Name: "enroll", Usage: "Let clients without a certificate enroll with a token created by " +
+			"the certs token command", Destination: &flags.enroll, EnvVar: "SWANN_ENROLL"},
 		cli.StringFlag{Name: "save-disk", Value: "", Usage: "File path to transcode and save the stream to",
 			Destination: &flags.saveDisk, EnvVar: "SWANN_SAVE_DISK"},
+		cli.StringFlag{Name: "save-mp4", Value: "", Usage: "File path to save the stream to as fragmented MP4",
+			Destination: &flags.saveMP4, EnvVar: "SWANN_SAVE_MP4"},
+		cli.StringFlag{Name: "save-ts", Value: "", Usage: "File path to save the stream to as MPEG-TS",
+			Destination: &flags.saveTS, EnvVar: "SWANN_SAVE_TS"},
+		cli.StringFlag{Name: "timing", Value: ArrivalTiming,
+			Usage: "Source of MP4 and MPEG-TS frame timing, either \"" + ArrivalTiming + "\" or \"" +
+				DVRTiming + "\"",
+			Destination: &flags.timing, EnvVar: "SWANN_TIMING"},
+		cli.DurationFlag{Name: "segment", Value: defaultSegmentDuration,
+			Usage:       "Duration of each recording segment (e.g., 1m, 5m, 60m), split at the next keyframe",
+			Destination: &flags.segment, EnvVar: "SWANN_SEGMENT"},
+		cli.DurationFlag{Name: "retention", Value: 0,
+			Usage:       "Age after which recordings are removed (e.g., 72h), keeping them forever if zero",
+			Destination: &flags.retention, EnvVar: "SWANN_RETENTION"},
+		cli.StringFlag{Name: "live", Value: "", Usage: "The address to serve HLS live streams on in the format host:port",
+			Destination: &flags.live, EnvVar: "SWANN_LIVE"},
+		cli.StringFlag{Name: "live-format", Value: hls.FormatTS,
+			Usage:       "Format of live segments, either \"" + hls.FormatTS + "\" or \"" + hls.FormatFMP4 + "\"",
+			Destination: &flags.liveFormat, EnvVar: "SWANN_LIVE_FORMAT"},
+		cli.DurationFlag{Name: "live-segment", Value: defaultLiveSegmentDuration,
+			Usage:       "Duration of each live segment, split at the next keyframe",
+			Destination: &flags.liveSegment, EnvVar: "SWANN_LIVE_SEGMENT"},
+		cli.IntFlag{Name: "live-window", Value: defaultLiveWindow, Usage: "Number of segments in each live playlist",
+			Destination: &flags.liveWindow, EnvVar: "SWANN_LIVE_WINDOW"},
+		cli.StringFlag{Name: "rtsp", Value: "", Usage: "The address to serve RTSP streams on in the format host:port",
+			Destination: &flags.rtsp, EnvVar: "SWANN_RTSP"},
+		cli.StringFlag{Name: "admin", Value: "", Usage: "The address to serve the admin API on in the format " +
+			"host:port, bound to 127.0.0.1 if the host is left out", Destination: &flags.admin, EnvVar: "SWANN_ADMIN"},
+		cli.StringFlag{Name: "admin-token", Value: "", Usage: "Bearer token which requests to the admin API need " +
+			"to carry, required unless the admin API is bound to a loopback address",
+			Destination: &flags.adminToken, EnvVar: "SWANN_ADMIN_TOKEN"},
+		cli.StringFlag{Name: "state", Value: "", Usage: "File path to save the sequence number of the last frame " +
+			"of each stream to, so that frames resent after the server restarts are only written once",
+			Destination: &flags.state, EnvVar: "SWANN_STATE"},
+		cli.StringFlag{Name: "takeover", Value: TakeoverStale,
+			Usage: "Whether a session can take over a stream which another session is publishing, either \"" +
+				TakeoverNever + "\", \"" + TakeoverStale + "\" or \"" + TakeoverAlways + "\"",
+			Destination: &flags.takeover, EnvVar: "SWANN_TAKEOVER"},
+		cli.DurationFlag{Name: "stale-timeout", Value: defaultStaleTimeout,
+			Usage:       "Time without frames after which a stream can be taken over by another session",
+			Destination: &flags.staleTimeout, EnvVar: "SWANN_STALE_TIMEOUT"},
+		cli.IntFlag{Name: "queue-size", Value: defaultQueueSize, Usage: "Number of frames queued for each consumer",
+			Destination: &flags.queueSize, EnvVar: "SWANN_QUEUE_SIZE"},
+		cli.StringFlag{Name: "queue-policy", Value: string(queue.Block),
+			Usage: "What happens when a consumer falls behind, either \"" + string(queue.Block) + "\", \"" +
+				string(queue.DropOldest) + "\" or \"" + string(queue.DropUntilKeyframe) + "\"",
+			Destination: &flags.queuePolicy, EnvVar: "SWANN_QUEUE_POLICY"},
+		cli.StringFlag{Name: "config", Value: "", Usage: "File path to a YAML or TOML configuration file, whose " +
+			"settings are overridden by flags and environment variables", Destination: &flags.config,
+			EnvVar: "SWANN_CONFIG"},
 	}
 
 	app.Name = "swanntools-client"
 	app.Usage = "client for kz/swanntools"
+	app.Commands = []cli.Command{certsCommand, clientsCommand}
+	app.Before = loadConfigFile
 	app.Action = func(c *cli.Context) error {
 		// Run the main application
 		run()
@@ -69,13 +162,10 @@ func run() {
 	config = Config{}
 
 	// Ensure that the command line flags are not empty
-	if flags.certs == "" || flags.key == "" || flags.bindAddr == "" {
+	if flags.certs == "" || (flags.key == "" && flags.clients == "") || flags.bindAddr == "" {
 		log.Fatalln("You are missing one or more flags. Run --help for more details.")
 	}
 
-	// Add key flag to config
-	config.key = flags.key
-
 	// Ensure that the certificates exist at the location
 	for _, file := range []string{"server.key", "server.pem"} {
 		if _, err := os.Stat(flags.certs + "/" + file); err != nil {
@@ -85,28 +175,45 @@ func run() {
 
 	// Add certificate to config
 	config.certs = flags.certs
+	config.ca = flags.ca
 
-	// If saveDisk is set, ensure that directory exists and start handler
-	if flags.saveDisk != "" {
-		// Check if directory exists
-		if _, err := os.Stat(flags.saveDisk); err != nil {
-			log.Fatalln("Unable to stat save disk folder: ", err.Error())
+	// Load the CA which signs the certificates of enrolling clients
+	if flags.enroll {
+		ca, err := pki.LoadCA(flags.certs+"/ca.pem", flags.certs+"/ca.key")
+		if err != nil {
+			log.Fatalln("Unable to load the CA to enroll clients with: ", err.Error())
 		}
+		config.authority = ca
+		config.tokens = pki.OpenTokens(flags.certs + "/" + tokensFile)
+	}
 
-		// Append a new consumer to config.consumers
-		config.consumers = append(config.consumers, Consumer{
-			Receiver:    make(chan Data),
-			HandlerType: SaveDiskHandlerType,
-			Destination: flags.saveDisk,
-		})
+	// Stop gracefully on SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	go shutdown.OnSignal(cancel)
 
-		log.WithField("Path", flags.saveDisk).Infoln("Save disk consumer added")
+	// Apply the settings which can be reloaded, starting every consumer
+	s, consumers, err := newSettings()
+	if err != nil {
+		log.Fatalln(err.Error())
 	}
+	failed, err := applySettings(s, consumers)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	// Unlike when reloading, every consumer needs to start along with the server
+	if len(failed) > 0 {
+		log.Fatalln(failed[0].Error())
+	}
+	started = flags
 
-	// Start handlers for all consumers
-	for _, consumer := range config.consumers {
-		go consumer.Handle()
+	// Load the sequence numbers of the streams saved by the last run
+	if sequences, err = openSequenceStore(flags.state); err != nil {
+		log.WithField("Path", flags.state).Fatalln("Unable to load the stream sequence numbers: ", err.Error())
 	}
+	go saveSequences(ctx)
+
+	// Remove recordings once they are older than the retention period
+	go pruneRecordings()
 
 	// Resolve the TCP address to bind to
 	tcpAddr, err := net.ResolveTCPAddr("tcp", flags.bindAddr)
@@ -117,6 +224,25 @@ func run() {
 	// Add bindAddr to config
 	config.bindAddr = tcpAddr
 
-	// Start the server listener
-	StartListener()
+	// Serve the admin API if requested
+	if flags.admin != "" {
+		adminAddr, err := adminAddress(flags.admin, flags.adminToken)
+		if err != nil {
+			log.Fatalln("Unable to serve the admin API: ", err.Error())
+		}
+		go serveAdmin(ctx, adminAddr, flags.adminToken)
+	}
+
+	// Reload the configuration whenever the server is sent SIGHUP
+	go reloadOnSignal(ctx)
+
+	// Start the server listener, which returns once every session has ended
+	StartListener(ctx)
+
+	// Wait for the consumers to finish writing and finalise their recordings
+	drainConsumers()
+	if err := sequences.save(); err != nil {
+		log.WithField("Path", flags.state).Warnln("Unable to save the stream sequence numbers: ", err.Error())
+	}
+	log.Infoln("Server stopped")
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/mp4"
+)
+
+// Timing sources for recordings
+const (
+	ArrivalTiming = "arrival" // ArrivalTiming times frames by when they arrived at the server
+	DVRTiming     = "dvr"     // DVRTiming times frames using the timestamps sent by the DVR, assumed to be milliseconds
+)
+
+// defaultSampleDuration is used when a frame duration cannot be calculated, which is one frame at 30fps
+const defaultSampleDuration = mp4.Timescale / 30
+
+// mp4Consumer saves the stream of each channel to fragmented MP4 files which are split in the same way as
+// diskConsumer
+type mp4Consumer struct {
+	options ConsumerOptions         // options configure the consumer
+	tracks  map[streamKey]*mp4Track // tracks are the open recordings of each stream
+}
+
+// mp4Track is the recording of a single channel to fragmented MP4
+type mp4Track struct {
+	seg          *segment    // seg is the open segment file
+	writer       *mp4.Writer // writer muxes samples into the segment file
+	sps          []byte      // sps is the SPS the init segment was written with
+	pending      *Data       // pending is the last frame, which is written once its duration is known
+	lastDuration uint32      // lastDuration is the duration of the last written sample
+}
+
+func init() {
+	RegisterConsumer("mp4", newMP4Consumer)
+}
+
+// newMP4Consumer creates an mp4Consumer saving to the directory in options
+func newMP4Consumer(options ConsumerOptions) (Consumer, error) {
+	if err := checkDirectory(options.Destination); err != nil {
+		return nil, err
+	}
+	if err := checkTiming(options.Timing); err != nil {
+		return nil, err
+	}
+	return &mp4Consumer{options: options, tracks: make(map[streamKey]*mp4Track)}, nil
+}
+
+// Start does nothing as recordings are opened when the first keyframe of each channel arrives
+func (c *mp4Consumer) Start() error {
+	return nil
+}
+
+// Write adds a frame to the recording of its channel
+func (c *mp4Consumer) Write(data Data) error {
+	// Only video frames are saved
+	if !data.frame.IsVideo() {
+		return nil
+	}
+	t := c.tracks[data.stream]
+
+	// Write the pending frame now that its duration is known
+	if t != nil && t.pending != nil {
+		err := t.writeSample(*t.pending, sampleDuration(c.options.Timing, *t.pending, data))
+		t.pending = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	// Start a new segment on a keyframe once the segment duration has passed or the stream parameters change
+	var seg *segment
+	if t != nil {
+		seg = t.seg
+	}
+	paramsChanged := t != nil && data.keyframe && !bytes.Equal(t.sps, data.params.SPSData)
+	if shouldRotate(seg, data, c.options.SegmentDuration) || paramsChanged && data.params.Ready() {
+		if t != nil {
+			t.close()
+			delete(c.tracks, data.stream)
+		}
+		var err error
+		if t, err = newMP4Track(c.options.Destination, data); err != nil {
+			return err
+		}
+		c.tracks[data.stream] = t
+	}
+
+	// Drop frames until the first keyframe so that the segment is playable from its start
+	if t == nil {
+		return nil
+	}
+	t.pending = &data
+	return nil
+}
+
+// Close finalises the open recordings
+func (c *mp4Consumer) Close() error {
+	for stream, t := range c.tracks {
+		t.close()
+		delete(c.tracks, stream)
+	}
+	return nil
+}
+
+// sampleDuration calculates the duration of a frame from the timing of the frame which follows it
+func sampleDuration(timing string, frame Data, next Data) uint32 {
+	var d int64
+	if timing == DVRTiming {
+		// Subtract as unsigned integers so that the timestamp can wrap around
+		d = int64(next.frame.Timestamp-frame.frame.Timestamp) * mp4.Timescale / 1000
+	} else {
+		d = int64(next.received.Sub(frame.received)) * mp4.Timescale / int64(time.Second)
+	}
+
+	// Fall back to a default for frames which arrive together or out of order
+	if d <= 0 || d > 10*mp4.Timescale {
+		return defaultSampleDuration
+	}
+	return uint32(d)
+}
+
+// newMP4Track opens a new segment and writes the init segment for the stream
+func newMP4Track(dir string, data Data) (*mp4Track, error) {
+	seg, err := openSegment(dir, data.stream, ".mp4", data.received)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := mp4.NewWriter(seg.file, data.params)
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+	return &mp4Track{seg: seg, writer: writer, sps: data.params.SPSData, lastDuration: defaultSampleDuration}, nil
+}
+
+// writeSample adds a frame to the recording
+func (t *mp4Track) writeSample(data Data, duration uint32) error {
+	t.lastDuration = duration
+	return t.writer.WriteSample(mp4.NewSample(data.units, duration))
+}
+
+// close writes the pending frame, finalises the recording and closes the segment
+func (t *mp4Track) close() {
+	// The duration of the last frame is unknown, so assume it is the same as the one before it
+	if t.pending != nil {
+		if err := t.writeSample(*t.pending, t.lastDuration); err != nil {
+			log.WithField("Path", t.seg.path).Warnln("Error when writing to file: ", err.Error())
+		}
+		t.pending = nil
+	}
+	if err := t.writer.Close(); err != nil {
+		log.WithField("Path", t.seg.path).Warnln("Error when finalising MP4: ", err.Error())
+	}
+	t.seg.close()
+}
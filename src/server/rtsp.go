@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/rtsp"
+)
+
+// rtspConsumer serves the stream of each channel over RTSP, at rtsp://host/<site>/channel<number>
+type rtspConsumer struct {
+	options  ConsumerOptions            // options configure the consumer
+	server   *rtsp.Server               // server serves the streams to RTSP clients
+	channels map[streamKey]*rtspChannel // channels are the RTSP streams by site and channel
+}
+
+// rtspChannel is the RTSP stream of a single channel
+type rtspChannel struct {
+	stream *rtsp.Stream // stream sends frames to the playing sessions
+	pts    uint64       // pts is the presentation time of the last frame in 90kHz ticks
+	last   *Data        // last is the last frame, used to time the next one
+}
+
+func init() {
+	RegisterConsumer("rtsp", newRTSPConsumer)
+}
+
+// newRTSPConsumer creates an rtspConsumer listening on the address in options
+func newRTSPConsumer(options ConsumerOptions) (Consumer, error) {
+	if err := checkTiming(options.Timing); err != nil {
+		return nil, err
+	}
+	return &rtspConsumer{options: options, server: rtsp.NewServer(), channels: make(map[streamKey]*rtspChannel)}, nil
+}
+
+// Start starts the RTSP server
+func (c *rtspConsumer) Start() error {
+	l, err := net.Listen("tcp", c.options.Destination)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		log.WithField("Address", c.options.Destination).Infoln("RTSP server listening")
+		if err := c.server.Serve(l); err != rtsp.ErrServerClosed {
+			log.Warnln("RTSP server stopped: ", err.Error())
+		}
+	}()
+	return nil
+}
+
+// Write sends a frame to the RTSP clients playing its channel
+func (c *rtspConsumer) Write(data Data) error {
+	// Only video frames are streamed
+	if !data.frame.IsVideo() {
+		return nil
+	}
+	ch := c.channels[data.stream]
+	if ch == nil {
+		name := data.stream.site + "/channel" + strconv.Itoa(data.stream.channel)
+		ch = &rtspChannel{stream: c.server.Stream(name)}
+		c.channels[data.stream] = ch
+		log.WithField("stream", data.stream).Infoln("RTSP stream available at /" + name)
+	}
+
+	// Advance the clock by the duration of the last frame
+	if ch.last != nil {
+		ch.pts += uint64(sampleDuration(c.options.Timing, *ch.last, data))
+	}
+	ch.last = &data
+
+	// RTP timestamps wrap around, so only the low 32 bits are sent
+	ch.stream.WriteAccessUnit(data.units, data.params, uint32(ch.pts))
+	return nil
+}
+
+// Close stops the RTSP server and disconnects its clients
+func (c *rtspConsumer) Close() error {
+	return c.server.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/h264"
+)
+
+const (
+	defaultSegmentDuration = time.Hour             // defaultSegmentDuration is the segment duration if none is set
+	segmentTimeFormat      = "2006-01-02-15-04-05" // segmentTimeFormat is the start time prefixing segment file names
+	retentionInterval      = time.Minute           // retentionInterval is how often expired recordings are removed
+)
+
+// segment is an open recording file for a single stream
+type segment struct {
+	file    *os.File  // file is the open recording file
+	path    string    // path is the file path of the recording
+	started time.Time // started is the time the first frame written was received
+}
+
+// openSegment creates a new recording file for the stream in the folder of its site in dir, starting with a frame
+// received at started
+func openSegment(dir string, stream streamKey, ext string, started time.Time) (*segment, error) {
+	// Keep the recordings of each site apart as sites number their channels independently
+	dir = dir + "/" + stream.site
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Generate file path from the start time, to the second so that short segments do not collide
+	path := dir + "/" + started.Format(segmentTimeFormat+"-") + strconv.Itoa(stream.channel) + ext
+
+	// Open file path
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithField("Path", path).Infoln("Started recording segment")
+	return &segment{file: f, path: path, started: started}, nil
+}
+
+// write writes data to the segment file
+func (s *segment) write(data []byte) error {
+	_, err := s.file.Write(data)
+	return err
+}
+
+// close flushes the segment file to disk and closes it
+func (s *segment) close() {
+	if err := s.file.Sync(); err != nil {
+		log.WithField("Path", s.path).Warnln("Error when flushing file: ", err.Error())
+	}
+	if err := s.file.Close(); err != nil {
+		log.WithField("Path", s.path).Warnln("Error when closing file: ", err.Error())
+	}
+}
+
+// shouldRotate reports whether data should start a new segment, which is only possible on a keyframe once the
+// parameter sets of the stream are known
+func shouldRotate(s *segment, data Data, duration time.Duration) bool {
+	if !data.keyframe || !data.params.Ready() {
+		return false
+	}
+	if duration <= 0 {
+		duration = defaultSegmentDuration
+	}
+	return s == nil || data.received.Sub(s.started) >= duration
+}
+
+// parameterSetsFor returns the parameter sets to write before data at the start of a segment, or nil if the frame
+// already carries its own
+func parameterSetsFor(data Data) []byte {
+	for _, u := range data.units {
+		if u.Type == h264.NALSPS {
+			return nil
+		}
+	}
+	return h264.AppendAnnexB(nil, data.params.SPSData, data.params.PPSData)
+}
+
+// pruneRecordings removes the recordings which are older than the retention period of the current settings, checking
+// again every retentionInterval
+func pruneRecordings() {
+	for {
+		if s := currentSettings(); s.retention > 0 {
+			for _, dir := range s.recordings {
+				removeExpired(dir, time.Now().Add(-s.retention))
+			}
+		}
+		time.Sleep(retentionInterval)
+	}
+}
+
+// removeExpired removes the recordings in the folder of each site in dir which were last written to before expiry.
+// Only files named like segments are removed, so that other files in dir are left alone.
+func removeExpired(dir string, expiry time.Time) {
+	sites, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.WithField("Path", dir).Warnln("Unable to list recordings: ", err.Error())
+		return
+	}
+	for _, site := range sites {
+		if !site.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(dir + "/" + site.Name())
+		if err != nil {
+			log.WithField("Path", dir+"/"+site.Name()).Warnln("Unable to list recordings: ", err.Error())
+			continue
+		}
+		for _, f := range files {
+			if !f.Mode().IsRegular() || !f.ModTime().Before(expiry) || len(f.Name()) <= len(segmentTimeFormat) {
+				continue
+			}
+			if _, err := time.Parse(segmentTimeFormat, f.Name()[:len(segmentTimeFormat)]); err != nil {
+				continue
+			}
+			path := dir + "/" + site.Name() + "/" + f.Name()
+			if err := os.Remove(path); err != nil {
+				log.WithField("Path", path).Warnln("Unable to remove expired recording: ", err.Error())
+				continue
+			}
+			log.WithField("Path", path).Infoln("Removed expired recording")
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/jsonfile"
+)
+
+// sequenceSaveInterval is how often the sequence numbers of the streams are saved while they change
+const sequenceSaveInterval = 5 * time.Second
+
+// sequenceStore holds the sequence numbers of the last frames received and written on each stream, so that frames
+// which are resent by a client after reconnecting, or after the server restarts, are only passed to the consumers
+// once. Only the frames written by every consumer are saved, as those still queued are lost if the server stops.
+type sequenceStore struct {
+	mu       sync.Mutex
+	path     string            // path is the file the written sequence numbers are saved to, or empty
+	received map[string]uint64 // received holds the last frame received on each stream, keyed by stream name
+	written  map[string]uint64 // written holds the last frame written by every consumer, keyed by stream name
+	dirty    bool              // dirty is set once a written sequence number changed since the file was saved
+}
+
+// sequences holds the sequence numbers of the streams published on the server
+var sequences = newSequenceStore("")
+
+// newSequenceStore creates an empty sequenceStore saved to the file at path, or kept in memory if path is empty
+func newSequenceStore(path string) *sequenceStore {
+	return &sequenceStore{path: path, received: make(map[string]uint64), written: make(map[string]uint64)}
+}
+
+// openSequenceStore creates a sequenceStore saved to the file at path, loading the sequence numbers saved by the
+// last run if the file exists
+func openSequenceStore(path string) (*sequenceStore, error) {
+	s := newSequenceStore(path)
+	if path == "" {
+		return s, nil
+	}
+	if err := jsonfile.Load(path, &s.written); err != nil {
+		return nil, err
+	}
+	for name, sequence := range s.written {
+		s.received[name] = sequence
+	}
+	return s, nil
+}
+
+// lastReceived returns the sequence number of the last frame received on the stream, or zero if none were received
+func (s *sequenceStore) lastReceived(key streamKey) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received[key.String()]
+}
+
+// setReceived records the sequence number of the last frame received on the stream
+func (s *sequenceStore) setReceived(key streamKey, sequence uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received[key.String()] = sequence
+}
+
+// lastWritten returns the sequence number of the last frame written by every consumer, after every frame before it,
+// or zero if none were written
+func (s *sequenceStore) lastWritten(key streamKey) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.written[key.String()]
+}
+
+// setWritten records the sequence number of the last frame written by every consumer
+func (s *sequenceStore) setWritten(key streamKey, sequence uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sequence > s.written[key.String()] {
+		s.written[key.String()] = sequence
+		s.dirty = true
+	}
+}
+
+// save writes the sequence numbers to the file if they changed since it was last written
+func (s *sequenceStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+	if err := jsonfile.Save(s.path, s.written); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// saveSequences saves the sequence numbers of the streams periodically until the context is cancelled. The server
+// saves them once more after its consumers are drained.
+func saveSequences(ctx context.Context) {
+	ticker := time.NewTicker(sequenceSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := sequences.save(); err != nil {
+				log.WithField("Path", sequences.path).Warnln("Unable to save the stream sequence numbers: ", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,30 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"io"
 	"net"
+	"sync"
+	"time"
 	"bufio"
-	"strconv"
-	"bytes"
 	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/dvr"
+	"github.com/kz/swanntools/src/h264"
+	"github.com/kz/swanntools/src/pki"
+	"github.com/kz/swanntools/src/registry"
+	"github.com/kz/swanntools/src/tunnel"
 )
 
-const (
-	SuccessfulAuthString = "200"
-	FailedAuthString     = "403"
-	InvalidChannelString = "400"
-	ChannelInUseString   = "409"
-)
-
-func StartListener() {
-	// Load server key pair
-	cert, err := tls.LoadX509KeyPair(config.certs+"/server.pem", config.certs+"/server.key")
+// StartListener accepts sessions from clients until the context is cancelled, then closes every session and waits
+// for them to end
+func StartListener(ctx context.Context) {
+	// Load the server certificate and the CA which signs client certificates
+	tlsConfig, err := newTLSConfig(config.certs, config.ca, config.authority != nil)
 	if err != nil {
-		log.Fatalln("Unable to load server key pair: ", err.Error())
+		log.Fatalln("Unable to set up TLS: ", err.Error())
 	}
-
-	// Add certificate to TLS config
-	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	log.WithField("fingerprint", pki.Fingerprint(tlsConfig.Certificates[0].Certificate[0])).Infoln("Loaded server certificate")
 
 	// Listen on the bindAddr for stream bytes
 	listener, err := tls.Listen("tcp", config.bindAddr.String(), tlsConfig)
@@ -34,122 +35,390 @@ func StartListener() {
 
 	log.Infof("Server ready and listening on: %s", config.bindAddr)
 
-	for {
-		// TODO: Use Mutexes to protect channels from simultaneous writes
+	// Stop accepting connections once the server shuts down
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 
+	var sessions sync.WaitGroup
+	for {
 		// Accept a new connection
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			log.Warnln("An error occured when accepting a connection: ", err.Error())
-			// Close the connection on error
-			conn.Close()
 			// Listen for more connections
 			continue
 		}
 
 		// Handle the connection
-		go handleConn(conn)
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			handleConn(ctx, conn)
+		}()
 	}
+
+	// Wait for every session to end
+	sessions.Wait()
+}
+
+// Status strings of the legacy ASCII handshake, which clients from before the tunnel protocol understand
+const (
+	legacyInvalidRequest = "400" // legacyInvalidRequest rejects a legacy client with the right passphrase
+	legacyUnauthorized   = "403" // legacyUnauthorized rejects a legacy client with the wrong passphrase
+)
+
+// stream is a channel opened on a session
+type stream struct {
+	key    streamKey           // key identifies the stream across sessions
+	pub    *publication        // pub is the claim of the session on the stream
+	params *h264.ParameterSets // params are the parameter sets of the channel
+	last   uint64              // last is the sequence number of the last frame received on the stream
+	seqs   *sequenceStore      // seqs records the last frames received and written on the stream across sessions
+	id     uint16              // id is the ID of the stream on the session
+	acks   *acker              // acks acknowledges frames once they are written, or nil if the session has no CapAck
 }
 
-func handleConn(conn net.Conn) {
-	var isAuthenticated bool = false // isAuthenticated stores whether the client is authenticated
-	var channel int                  // channel stores the channel the client is sending
-	var response string              // response stores the response code to send to the client
+// handleConn handles a session from a client, which carries the streams of several channels, until the session ends
+// or the context is cancelled
+func handleConn(ctx context.Context, conn net.Conn) {
+	source := conn.RemoteAddr().String()
+	logger := log.WithField("source", source)
 
-	defer func(channel *int) {
-		// Close the connection upon connection end
+	// Close the connection once the server shuts down, which ends the session
+	ended := make(chan bool)
+	defer close(ended)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-ended:
+		}
+	}()
+
+	// Complete the TLS handshake so that clients with invalid certificates are reported as such. The deadline also
+	// covers the greeting or enrollment which follows, so that clients which never send one are dropped.
+	tlsConn := conn.(*tls.Conn)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		logger.Warnln("Rejected client during TLS handshake: ", err.Error())
 		conn.Close()
-		// Remove channel from channelsInUse if appropriate
-		if channel != nil {
-			if pos, isPresent := intPositionInSlice(channel, &channelsInUse); isPresent {
-				channelsInUse = append(channelsInUse[:pos], channelsInUse[pos+1:]...)
-			}
+		return
+	}
+
+	// Read messages through a buffer as frames arrive in many small TLS records
+	br := bufio.NewReader(conn)
+	tc := tunnel.NewConn(struct {
+		io.Reader
+		io.Writer
+	}{br, conn})
+
+	// Answer clients which still use the ASCII handshake with a status they understand, as they cannot read replies
+	if legacyHandshake(br) {
+		code := legacyReply(br)
+		logger.WithField("code", code).Warnln("Rejected client using the legacy handshake, which needs to be upgraded")
+		if _, err := conn.Write([]byte(code)); err != nil {
+			logger.Warnln("Unable to write response to client: ", err.Error())
 		}
-	}(&channel)
+		conn.Close()
+		return
+	}
 
-	// Read the authentication data provided by the client
-	authData := bufio.NewReader(conn)
+	// Clients without a certificate can only enroll for one
+	peerCerts := tlsConn.ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		enroll(tc, logger)
+		conn.Close()
+		return
+	}
+	logger = logger.WithField("cert", peerCerts[0].Subject.CommonName)
 
-	// Attempt authentication
-	isAuthenticated, channel, response = parseAuthMessage(authData)
+	// Streams opened on the session, keyed by stream ID
+	streams := make(map[uint16]*stream)
 
-	log.WithFields(log.Fields{"source": conn.RemoteAddr().String(), "channel": channel, "code": response, }).
-		Infof("Auth status: %v\n", isAuthenticated)
+	defer func() {
+		// Close the connection upon connection end
+		conn.Close()
+		// Release the streams of the session so that they can be published again
+		for _, st := range streams {
+			published.release(st.pub)
+		}
+	}()
 
-	// Send the response to the client
-	_, err := conn.Write([]byte(response))
+	// Agree on a version and authenticate the session before accepting any streams
+	hello, reply, client := greet(tc, peerCerts[0].Subject.CommonName)
+	logger = logger.WithField("client", hello.ClientID)
+	logger.WithFields(log.Fields{"code": reply.Status, "version": reply.Version}).
+		Infof("Auth status: %v", reply.Status == tunnel.StatusOK)
+	msg, err := reply.Message()
+	if err == nil {
+		err = tc.Send(msg)
+	}
 	if err != nil {
-		log.Warnln("Unable to write response to client: ", err.Error())
+		logger.Warnln("Unable to write response to client: ", err.Error())
+		return
 	}
-
-	// Cease execution if authentication failed
-	if !isAuthenticated {
+	if reply.Status != tunnel.StatusOK {
 		return
 	}
+	// Streams are kept alive by their frames, so the session has no deadline once it is authenticated
+	tlsConn.SetDeadline(time.Time{})
+	p := &publisher{client: hello.ClientID, source: source, conn: conn}
 
-	// Append the channel to slice of channels in use
-	if intInSlice(&channel, &channelsInUse) {
-		channelsInUse = append(channelsInUse, channel)
+	// Acknowledge frames once every consumer has written them, ending the session if the client cannot be reached
+	var acks *acker
+	if reply.Capabilities.Has(tunnel.CapAck) {
+		acks = newAcker()
+		go func() {
+			if err := acks.run(tc, ended); err != nil {
+				logger.Warnln("Unable to write acknowledgement to client: ", err.Error())
+				conn.Close()
+			}
+		}()
 	}
 
-	// Get the camera stream
 	for {
-		// Create a byte array to store data
-		data := make([]byte, socketBufferSize)
-
-		// Read the data from the connection
-		n, err := conn.Read(data)
+		// Read a whole message from the session
+		msg, err := tc.Receive()
 		if err != nil {
-			log.WithFields(log.Fields{
-				"source": conn.RemoteAddr().String(), "channel": channel,
-			}).Warnf("An error occurred while reading stream: %s", err.Error())
-			break
+			if ctx.Err() != nil {
+				logger.Infoln("Closed session as the server is shutting down")
+				return
+			}
+			logger.Warnf("An error occurred while reading session: %s", err.Error())
+			return
 		}
 
-		// Send data to each consumer
-		for _, consumer := range config.consumers {
-			consumer.Receiver <- Data{channel, data[:n]}
+		switch msg.Type {
+		// Claim the channel of a new stream
+		case tunnel.MsgOpen:
+			st, status := openStream(streams, msg, reply.Capabilities, client, p, hello.ClientID)
+			logger.WithFields(log.Fields{"stream": msg.Stream, "site": st.key.site, "channel": st.key.channel,
+				"code": status}).
+				Infoln("Stream open requested")
+			if status == tunnel.StatusOK {
+				st.id, st.acks = msg.Stream, acks
+				streams[msg.Stream] = st
+			}
+			if err := tc.Send(tunnel.StatusMessage(tunnel.MsgOpenReply, msg.Stream, status)); err != nil {
+				logger.Warnln("Unable to write response to client: ", err.Error())
+				return
+			}
+
+			// Tell the client where to resume the stream from, which is after the last frame every consumer wrote
+			if status == tunnel.StatusOK && acks != nil {
+				if err := tc.Send(tunnel.AckMessage(msg.Stream, st.seqs.lastWritten(st.key))); err != nil {
+					logger.Warnln("Unable to write response to client: ", err.Error())
+					return
+				}
+			}
+
+		// Pass frames of open streams to the consumers
+		case tunnel.MsgData:
+			st := streams[msg.Stream]
+			if st == nil {
+				logger.WithField("stream", msg.Stream).Warnln("Dropping frame for a stream which is not open")
+				continue
+			}
+			d, err := msg.Data(reply.Capabilities)
+			if err != nil {
+				logger.WithField("channel", st.key.channel).Warnln("Dropping invalid message: ", err.Error())
+				continue
+			}
+			st.pub.received()
+
+			// Drop frames which were received before the client reconnected, acknowledging those which have been
+			// written again. Those still being written are acknowledged along with the next frame written.
+			if st.acks != nil && !st.accept(d.Sequence) {
+				if err := tc.Send(tunnel.AckMessage(msg.Stream, st.seqs.lastWritten(st.key))); err != nil {
+					logger.Warnln("Unable to write acknowledgement to client: ", err.Error())
+					return
+				}
+				continue
+			}
+
+			dispatch(st, d, logger)
+
+		// Release the channel of a closed stream
+		case tunnel.MsgClose:
+			if st := streams[msg.Stream]; st != nil {
+				logger.WithField("channel", st.key.channel).Infoln("Stream closed by client")
+				published.release(st.pub)
+				delete(streams, msg.Stream)
+			}
+
+		default:
+			logger.WithField("type", msg.Type).Warnln("Ignoring unknown message")
 		}
 	}
 }
 
-func parseAuthMessage(r *bufio.Reader) (isAuthenticated bool, channelNum int, responseCode string) {
-	var nilInt int
+// dispatch queues a frame received on the stream for each consumer, dropping it if it is invalid. The frame is
+// acknowledged once every consumer has written it, or straight away if it is dropped.
+func dispatch(st *stream, d *tunnel.Data, logger *log.Entry) {
+	frame := &dvr.Frame{}
+	if err := frame.UnmarshalBinary(d.Frame); err != nil {
+		logger.WithField("channel", st.key.channel).Warnln("Dropping invalid frame: ", err.Error())
+		if st.acks != nil {
+			st.acks.track(st.id, st, d.Sequence, 0)
+		}
+		return
+	}
+
+	// Time the frame by when the client captured it, so that frames sent late keep their timing
+	captured := d.Captured
+	if captured.IsZero() {
+		captured = time.Now()
+	}
+
+	// Tag the frame with its NAL units and parameter sets
+	data := newData(st.key, frame, st.params, captured)
+
+	// Queue data for each consumer
+	consumers := currentSettings().consumers
+	if st.acks != nil {
+		data.delivery = st.acks.track(st.id, st, d.Sequence, len(consumers))
+	}
+	for _, consumer := range consumers {
+		consumer.send(data)
+	}
+}
 
-	// Parse channel and password
-	msg, err := r.ReadString('\n')
+// greet reads the hello of a session, negotiates the protocol version and authenticates the client by its key and
+// the common name of its certificate, returning the client if it is accepted
+func greet(tc *tunnel.Conn, cert string) (*tunnel.Hello, *tunnel.HelloReply, *registry.Client) {
+	hello := &tunnel.Hello{}
+	msg, err := tc.Receive()
 	if err != nil {
 		log.Warnln("Unable to retrieve authentication message: ", err.Error())
-		return false, nilInt, FailedAuthString
+		return hello, &tunnel.HelloReply{Status: tunnel.StatusUnauthorized, Version: tunnel.Version}, nil
+	}
+	if msg.Type != tunnel.MsgHello || hello.UnmarshalBinary(msg.Payload) != nil {
+		return hello, &tunnel.HelloReply{Status: tunnel.StatusUnauthorized, Version: tunnel.Version,
+			Reason: "malformed hello"}, nil
+	}
+
+	// Reject clients whose version cannot be spoken before looking at their credentials
+	reply := tunnel.Negotiate(hello)
+	if reply.Status != tunnel.StatusOK {
+		return hello, reply, nil
+	}
+	client, err := authenticate(hello, cert)
+	if err != nil {
+		log.WithFields(log.Fields{"client": hello.ClientID, "cert": cert}).Warnln("Rejected client: ", err.Error())
+		reason := "invalid credentials"
+		if err == registry.ErrRevoked {
+			reason = "the client has been revoked"
+		}
+		return hello, &tunnel.HelloReply{Status: tunnel.StatusUnauthorized, Version: reply.Version,
+			Reason: reason}, nil
+	}
+
+	// Frames are only acknowledged if no consumer drops them when it falls behind, as acknowledged frames are not
+	// resent. Sessions which started before a reload changed the queue policy stop being acknowledged once a frame is
+	// dropped, and the client resends the frames on its next session.
+	if !currentSettings().blocking() {
+		reply.Capabilities &^= tunnel.CapAck
 	}
-	channelInput := string(msg[0])
-	// Ensure that line break is removed
-	passwordInput := string(bytes.Trim([]byte(msg[1:]), "\x0a"))
+	return hello, reply, client
+}
+
+// legacyHandshake reports whether the client opened the session with the ASCII handshake used before the tunnel
+// protocol, which is the channel number followed by the passphrase and a line break. Messages start with their type,
+// which is never an ASCII digit.
+func legacyHandshake(r *bufio.Reader) bool {
+	b, err := r.Peek(1)
+	return err == nil && b[0] >= '0' && b[0] <= '9'
+}
+
+// legacyReply reads the ASCII handshake of a legacy client and returns the status string it understands, which is
+// 403 if its passphrase is wrong, or 400 as no channel can be streamed without the tunnel protocol
+func legacyReply(r *bufio.Reader) string {
+	// Handshakes longer than the buffer are not read any further
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return legacyUnauthorized
+	}
+	s := currentSettings()
+	key := line[1 : len(line)-1]
+	if s.clients != nil || subtle.ConstantTimeCompare(key, []byte(s.key)) != 1 {
+		return legacyUnauthorized
+	}
+	return legacyInvalidRequest
+}
 
-	// Validate length, accounting for the line break
-	if len(msg) < 3 {
-		log.Warnln("Authentication failed due to invalid authentication message length")
-		return false, nilInt, FailedAuthString
+// authenticate checks the credentials of the client against the registry, or against the shared key if there is
+// no registry
+func authenticate(hello *tunnel.Hello, cert string) (*registry.Client, error) {
+	s := currentSettings()
+	if s.clients != nil {
+		return s.clients.Authenticate(hello.ClientID, cert, hello.Key)
 	}
+	if subtle.ConstantTimeCompare([]byte(hello.Key), []byte(s.key)) != 1 {
+		return nil, registry.ErrInvalidCredentials
+	}
+
+	// Clients knowing the shared key may publish any stream
+	return &registry.Client{Name: hello.ClientID, Publish: []string{registry.Wildcard + "/" + registry.Wildcard}},
+		nil
+}
 
-	// Validate channel
-	intChannel, err := strconv.Atoi(channelInput)
-	if len(channelsInUse) >= maxChannels {
-		log.Warnln("You cannot have greater than %d streams", maxChannels)
-		return false, nilInt, InvalidChannelString
-	} else if err != nil || intChannel > maxChannels {
-		log.Warnln("All channels need to be a number between 1 and %d", maxChannels)
-		return false, nilInt, InvalidChannelString
-	} else if intInSlice(&intChannel, &channelsInUse) {
-		log.Warnln("The channel %d is currently receiving a stream", intChannel)
-		return false, nilInt, ChannelInUseString
+// openStream validates a request to open a stream and claims it for the session, returning the stream if it was
+// opened. Streams belong to the site named in the request, which defaults to the ID of the client.
+func openStream(streams map[uint16]*stream, msg *tunnel.Message, caps tunnel.Capability, client *registry.Client,
+	p *publisher, clientID string) (*stream, uint16) {
+	open, err := msg.Open(caps)
+	if err != nil {
+		log.Warnln("Invalid request to open a stream: ", err.Error())
+		return &stream{key: streamKey{site: clientID}}, tunnel.StatusInvalidChannel
+	}
+	site, channel := open.Site, open.Channel
+	if site == "" {
+		site = clientID
+	}
+	st := &stream{key: streamKey{site: site, channel: channel}, params: &h264.ParameterSets{}}
+	if channel < 1 || channel > dvr.MaxChannels {
+		log.Warnf("All channels need to be a number between 1 and %d", dvr.MaxChannels)
+		return st, tunnel.StatusInvalidChannel
+	}
+	if !tunnel.ValidSite(site) {
+		log.Warnf("The site %q needs to be made of letters, digits, dots, dashes and underscores", site)
+		return st, tunnel.StatusInvalidChannel
+	}
+	if !client.CanPublish(site, channel) {
+		log.Warnf("The client %s is not allowed to publish %s", client.Name, st.key)
+		return st, tunnel.StatusUnauthorized
+	}
+	if streams[msg.Stream] != nil {
+		log.Warnf("The stream %d is already open", msg.Stream)
+		return st, tunnel.StatusInvalidChannel
 	}
 
-	// Validate password
-	if passwordInput != config.key {
-		return false, nilInt, FailedAuthString
+	// Claim the stream unless another session is publishing it
+	s := currentSettings()
+	pub, status := published.claim(st.key, p, s.takeover, s.staleTimeout)
+	if status != tunnel.StatusOK {
+		log.Warnf("The stream %s is already being published", st.key)
+		return st, status
 	}
+	st.pub = pub
+	st.seqs = sequences
+	st.last = sequences.lastReceived(st.key)
+	return st, tunnel.StatusOK
+}
 
-	return true, intChannel, SuccessfulAuthString
+// accept reports whether the frame with the sequence number is new to the stream, recording it as the last frame
+// received if it is. Frames which were already received, such as those resent after the client reconnected, are
+// not accepted.
+func (st *stream) accept(sequence uint64) bool {
+	if sequence <= st.last {
+		return false
+	}
+	st.last = sequence
+	st.seqs.setReceived(st.key, sequence)
+	return true
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/kz/swanntools/src/registry"
+	"github.com/kz/swanntools/src/tunnel"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResentFramesAreAcceptedOnce(t *testing.T) {
+	key := streamKey{site: "resent", channel: 1}
+	seqs := newSequenceStore("")
+	st := &stream{key: key, last: seqs.lastReceived(key), seqs: seqs}
+	for _, sequence := range []uint64{1, 2} {
+		if !st.accept(sequence) {
+			t.Errorf("Expected frame %d to be accepted", sequence)
+		}
+	}
+	if st.accept(2) || st.accept(1) {
+		t.Error("Expected frames which were already received to be dropped")
+	}
+
+	// The stream is opened again by the next session of the client, which resends the frames it has not seen
+	// acknowledged
+	st = &stream{key: key, last: seqs.lastReceived(key), seqs: seqs}
+	if st.accept(2) {
+		t.Error("Expected a frame received on the last session to be dropped")
+	}
+	if !st.accept(3) {
+		t.Error("Expected the next frame to be accepted")
+	}
+}
+
+func TestSequencesAreKeptAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	key := streamKey{site: "restarted", channel: 2}
+	seqs, err := openSequenceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs.setWritten(key, 42)
+	if err := seqs.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next run drops the frames received before the restart
+	seqs, err = openSequenceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &stream{key: key, last: seqs.lastReceived(key), seqs: seqs}
+	if st.accept(42) {
+		t.Error("Expected a frame received before the restart to be dropped")
+	}
+	if !st.accept(43) {
+		t.Error("Expected the next frame to be accepted")
+	}
+}
+
+func TestFramesAreAcknowledgedOnceWritten(t *testing.T) {
+	key := streamKey{site: "acked", channel: 1}
+	seqs := newSequenceStore("")
+	st := &stream{key: key, seqs: seqs}
+	acks := newAcker()
+
+	// Frames are acknowledged in order once both consumers have written them
+	first := acks.track(1, st, 1, 2)
+	second := acks.track(1, st, 2, 2)
+	second.written()
+	second.written()
+	first.written()
+	if m := acks.acks(); len(m) != 0 {
+		t.Errorf("Expected no acknowledgement before every consumer wrote the first frame, got %v", m)
+	}
+	first.written()
+	m := acks.acks()
+	if len(m) != 1 {
+		t.Fatalf("Expected one acknowledgement, got %v", m)
+	}
+	if sequence, err := m[0].Sequence(); err != nil || m[0].Stream != 1 || sequence != 2 {
+		t.Errorf("Expected frame 2 of stream 1 to be acknowledged, got stream %d frame %d", m[0].Stream, sequence)
+	}
+	if seqs.lastWritten(key) != 2 {
+		t.Errorf("Expected frame 2 to be recorded as written, got %d", seqs.lastWritten(key))
+	}
+
+	// A frame which is never written holds back the frames after it
+	acks.track(1, st, 3, 1)
+	acks.track(1, st, 4, 0)
+	if m := acks.acks(); len(m) != 0 {
+		t.Errorf("Expected no acknowledgement while frame 3 is not written, got %v", m)
+	}
+}
+
+func TestLegacyHandshakeIsAnswered(t *testing.T) {
+	defer setSettings(currentSettings())
+	setSettings(&Settings{key: "secret"})
+
+	for handshake, expected := range map[string]string{
+		"1secret\n": legacyInvalidRequest, "4wrong\n": legacyUnauthorized, "1secret": legacyUnauthorized,
+	} {
+		r := bufio.NewReader(strings.NewReader(handshake))
+		if !legacyHandshake(r) {
+			t.Errorf("Expected %q to be a legacy handshake", handshake)
+			continue
+		}
+		if code := legacyReply(r); code != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, handshake, code)
+		}
+	}
+
+	// Clients authenticated by the registry have no shared passphrase
+	setSettings(&Settings{key: "secret", clients: registry.Open("clients.json")})
+	if code := legacyReply(bufio.NewReader(strings.NewReader("1secret\n"))); code != legacyUnauthorized {
+		t.Errorf("Expected %s with a client registry, got %s", legacyUnauthorized, code)
+	}
+
+	// Messages of the tunnel protocol start with their type
+	msg, err := (&tunnel.Hello{Version: tunnel.Version, ClientID: "home", Key: "secret"}).Message()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := msg.MarshalBinary()
+	if legacyHandshake(bufio.NewReader(bytes.NewReader(data))) {
+		t.Error("Expected a hello message not to be a legacy handshake")
+	}
+}
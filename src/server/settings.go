@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/queue"
+	"github.com/kz/swanntools/src/registry"
+)
+
+// Settings are the settings which can change while the server is running. Each reload replaces them as a whole, so
+// that a session always sees a consistent set.
+type Settings struct {
+	key          string             // key is the passphrase to authenticate the client with when there is no registry
+	clients      *registry.Registry // clients are the clients allowed to connect and publish streams, if registered
+	takeover     string             // takeover decides whether a session can take over a stream published by another
+	staleTimeout time.Duration      // staleTimeout is how long a stream can go without frames before it is stale
+	consumers    []*runner          // consumers are the runners of each consumer which performs actions on the stream
+	recordings   []string           // recordings are the folders recordings are saved to
+	retention    time.Duration      // retention is the age after which recordings are removed, or zero to keep them
+}
+
+// consumerSpec is a consumer to run, which keeps running across reloads as long as its options are unchanged
+type consumerSpec struct {
+	name    string          // name is the registered name of the consumer
+	options ConsumerOptions // options configure the consumer
+}
+
+// current holds the settings in use
+var current struct {
+	sync.RWMutex
+	settings *Settings
+}
+
+// started holds the flags the server was started with, to tell which changes need a restart
+var started Flags
+
+// reloadMu prevents reloads from overlapping
+var reloadMu sync.Mutex
+
+// shuttingDown is set under reloadMu once the consumers are being drained, after which reloads fail
+var shuttingDown bool
+
+// currentSettings returns the settings in use
+func currentSettings() *Settings {
+	current.RLock()
+	defer current.RUnlock()
+	return current.settings
+}
+
+// setSettings replaces the settings in use
+func setSettings(s *Settings) {
+	current.Lock()
+	defer current.Unlock()
+	current.settings = s
+}
+
+// newSettings validates the flags and returns the settings and consumers they describe, without starting anything
+func newSettings() (*Settings, []consumerSpec, error) {
+	if flags.key == "" && flags.clients == "" {
+		return nil, nil, errors.New("either a key or a client registry is required")
+	}
+	s := &Settings{key: flags.key}
+
+	// Authenticate each client against the registry instead of the key if there is one
+	if flags.clients != "" {
+		s.clients = registry.Open(flags.clients)
+		clients, err := s.clients.Clients()
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load the client registry: %s", err.Error())
+		}
+		log.WithField("Path", flags.clients).Infof("Loaded %d registered clients", len(clients))
+	}
+
+	// Ensure that the takeover policy is known
+	if err := checkTakeover(flags.takeover); err != nil {
+		return nil, nil, err
+	}
+	s.takeover = flags.takeover
+	s.staleTimeout = flags.staleTimeout
+
+	// Ensure that the queue policy is known
+	policy, err := queue.ParsePolicy(flags.queuePolicy)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flags.retention < 0 {
+		return nil, nil, errors.New("the retention period cannot be negative")
+	}
+	s.retention = flags.retention
+
+	// Add a consumer for each output which is set
+	var consumers []consumerSpec
+	add := func(name string, options ConsumerOptions) {
+		options.QueueSize = flags.queueSize
+		options.QueuePolicy = policy
+		consumers = append(consumers, consumerSpec{name: name, options: options})
+	}
+	recording := ConsumerOptions{SegmentDuration: flags.segment, Timing: flags.timing}
+	for _, output := range []struct{ name, dir string }{
+		{"disk", flags.saveDisk}, {"mp4", flags.saveMP4}, {"ts", flags.saveTS},
+	} {
+		if output.dir != "" {
+			add(output.name, recording.withDestination(output.dir))
+			s.recordings = append(s.recordings, output.dir)
+		}
+	}
+	if flags.live != "" {
+		add("live", ConsumerOptions{
+			Destination:     flags.live,
+			SegmentDuration: flags.liveSegment,
+			Timing:          flags.timing,
+			Format:          flags.liveFormat,
+			Window:          flags.liveWindow,
+		})
+	}
+	if flags.rtsp != "" {
+		add("rtsp", ConsumerOptions{Destination: flags.rtsp, Timing: flags.timing})
+	}
+	return s, consumers, nil
+}
+
+// applySettings puts the settings in use along with the consumers. Consumers which are already running with the same
+// options keep running, other running consumers are stopped once they have written the frames queued for them, and
+// new consumers are started. Consumers which cannot be created leave the settings unchanged and return an error, while
+// those which fail to start are left out of the settings, which are in use regardless, and returned as failures.
+func applySettings(s *Settings, consumers []consumerSpec) (failed []error, err error) {
+	var running []*runner
+	if previous := currentSettings(); previous != nil {
+		running = previous.consumers
+	}
+
+	// Create the consumers which are not running yet, so that invalid options are found before anything changes
+	kept := make(map[*runner]bool)
+	created := make([]Consumer, len(consumers))
+	for i, spec := range consumers {
+		if r := findRunner(running, spec); r != nil {
+			kept[r] = true
+			s.consumers = append(s.consumers, r)
+			continue
+		}
+		consumer, err := NewConsumer(spec.name, spec.options)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create the %s consumer: %s", spec.name, err.Error())
+		}
+		created[i] = consumer
+	}
+
+	// Stop sending frames to the consumers which are not kept, then wait for them to close so that their listeners
+	// can be reused by the new consumers
+	setSettings(s)
+	for _, r := range running {
+		if !kept[r] {
+			r.stop()
+			log.WithField("consumer", r.name).Infoln("Consumer removed")
+		}
+	}
+
+	// Start the new consumers, publishing the settings again once they are running
+	next := *s
+	next.consumers = append([]*runner(nil), s.consumers...)
+	for i, consumer := range created {
+		if consumer == nil {
+			continue
+		}
+		spec := consumers[i]
+		if err := consumer.Start(); err != nil {
+			log.WithField("consumer", spec.name).Warnln("Unable to start consumer: ", err.Error())
+			failed = append(failed, fmt.Errorf("unable to start the %s consumer: %s", spec.name, err.Error()))
+			continue
+		}
+		r := newRunner(spec.name, consumer, spec.options)
+		go r.run()
+		next.consumers = append(next.consumers, r)
+
+		log.WithFields(log.Fields{
+			"consumer": spec.name, "Destination": spec.options.Destination, "Queue": spec.options.QueueSize,
+			"Policy": spec.options.QueuePolicy,
+		}).Infoln("Consumer added")
+	}
+	setSettings(&next)
+	return failed, nil
+}
+
+// blocking reports whether every consumer waits for room in its queue rather than dropping frames when it falls
+// behind, so that every frame received is written
+func (s *Settings) blocking() bool {
+	for _, r := range s.consumers {
+		if r.options.QueuePolicy != queue.Block {
+			return false
+		}
+	}
+	return true
+}
+
+// findRunner returns the running consumer with the name and options of the spec, if any
+func findRunner(running []*runner, spec consumerSpec) *runner {
+	for _, r := range running {
+		if r.name == spec.name && r.options == spec.options {
+			return r
+		}
+	}
+	return nil
+}
+
+// reload reads the configuration file again and applies the settings which can change while the server is running.
+// Sessions keep streaming throughout, and changes to client credentials apply from the next handshake of each client.
+// Reloads fail once the context is cancelled, as the server is shutting down. Consumers which fail to start are left
+// out and returned as failures, while the rest of the settings are in use.
+func reload(ctx context.Context) (failed []error, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if shuttingDown || ctx.Err() != nil {
+		return nil, errors.New("the server is shutting down")
+	}
+
+	// Start again from the flags and environment variables so that settings removed from the file are reset
+	previous := flags
+	flags = commandLine
+	if err := applyConfigFile(); err != nil {
+		flags = previous
+		return nil, err
+	}
+	s, consumers, err := newSettings()
+	if err != nil {
+		flags = previous
+		return nil, err
+	}
+
+	// Settings which are only read when the server starts keep their values until it is restarted
+	if flags.bindAddr != started.bindAddr || flags.certs != started.certs || flags.ca != started.ca ||
+		flags.enroll != started.enroll || flags.admin != started.admin || flags.adminToken != started.adminToken ||
+		flags.state != started.state {
+		log.Warnln("Changes to the bind address, certificates, enrollment, admin API and state file apply after a " +
+			"restart")
+	}
+
+	failed, err = applySettings(s, consumers)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		log.WithField("Failed", len(failed)).Warnln("Configuration reloaded without the consumers which failed to start")
+		return failed, nil
+	}
+	log.Infoln("Configuration reloaded")
+	return nil, nil
+}
+
+// reloadOnSignal reloads the configuration whenever the server is sent SIGHUP
+func reloadOnSignal(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Infoln("Received SIGHUP, reloading the configuration")
+		if _, err := reload(ctx); err != nil {
+			log.Warnln("Unable to reload the configuration: ", err.Error())
+		}
+	}
+}
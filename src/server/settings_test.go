@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/kz/swanntools/src/dvr"
+	"github.com/kz/swanntools/src/queue"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConsumer records the frames written to it. Consumers with the destination "invalid" cannot be created and
+// those with the destination "unstartable" fail to start.
+type testConsumer struct {
+	mu      sync.Mutex
+	written int  // written is the number of frames written
+	closed  bool // closed is true once the consumer has been closed
+}
+
+func init() {
+	RegisterConsumer("test", func(options ConsumerOptions) (Consumer, error) {
+		if options.Destination == "invalid" {
+			return nil, os.ErrInvalid
+		}
+		if options.Destination == "unstartable" {
+			return &unstartableConsumer{}, nil
+		}
+		return &testConsumer{}, nil
+	})
+}
+
+func (c *testConsumer) Start() error {
+	return nil
+}
+
+func (c *testConsumer) Write(data Data) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written++
+	return nil
+}
+
+func (c *testConsumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// unstartableConsumer is a consumer which fails to start, such as when its address is in use
+type unstartableConsumer struct {
+	testConsumer
+}
+
+func (c *unstartableConsumer) Start() error {
+	return os.ErrExist
+}
+
+// testSpec returns the spec of a test consumer with the destination
+func testSpec(destination string) consumerSpec {
+	return consumerSpec{name: "test", options: ConsumerOptions{Destination: destination, QueueSize: 4,
+		QueuePolicy: queue.Block}}
+}
+
+// resetSettings stops the running consumers and clears the settings in use
+func resetSettings() {
+	if s := currentSettings(); s != nil {
+		for _, r := range s.consumers {
+			r.stop()
+		}
+	}
+	setSettings(nil)
+}
+
+// destinations returns the destination of each consumer in use
+func destinations() []string {
+	var list []string
+	for _, r := range currentSettings().consumers {
+		list = append(list, r.options.Destination)
+	}
+	return list
+}
+
+func TestApplySettingsKeepsUnchangedConsumers(t *testing.T) {
+	resetSettings()
+	defer resetSettings()
+	if _, err := applySettings(&Settings{}, []consumerSpec{testSpec("a"), testSpec("b")}); err != nil {
+		t.Fatal(err)
+	}
+	a, b := currentSettings().consumers[0], currentSettings().consumers[1]
+
+	// Frames queued for a removed consumer are written before it is closed
+	data := Data{stream: streamKey{site: "home", channel: 1}, frame: &dvr.Frame{Payload: []byte{0x01}}}
+	b.send(data)
+	b.send(data)
+	if _, err := applySettings(&Settings{}, []consumerSpec{testSpec("a"), testSpec("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if list := destinations(); len(list) != 2 || list[0] != "a" || list[1] != "c" {
+		t.Fatalf("Expected consumers a and c, got %v", list)
+	}
+	if findRunner(currentSettings().consumers, testSpec("a")) != a {
+		t.Error("Expected consumer a to keep running")
+	}
+	removed := b.consumer.(*testConsumer)
+	if !removed.closed || removed.written != 2 {
+		t.Errorf("Expected consumer b to write its 2 queued frames and close, wrote %d (closed %v)",
+			removed.written, removed.closed)
+	}
+	if a.consumer.(*testConsumer).closed {
+		t.Error("Expected consumer a to stay open")
+	}
+
+	// Changing the options of a consumer replaces it
+	changed := testSpec("a")
+	changed.options.QueueSize = 8
+	if findRunner(currentSettings().consumers, changed) != nil {
+		t.Error("Expected no runner to match changed options")
+	}
+}
+
+func TestApplySettingsWithFailingConsumers(t *testing.T) {
+	resetSettings()
+	defer resetSettings()
+	if _, err := applySettings(&Settings{key: "old"}, []consumerSpec{testSpec("a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A consumer which cannot be created leaves the settings unchanged
+	if _, err := applySettings(&Settings{key: "new"}, []consumerSpec{testSpec("b"), testSpec("invalid")}); err == nil {
+		t.Error("Expected an error for a consumer which cannot be created")
+	}
+	if s := currentSettings(); s.key != "old" || len(destinations()) != 1 {
+		t.Errorf("Expected the settings to be unchanged, got key %q and consumers %v", s.key, destinations())
+	}
+
+	// A consumer which fails to start is left out and reported while the rest of the settings apply
+	failed, err := applySettings(&Settings{key: "new"}, []consumerSpec{testSpec("a"), testSpec("unstartable"),
+		testSpec("c")})
+	if err != nil {
+		t.Errorf("Expected the settings to apply, got %v", err)
+	}
+	if len(failed) != 1 {
+		t.Errorf("Expected the consumer which fails to start to be reported, got %v", failed)
+	}
+	if list := destinations(); currentSettings().key != "new" || len(list) != 2 || list[0] != "a" || list[1] != "c" {
+		t.Errorf("Expected the new key with consumers a and c, got key %q and consumers %v", currentSettings().key,
+			list)
+	}
+}
+
+func TestRejectedReloadRestoresFlags(t *testing.T) {
+	resetSettings()
+	defer resetSettings()
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	appContext = cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	defer func(previous Flags) { flags, commandLine = previous, previous }(flags)
+
+	// The file is checked before the flags change
+	path := filepath.Join(dir, "server.yml")
+	commandLine = Flags{config: path, takeover: TakeoverStale, queuePolicy: string(queue.Block), timing: DVRTiming}
+	flags = commandLine
+	flags.key = "from the last file"
+	if err := ioutil.WriteFile(path, []byte("streams:\n  takeover: sometimes\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reload(context.Background()); err == nil {
+		t.Error("Expected an invalid file to be rejected")
+	}
+	if flags.key != "from the last file" {
+		t.Errorf("Expected the flags to be restored, got key %q", flags.key)
+	}
+
+	// The settings are checked once the file is applied, which removing the key from the file makes invalid
+	if err := ioutil.WriteFile(path, []byte("bind: 0.0.0.0:9000\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reload(context.Background()); err == nil {
+		t.Error("Expected settings without a key or client registry to be rejected")
+	}
+	if flags.key != "from the last file" || flags.bindAddr != "" {
+		t.Errorf("Expected the flags to be restored, got key %q and bind address %q", flags.key, flags.bindAddr)
+	}
+
+	// A valid file applies
+	if err := ioutil.WriteFile(path, []byte("key: secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if currentSettings().key != "secret" {
+		t.Errorf("Expected the key from the file, got %q", currentSettings().key)
+	}
+}
+
+func TestReloadFailsOnceConsumersAreDrained(t *testing.T) {
+	resetSettings()
+	defer func() { shuttingDown = false }()
+	if _, err := applySettings(&Settings{}, []consumerSpec{testSpec("a")}); err != nil {
+		t.Fatal(err)
+	}
+	drainConsumers()
+	defer setSettings(nil)
+
+	// Reloading neither blocks nor starts consumers again
+	result := make(chan error, 1)
+	go func() {
+		_, err := reload(context.Background())
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("Expected reloading to fail while the server shuts down")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected reloading not to block while the server shuts down")
+	}
+}
+
+func TestFramesAreOnlyAcknowledgedWhenNoConsumerDropsThem(t *testing.T) {
+	resetSettings()
+	defer resetSettings()
+	dropping := testSpec("b")
+	dropping.options.QueuePolicy = queue.DropOldest
+	if _, err := applySettings(&Settings{}, []consumerSpec{testSpec("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if !currentSettings().blocking() {
+		t.Error("Expected frames to be acknowledged when every consumer blocks")
+	}
+	if _, err := applySettings(&Settings{}, []consumerSpec{testSpec("a"), dropping}); err != nil {
+		t.Fatal(err)
+	}
+	if currentSettings().blocking() {
+		t.Error("Expected frames not to be acknowledged when a consumer drops frames")
+	}
+}
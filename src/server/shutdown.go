@@ -0,0 +1,13 @@
+package main
+
+// drainConsumers closes the queue of every consumer and waits for it to write the frames queued for it and close,
+// which finalises its recordings. It is called once every session has ended, so that no frame the server has
+// acknowledged is pushed onto a closed queue. Reloads fail from then on instead of starting consumers.
+func drainConsumers() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	shuttingDown = true
+	for _, r := range currentSettings().consumers {
+		r.stop()
+	}
+}
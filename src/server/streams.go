@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	log "github.com/Sirupsen/logrus"
+	"github.com/kz/swanntools/src/tunnel"
+)
+
+// Takeover policies deciding whether a session can claim a stream which another session is publishing
+const (
+	TakeoverNever  = "never"  // TakeoverNever rejects the new session while the stream is being published
+	TakeoverStale  = "stale"  // TakeoverStale lets the new session take over if no frame arrived within the timeout
+	TakeoverAlways = "always" // TakeoverAlways lets the newest session take over
+)
+
+// defaultStaleTimeout is how long a stream can go without frames before another session can take it over
+const defaultStaleTimeout = 15 * time.Second
+
+// streamKey identifies a stream by the site publishing it and its channel number, across sessions
+type streamKey struct {
+	site    string // site is the name of the DVR given by the client, which defaults to the ID of the client
+	channel int    // channel is the channel number
+}
+
+// String returns the name of the stream as site/channel
+func (k streamKey) String() string {
+	return k.site + "/" + strconv.Itoa(k.channel)
+}
+
+// publisher is a session publishing streams
+type publisher struct {
+	client string   // client is the ID of the client of the session
+	source string   // source is the remote address of the session
+	conn   net.Conn // conn is closed when another session takes over one of its streams
+}
+
+// publication is a stream claimed by a session
+type publication struct {
+	key       streamKey  // key identifies the stream
+	publisher *publisher // publisher is the session publishing the stream
+	opened    time.Time  // opened is when the session claimed the stream
+	lastFrame int64      // lastFrame is when the last frame arrived in Unix nanoseconds, accessed atomically
+	frames    uint64     // frames is the number of frames received, accessed atomically
+}
+
+// received records the arrival of a frame
+func (p *publication) received() {
+	atomic.StoreInt64(&p.lastFrame, time.Now().UnixNano())
+	atomic.AddUint64(&p.frames, 1)
+}
+
+// idle returns how long it has been since the last frame arrived
+func (p *publication) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastFrame)))
+}
+
+// StreamStatus describes a stream being published
+type StreamStatus struct {
+	Site      string    `json:"site"`
+	Channel   int       `json:"channel"`
+	Client    string    `json:"client"`
+	Source    string    `json:"source"`
+	Opened    time.Time `json:"opened"`
+	LastFrame time.Time `json:"lastFrame"`
+	Frames    uint64    `json:"frames"`
+}
+
+// streamRegistry holds the streams being published, so that each channel of a site is only published by a single
+// session at a time
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[streamKey]*publication // streams holds the publication of each stream
+}
+
+// published is the registry of every stream being published to the server
+var published = &streamRegistry{streams: make(map[streamKey]*publication)}
+
+// claim registers the stream as published by the session, returning StatusChannelInUse if another session is
+// publishing it and cannot be taken over according to the policy. Sessions which are taken over are disconnected.
+func (r *streamRegistry) claim(key streamKey, p *publisher, policy string, staleTimeout time.Duration) (
+	*publication, uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing := r.streams[key]; existing != nil {
+		idle := existing.idle()
+		takeover := policy == TakeoverAlways || (policy == TakeoverStale && idle >= staleTimeout)
+		if existing.publisher == p || !takeover {
+			return nil, tunnel.StatusChannelInUse
+		}
+		log.WithFields(log.Fields{"stream": key, "source": existing.publisher.source, "idle": idle}).
+			Warnln("Taking over stream from another session")
+		go existing.publisher.conn.Close()
+	}
+
+	now := time.Now()
+	pub := &publication{key: key, publisher: p, opened: now, lastFrame: now.UnixNano()}
+	r.streams[key] = pub
+	return pub, tunnel.StatusOK
+}
+
+// release removes the stream unless another session has taken it over since
+func (r *streamRegistry) release(pub *publication) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.streams[pub.key] == pub {
+		delete(r.streams, pub.key)
+	}
+}
+
+// list returns the status of every stream being published, sorted by site and channel
+func (r *streamRegistry) list() []StreamStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]StreamStatus, 0, len(r.streams))
+	for _, pub := range r.streams {
+		statuses = append(statuses, StreamStatus{
+			Site:      pub.key.site,
+			Channel:   pub.key.channel,
+			Client:    pub.publisher.client,
+			Source:    pub.publisher.source,
+			Opened:    pub.opened,
+			LastFrame: time.Unix(0, atomic.LoadInt64(&pub.lastFrame)),
+			Frames:    atomic.LoadUint64(&pub.frames),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Site != statuses[j].Site {
+			return statuses[i].Site < statuses[j].Site
+		}
+		return statuses[i].Channel < statuses[j].Channel
+	})
+	return statuses
+}
+
+// checkTakeover returns an error unless the takeover policy is known
+func checkTakeover(policy string) error {
+	if policy != TakeoverNever && policy != TakeoverStale && policy != TakeoverAlways {
+		return fmt.Errorf("the takeover policy needs to be either %s, %s or %s", TakeoverNever, TakeoverStale,
+			TakeoverAlways)
+	}
+	return nil
+}
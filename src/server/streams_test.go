@@ -0,0 +1,131 @@
+package main
+
+import (
+	"github.com/kz/swanntools/src/tunnel"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestPublisher returns a session publishing streams and the peer of its connection, whose reads fail once the
+// session is disconnected
+func newTestPublisher(client string) (*publisher, net.Conn) {
+	conn, peer := net.Pipe()
+	return &publisher{client: client, source: client + ":9000", conn: conn}, peer
+}
+
+// disconnected reports whether the session of the peer was disconnected within a second
+func disconnected(peer net.Conn) bool {
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := peer.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+func TestClaimRefusesStreamsInUse(t *testing.T) {
+	r := &streamRegistry{streams: make(map[streamKey]*publication)}
+	key := streamKey{site: "home", channel: 1}
+	first, _ := newTestPublisher("first")
+	second, _ := newTestPublisher("second")
+
+	if _, status := r.claim(key, first, TakeoverNever, defaultStaleTimeout); status != tunnel.StatusOK {
+		t.Fatalf("Expected the first claim to succeed, got %d", status)
+	}
+	if _, status := r.claim(key, second, TakeoverNever, defaultStaleTimeout); status != tunnel.StatusChannelInUse {
+		t.Errorf("Expected another session to be refused, got %d", status)
+	}
+	if _, status := r.claim(key, second, TakeoverStale, defaultStaleTimeout); status != tunnel.StatusChannelInUse {
+		t.Errorf("Expected another session to be refused while frames arrive, got %d", status)
+	}
+
+	// A session cannot take over its own stream, even when every takeover is allowed
+	if _, status := r.claim(key, first, TakeoverAlways, defaultStaleTimeout); status != tunnel.StatusChannelInUse {
+		t.Errorf("Expected the same session to be refused, got %d", status)
+	}
+
+	// Other channels of the site are unaffected
+	if _, status := r.claim(streamKey{site: "home", channel: 2}, second, TakeoverNever,
+		defaultStaleTimeout); status != tunnel.StatusOK {
+		t.Errorf("Expected another channel to be claimed, got %d", status)
+	}
+}
+
+func TestClaimTakesOverStaleStreams(t *testing.T) {
+	r := &streamRegistry{streams: make(map[streamKey]*publication)}
+	key := streamKey{site: "home", channel: 1}
+	first, firstPeer := newTestPublisher("first")
+	second, _ := newTestPublisher("second")
+
+	old, _ := r.claim(key, first, TakeoverStale, time.Minute)
+	atomic.StoreInt64(&old.lastFrame, time.Now().Add(-2*time.Minute).UnixNano())
+	pub, status := r.claim(key, second, TakeoverStale, time.Minute)
+	if status != tunnel.StatusOK || pub.publisher != second {
+		t.Fatalf("Expected the stale stream to be taken over, got %d", status)
+	}
+	if !disconnected(firstPeer) {
+		t.Error("Expected the session which was taken over to be disconnected")
+	}
+
+	// The old session releasing its stream as it ends keeps the stream of the new session
+	r.release(old)
+	if list := r.list(); len(list) != 1 || list[0].Client != "second" {
+		t.Errorf("Expected the stream to stay published by the new session, got %+v", list)
+	}
+	r.release(pub)
+	if list := r.list(); len(list) != 0 {
+		t.Errorf("Expected the stream to be released, got %+v", list)
+	}
+}
+
+func TestClaimAlwaysTakesOver(t *testing.T) {
+	r := &streamRegistry{streams: make(map[streamKey]*publication)}
+	key := streamKey{site: "home", channel: 1}
+	first, firstPeer := newTestPublisher("first")
+	second, _ := newTestPublisher("second")
+
+	r.claim(key, first, TakeoverAlways, defaultStaleTimeout)
+	if pub, status := r.claim(key, second, TakeoverAlways, defaultStaleTimeout); status != tunnel.StatusOK ||
+		pub.publisher != second {
+		t.Fatalf("Expected the stream to be taken over while frames arrive, got %d", status)
+	}
+	if !disconnected(firstPeer) {
+		t.Error("Expected the session which was taken over to be disconnected")
+	}
+}
+
+func TestConcurrentClaims(t *testing.T) {
+	r := &streamRegistry{streams: make(map[streamKey]*publication)}
+	key := streamKey{site: "home", channel: 1}
+
+	// Only one of the sessions claiming the stream at once publishes it until it releases the stream
+	var claimed, publishing int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		p, _ := newTestPublisher("client")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pub, status := r.claim(key, p, TakeoverNever, defaultStaleTimeout)
+			if status != tunnel.StatusOK {
+				return
+			}
+			atomic.AddInt32(&claimed, 1)
+			if atomic.AddInt32(&publishing, 1) > 1 {
+				t.Error("Expected a single session to publish the stream")
+			}
+			pub.received()
+			r.list()
+			atomic.AddInt32(&publishing, -1)
+			r.release(pub)
+		}()
+	}
+	wg.Wait()
+	if claimed < 1 {
+		t.Error("Expected the stream to be claimed")
+	}
+	if list := r.list(); len(list) != 0 {
+		t.Errorf("Expected every claimed stream to be released, got %+v", list)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// handshakeTimeout is the time clients have to complete the TLS handshake and then greet the server or enroll
+const handshakeTimeout = 10 * time.Second
+
+// newTLSConfig creates the TLS config of the listener. The server presents its certificate and requires clients to
+// present a certificate signed by the CA, unless enrollment is enabled in which case clients without a certificate
+// are let through to enroll.
+func newTLSConfig(certs, ca string, enroll bool) (*tls.Config, error) {
+	// Load server key pair
+	cert, err := tls.LoadX509KeyPair(certs+"/server.pem", certs+"/server.key")
+	if err != nil {
+		return nil, fmt.Errorf("unable to load server key pair: %s", err.Error())
+	}
+
+	// Trust the CA, falling back to the client certificate itself if it is self-signed
+	if ca == "" {
+		ca = certs + "/ca.pem"
+		if _, err := os.Stat(ca); os.IsNotExist(err) {
+			ca = certs + "/client.pem"
+		}
+	}
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificate: %s", err.Error())
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", ca)
+	}
+
+	clientAuth := tls.RequireAndVerifyClientCert
+	if enroll {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
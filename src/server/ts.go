@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/kz/swanntools/src/mpegts"
+)
+
+// tsConsumer saves the stream of each channel to MPEG-TS files which are split in the same way as diskConsumer
+type tsConsumer struct {
+	options ConsumerOptions        // options configure the consumer
+	tracks  map[streamKey]*tsTrack // tracks are the open recordings of each stream
+}
+
+// tsTrack is the recording of a single channel to MPEG-TS
+type tsTrack struct {
+	seg   *segment      // seg is the open segment file
+	muxer *mpegts.Muxer // muxer packetizes frames into the segment file
+	pts   uint64        // pts is the presentation time of the last frame in 90kHz ticks
+	last  *Data         // last is the last written frame, used to time the next one
+}
+
+func init() {
+	RegisterConsumer("ts", newTSConsumer)
+}
+
+// newTSConsumer creates a tsConsumer saving to the directory in options
+func newTSConsumer(options ConsumerOptions) (Consumer, error) {
+	if err := checkDirectory(options.Destination); err != nil {
+		return nil, err
+	}
+	if err := checkTiming(options.Timing); err != nil {
+		return nil, err
+	}
+	return &tsConsumer{options: options, tracks: make(map[streamKey]*tsTrack)}, nil
+}
+
+// Start does nothing as recordings are opened when the first keyframe of each channel arrives
+func (c *tsConsumer) Start() error {
+	return nil
+}
+
+// Write adds a frame to the recording of its channel
+func (c *tsConsumer) Write(data Data) error {
+	// Only video frames are saved
+	if !data.frame.IsVideo() {
+		return nil
+	}
+	t := c.tracks[data.stream]
+	if t == nil {
+		t = &tsTrack{}
+		c.tracks[data.stream] = t
+	}
+
+	// Start a new segment on a keyframe once the segment duration has passed
+	if shouldRotate(t.seg, data, c.options.SegmentDuration) {
+		if t.seg != nil {
+			t.seg.close()
+			t.seg = nil
+		}
+		seg, err := openSegment(c.options.Destination, data.stream, ".ts", data.received)
+		if err != nil {
+			return err
+		}
+		t.seg = seg
+		t.muxer = mpegts.NewMuxer(t.seg.file)
+	}
+
+	// Drop frames until the first keyframe so that the segment is playable from its start
+	if t.seg == nil {
+		return nil
+	}
+
+	// Advance the clock by the duration of the last frame, continuing across segments
+	if t.last != nil {
+		t.pts += uint64(sampleDuration(c.options.Timing, *t.last, data))
+	}
+	t.last = &data
+
+	// Write to file
+	au := mpegts.AccessUnit(data.units, data.params)
+	return t.muxer.WriteAccessUnit(au, t.pts, data.keyframe)
+}
+
+// Close closes the open segments
+func (c *tsConsumer) Close() error {
+	for stream, t := range c.tracks {
+		if t.seg != nil {
+			t.seg.close()
+		}
+		delete(c.tracks, stream)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+// Package shutdown stops the client and the server gracefully when they are asked to exit, while still letting an
+// impatient operator exit straight away.
+package shutdown
+
+import (
+	"context"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// exit exits the process, which tests replace
+var exit = func() { log.Fatalln("Exiting before the shutdown has finished") }
+
+// OnSignal cancels the context once the process is sent SIGINT or SIGTERM, so that it can finish what it is doing
+// and exit. Sending either signal again exits straight away.
+func OnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	log.WithField("signal", sig).Infoln("Shutting down, send the signal again to exit straight away")
+	cancel()
+	<-signals
+	exit()
+}
@@ -0,0 +1,36 @@
+package shutdown
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOnSignal(t *testing.T) {
+	exited := make(chan struct{})
+	exit = func() { close(exited) }
+	ctx, cancel := context.WithCancel(context.Background())
+	go OnSignal(cancel)
+
+	// Wait for the signals to be caught before sending them, as they would otherwise end the test
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the context to be cancelled by the first signal")
+	}
+	select {
+	case <-exited:
+		t.Fatal("Expected the first signal not to exit")
+	default:
+	}
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the second signal to exit")
+	}
+}
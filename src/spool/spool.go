@@ -0,0 +1,360 @@
+// Package spool provides a bounded first-in first-out queue of records stored on disk, which holds data while it
+// cannot be delivered and survives restarts.
+//
+// Records are appended to segment files in a directory, each record being prefixed by its big-endian 4 byte length.
+// Segment files are deleted once every record in them has been read, and the oldest segment files are deleted when
+// the spool grows beyond its maximum size.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Segment files
+const (
+	segmentExt      = ".spool"  // segmentExt is the extension of segment files
+	minSegmentSize  = 1 << 20   // minSegmentSize is the smallest size of a segment file before the next is started
+	segmentsPerSize = 16        // segmentsPerSize is the number of segment files a full spool is split into
+	maxRecordSize   = 256 << 20 // maxRecordSize is the largest record read before assuming corruption
+)
+
+// ErrEmpty is returned when reading from an empty spool
+var ErrEmpty = errors.New("spool: empty")
+
+// Spool is a bounded first-in first-out queue of records stored on disk. It is not safe for concurrent use.
+type Spool struct {
+	dir         string   // dir is the directory holding the segment files
+	maxSize     int64    // maxSize is the size above which the oldest segment files are deleted
+	segmentSize int64    // segmentSize is the size of a segment file before the next is started
+	segments    []int64  // segments are the sequence numbers of the segment files, oldest first
+	sizes       []int64  // sizes are the sizes of each segment file
+	writer      *os.File // writer appends to the newest segment file
+	reader      *os.File // reader reads from the oldest segment file
+	offset      int64    // offset is the position of the next record in the oldest segment file
+	next        []byte   // next is the record at offset once it has been read by Peek
+	size        int64    // size is the number of bytes which have not been read
+	dropped     int64    // dropped is the number of bytes deleted because the spool was full
+}
+
+// Open opens the spool in dir, creating dir if needed. Records left in dir by an earlier spool are kept and read
+// first.
+func Open(dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("spool: the maximum size needs to be positive")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxSize: maxSize, segmentSize: maxSize / segmentsPerSize}
+	if s.segmentSize < minSegmentSize {
+		s.segmentSize = minSegmentSize
+	}
+
+	// Find the segment files of an earlier spool
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	for _, seq := range s.segments {
+		info, err := os.Stat(s.path(seq))
+		if err != nil {
+			return nil, err
+		}
+		s.sizes = append(s.sizes, info.Size())
+		s.size += info.Size()
+	}
+	return s, nil
+}
+
+// path returns the path of the segment file with the sequence number
+func (s *Spool) path(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016d%s", seq, segmentExt))
+}
+
+// Append adds a record to the end of the spool, deleting the oldest records if the spool becomes too large
+func (s *Spool) Append(record []byte) error {
+	// Start a new segment file once the newest is full, or if it was left by an earlier spool
+	last := len(s.segments) - 1
+	if s.writer == nil || s.sizes[last] >= s.segmentSize {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+		last = len(s.segments) - 1
+	}
+
+	data := make([]byte, 4+len(record))
+	binary.BigEndian.PutUint32(data[:4], uint32(len(record)))
+	copy(data[4:], record)
+	if _, err := s.writer.Write(data); err != nil {
+		return err
+	}
+	s.sizes[last] += int64(len(data))
+	s.size += int64(len(data))
+
+	// Delete the oldest segment files, but never the one being written
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		s.dropped += s.sizes[0] - s.offset
+		if err := s.removeOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prepend adds records to the front of the spool, ahead of every record already in it, such as records which were
+// taken out to be delivered but were never confirmed. The records are written to a segment file of their own which is
+// read first, and the oldest records are deleted if the spool becomes too large.
+func (s *Spool) Prepend(records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var data []byte
+	for _, record := range records {
+		var hdr [4]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(record)))
+		data = append(append(data, hdr[:]...), record...)
+	}
+
+	// Only the oldest segment file keeps its read position, so move the records left in it behind the new ones
+	if len(s.segments) > 0 && s.offset > 0 {
+		rest, err := s.unread()
+		if err != nil {
+			return err
+		}
+		data = append(data, rest...)
+		if err := s.removeOldest(); err != nil {
+			return err
+		}
+	}
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	s.next = nil
+
+	// Number the segment file before the oldest, which may be negative
+	var seq int64
+	if len(s.segments) > 0 {
+		seq = s.segments[0] - 1
+	}
+	f, err := os.OpenFile(s.path(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.segments = append([]int64{seq}, s.segments...)
+	s.sizes = append([]int64{int64(len(data))}, s.sizes...)
+	s.size += int64(len(data))
+
+	// Delete the oldest segment files, but never the one being written
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		s.dropped += s.sizes[0] - s.offset
+		if err := s.removeOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unread returns the records of the oldest segment file which have not been read, along with their length prefixes
+func (s *Spool) unread() ([]byte, error) {
+	if s.reader == nil {
+		f, err := os.Open(s.path(s.segments[0]))
+		if err != nil {
+			return nil, err
+		}
+		s.reader = f
+	}
+	rest := make([]byte, s.sizes[0]-s.offset)
+	if _, err := s.reader.ReadAt(rest, s.offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return rest, nil
+}
+
+// startSegment closes the newest segment file and creates the next one
+func (s *Spool) startSegment() error {
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			return err
+		}
+		s.writer = nil
+	}
+	var seq int64
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1] + 1
+	}
+	f, err := os.OpenFile(s.path(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	s.writer = f
+	s.segments = append(s.segments, seq)
+	s.sizes = append(s.sizes, 0)
+	return nil
+}
+
+// removeOldest deletes the oldest segment file, along with any records in it which have not been read
+func (s *Spool) removeOldest() error {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if len(s.segments) == 1 && s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+	s.size -= s.sizes[0] - s.offset
+	path := s.path(s.segments[0])
+	s.segments, s.sizes, s.offset, s.next = s.segments[1:], s.sizes[1:], 0, nil
+	return os.Remove(path)
+}
+
+// Peek returns the oldest record without removing it, or ErrEmpty if there are no records
+func (s *Spool) Peek() ([]byte, error) {
+	if s.next != nil {
+		return s.next, nil
+	}
+	for {
+		if len(s.segments) == 0 {
+			return nil, ErrEmpty
+		}
+
+		// Move on to the next segment file once every record in the oldest has been read
+		if s.offset >= s.sizes[0] {
+			if len(s.segments) == 1 && s.writer != nil {
+				// The only segment file is being written, so start again from an empty file
+				if err := s.removeOldest(); err != nil {
+					return nil, err
+				}
+				return nil, ErrEmpty
+			}
+			if err := s.removeOldest(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if s.reader == nil {
+			f, err := os.Open(s.path(s.segments[0]))
+			if err != nil {
+				return nil, err
+			}
+			s.reader = f
+		}
+		record, err := s.read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A record was cut short, such as by a crash while it was written, so skip the rest of the file
+			s.dropped += s.sizes[0] - s.offset
+			s.size -= s.sizes[0] - s.offset
+			s.sizes[0] = s.offset
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.next = record
+		return record, nil
+	}
+}
+
+// read reads the record at the offset of the oldest segment file
+func (s *Spool) read() ([]byte, error) {
+	hdr := make([]byte, 4)
+	if _, err := s.reader.ReadAt(hdr, s.offset); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr)
+	if length > maxRecordSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	record := make([]byte, length)
+	if _, err := s.reader.ReadAt(record, s.offset+4); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// Remove removes the oldest record, which is the one returned by Peek
+func (s *Spool) Remove() error {
+	record, err := s.Peek()
+	if err != nil {
+		return err
+	}
+	s.offset += int64(4 + len(record))
+	s.size -= int64(4 + len(record))
+	s.next = nil
+	return nil
+}
+
+// Size returns the number of bytes of records which have not been read, including their length prefixes
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+// Empty reports whether every record has been read
+func (s *Spool) Empty() bool {
+	return s.size == 0
+}
+
+// Dropped returns the number of bytes of records deleted because the spool was full or corrupt, then resets it
+func (s *Spool) Dropped() int64 {
+	d := s.dropped
+	s.dropped = 0
+	return d
+}
+
+// Close flushes the newest segment file to disk and closes the segment files. Records which have not been removed are
+// kept for the next time the spool is opened, although records removed from a segment file which still holds others
+// are read again.
+func (s *Spool) Close() error {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if s.writer != nil {
+		if err := s.writer.Sync(); err != nil {
+			s.writer.Close()
+			s.writer = nil
+			return err
+		}
+		if err := s.writer.Close(); err != nil {
+			return err
+		}
+		s.writer = nil
+	}
+	return nil
+}
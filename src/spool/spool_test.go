@@ -0,0 +1,195 @@
+package spool
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempDir creates a directory for a spool which is removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// drain removes every record from the spool, returning them in order
+func drain(t *testing.T, s *Spool) [][]byte {
+	var records [][]byte
+	for {
+		record, err := s.Peek()
+		if err == ErrEmpty {
+			return records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+		if err := s.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFIFO(t *testing.T) {
+	s, err := Open(tempDir(t), 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Peek(); err != ErrEmpty {
+		t.Fatalf("Expected ErrEmpty, got %v", err)
+	}
+	for _, r := range []string{"one", "", "three"} {
+		if err := s.Append([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Size() != 3*4+8 {
+		t.Errorf("Expected a size of 20 but got %d", s.Size())
+	}
+
+	// Peek does not remove the record
+	first, _ := s.Peek()
+	again, _ := s.Peek()
+	if string(first) != "one" || string(again) != "one" {
+		t.Errorf("Expected to peek at the first record twice, got %q and %q", first, again)
+	}
+
+	records := drain(t, s)
+	if len(records) != 3 || string(records[0]) != "one" || len(records[1]) != 0 || string(records[2]) != "three" {
+		t.Errorf("Unexpected records %q", records)
+	}
+	if !s.Empty() {
+		t.Errorf("Expected the spool to be empty, %d bytes left", s.Size())
+	}
+
+	// Records can still be appended once the spool has been emptied
+	s.Append([]byte("four"))
+	if records := drain(t, s); len(records) != 1 || string(records[0]) != "four" {
+		t.Errorf("Unexpected records %q", records)
+	}
+}
+
+func TestDropsOldestWhenFull(t *testing.T) {
+	dir := tempDir(t)
+	s, err := Open(dir, 4<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Write 8MB of records to a 4MB spool which is split into 1MB segment files
+	record := make([]byte, 64<<10)
+	for i := 0; i < 128; i++ {
+		record[0] = byte(i)
+		if err := s.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Size() > 4<<20 {
+		t.Errorf("Expected the spool to stay within 4MB, got %d bytes", s.Size())
+	}
+	if s.Dropped() == 0 {
+		t.Errorf("Expected records to be dropped")
+	}
+
+	// The newest records are kept, in order
+	records := drain(t, s)
+	for i, r := range records {
+		if expected := byte(128 - len(records) + i); r[0] != expected {
+			t.Fatalf("Expected record %d but got %d", expected, r[0])
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt)); len(files) != 0 {
+		t.Errorf("Expected segment files to be deleted, found %v", files)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := tempDir(t)
+	s, err := Open(dir, 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Append([]byte("kept"))
+	s.Append([]byte("cut short"))
+	s.Close()
+
+	// Simulate a crash while the last record was written
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(files) != 1 {
+		t.Fatalf("Expected one segment file, found %v", files)
+	}
+	info, _ := os.Stat(files[0])
+	os.Truncate(files[0], info.Size()-2)
+
+	s, err = Open(dir, 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Append([]byte("new"))
+
+	records := drain(t, s)
+	if len(records) != 2 || !bytes.Equal(records[0], []byte("kept")) || !bytes.Equal(records[1], []byte("new")) {
+		t.Errorf("Unexpected records %q", records)
+	}
+	if s.Dropped() == 0 {
+		t.Errorf("Expected the record which was cut short to be dropped")
+	}
+}
+
+func TestPrepend(t *testing.T) {
+	dir := tempDir(t)
+	s, err := Open(dir, 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{"a", "b", "c"} {
+		s.Append([]byte(record))
+	}
+	if records := drain(t, s); len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %q", records)
+	}
+	s.Append([]byte("d"))
+	s.Append([]byte("e"))
+
+	// Read part of the segment file being written, then put records back ahead of the rest
+	if _, err := s.Peek(); err != nil {
+		t.Fatal(err)
+	}
+	s.Remove()
+	if err := s.Prepend([][]byte{[]byte("x"), []byte("y")}); err != nil {
+		t.Fatal(err)
+	}
+	s.Append([]byte("f"))
+	s.Close()
+
+	// The order survives reopening, and records can be put back ahead of those left by an earlier spool
+	s, err = Open(dir, 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Prepend([][]byte{[]byte("w")}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, record := range drain(t, s) {
+		got = append(got, string(record))
+	}
+	if expected := []string{"w", "x", "y", "e", "f"}; strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected records %v, got %v", expected, got)
+	}
+	if !s.Empty() {
+		t.Errorf("Expected the spool to be empty, %d bytes are left", s.Size())
+	}
+}
@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Data is the content of a MsgData message
+type Data struct {
+	Sequence uint64    // Sequence numbers the frames of a stream in order, only sent if the session uses CapAck
+	Captured time.Time // Captured is the time the frame was captured, only sent if the session uses CapTimestamps
+	Frame    []byte    // Frame is the encoded frame
+}
+
+// Message returns the MsgData message carrying the data on the stream of a session using caps. The payload is the
+// capture time as a big-endian count of nanoseconds since the Unix epoch if the session uses CapTimestamps, then the
+// big-endian sequence number if the session uses CapAck, then the frame.
+func (d *Data) Message(stream uint16, caps Capability) *Message {
+	payload := make([]byte, 0, 16+len(d.Frame))
+	if caps.Has(CapTimestamps) {
+		payload = appendUint64(payload, uint64(d.Captured.UnixNano()))
+	}
+	if caps.Has(CapAck) {
+		payload = appendUint64(payload, d.Sequence)
+	}
+	payload = append(payload, d.Frame...)
+	return &Message{Type: MsgData, Stream: stream, Payload: payload}
+}
+
+// Data decodes a MsgData message sent on a session using caps. Fields which are not sent on the session are zero.
+func (m *Message) Data(caps Capability) (*Data, error) {
+	d := &Data{}
+	payload := m.Payload
+	if caps.Has(CapTimestamps) {
+		if len(payload) < 8 {
+			return nil, ErrInvalidPayload
+		}
+		d.Captured = time.Unix(0, int64(binary.BigEndian.Uint64(payload[:8])))
+		payload = payload[8:]
+	}
+	if caps.Has(CapAck) {
+		if len(payload) < 8 {
+			return nil, ErrInvalidPayload
+		}
+		d.Sequence = binary.BigEndian.Uint64(payload[:8])
+		payload = payload[8:]
+	}
+	d.Frame = payload
+	return d, nil
+}
+
+// AckMessage returns a MsgAck message acknowledging every data message of the stream up to the sequence number. Zero
+// acknowledges nothing.
+func AckMessage(stream uint16, sequence uint64) *Message {
+	return &Message{Type: MsgAck, Stream: stream, Payload: appendUint64(nil, sequence)}
+}
+
+// Sequence decodes the sequence number of a MsgAck message
+func (m *Message) Sequence() (uint64, error) {
+	if len(m.Payload) != 8 {
+		return 0, ErrInvalidPayload
+	}
+	return binary.BigEndian.Uint64(m.Payload), nil
+}
+
+// appendUint64 appends v to data in big-endian byte order
+func appendUint64(data []byte, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return append(data, b...)
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"encoding/binary"
+)
+
+// Enrollment is sent instead of a Hello by a client without a certificate, asking the server to sign one
+type Enrollment struct {
+	Token   string // Token is the one-time enrollment token given to the client
+	Request []byte // Request is the PEM encoded certificate request of the client
+}
+
+// MarshalBinary encodes the enrollment as the payload of a MsgEnroll message. The layout is the token prefixed by its
+// big-endian 2 byte length, then the request.
+func (e *Enrollment) MarshalBinary() ([]byte, error) {
+	if len(e.Token) > 0xffff {
+		return nil, ErrInvalidPayload
+	}
+	data := make([]byte, 2, 2+len(e.Token)+len(e.Request))
+	binary.BigEndian.PutUint16(data, uint16(len(e.Token)))
+	data = append(data, e.Token...)
+	return append(data, e.Request...), nil
+}
+
+// UnmarshalBinary decodes the payload of a MsgEnroll message
+func (e *Enrollment) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+		return ErrInvalidPayload
+	}
+	n := 2 + int(binary.BigEndian.Uint16(data))
+	e.Token = string(data[2:n])
+	e.Request = data[n:]
+	return nil
+}
+
+// Message returns the MsgEnroll message carrying the enrollment
+func (e *Enrollment) Message() (*Message, error) {
+	payload, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Type: MsgEnroll, Payload: payload}, nil
+}
+
+// EnrollmentReply answers an Enrollment, either with the signed certificate or the reason it was refused
+type EnrollmentReply struct {
+	Status      uint16 // Status is StatusOK if the certificate was signed
+	Certificate []byte // Certificate is the PEM encoded certificate of the client
+	CA          []byte // CA is the PEM encoded certificate of the CA, which the client verifies the server with
+	Reason      string // Reason explains why the enrollment was refused
+}
+
+// MarshalBinary encodes the reply as the payload of a MsgEnrollReply message. The layout is the big-endian status,
+// the certificate and the CA certificate each prefixed by their big-endian 4 byte length, then the reason.
+func (r *EnrollmentReply) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 2, 10+len(r.Certificate)+len(r.CA)+len(r.Reason))
+	binary.BigEndian.PutUint16(data, r.Status)
+	for _, b := range [][]byte{r.Certificate, r.CA} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(b)))
+		data = append(append(data, length...), b...)
+	}
+	return append(data, r.Reason...), nil
+}
+
+// UnmarshalBinary decodes the payload of a MsgEnrollReply message
+func (r *EnrollmentReply) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return ErrInvalidPayload
+	}
+	r.Status = binary.BigEndian.Uint16(data)
+	data = data[2:]
+	for _, b := range []*[]byte{&r.Certificate, &r.CA} {
+		if len(data) < 4 || uint32(len(data)-4) < binary.BigEndian.Uint32(data) {
+			return ErrInvalidPayload
+		}
+		n := 4 + int(binary.BigEndian.Uint32(data))
+		*b = data[4:n]
+		data = data[n:]
+	}
+	r.Reason = string(data)
+	return nil
+}
+
+// Message returns the MsgEnrollReply message carrying the reply
+func (r *EnrollmentReply) Message() (*Message, error) {
+	payload, err := r.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Type: MsgEnrollReply, Payload: payload}, nil
+}
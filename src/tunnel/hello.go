@@ -0,0 +1,161 @@
+package tunnel
+
+import (
+	"encoding/binary"
+)
+
+// Protocol versions understood by this package. Version is the version spoken by default and MinVersion is the
+// oldest version which can still be spoken with a peer.
+const (
+	Version    uint8 = 1
+	MinVersion uint8 = 1
+)
+
+// Capability is a set of optional protocol features, each being a single bit
+type Capability uint32
+
+// Optional features
+const (
+	// CapTimestamps prefixes the payload of data messages with the time the frame was captured, so that frames sent
+	// late, such as after an outage, keep their original timing
+	CapTimestamps Capability = 1 << iota
+	// CapAck numbers the data messages of each stream, which the server acknowledges with MsgAck messages once it
+	// has stored them so that the client can resume from the last acknowledged frame after reconnecting. Servers
+	// which may drop frames they received leave it out of their reply.
+	CapAck
+	// CapSites adds the name of the site to MsgOpen messages, so that a client can publish the streams of several
+	// DVRs, each being its own site
+	CapSites
+)
+
+// Capabilities is the set of optional features implemented by this package. Features are only used on a session
+// when both peers set them in their hello messages.
+const Capabilities = CapTimestamps | CapAck | CapSites
+
+// Has reports whether every feature of o is in c
+func (c Capability) Has(o Capability) bool {
+	return c&o == o
+}
+
+// Hello is the first message of a session, sent by the client
+type Hello struct {
+	Version      uint8      // Version is the newest protocol version spoken by the client
+	Capabilities Capability // Capabilities are the optional features implemented by the client
+	ClientID     string     // ClientID names the client, at most 255 bytes long
+	Key          string     // Key is the passphrase the client authenticates with
+}
+
+// MarshalBinary encodes the hello as the payload of a MsgHello message. The layout is the version, the big-endian
+// capabilities, the client ID prefixed by its 1 byte length and the key prefixed by its big-endian 2 byte length.
+func (h *Hello) MarshalBinary() ([]byte, error) {
+	if len(h.ClientID) > 0xff || len(h.Key) > 0xffff {
+		return nil, ErrInvalidPayload
+	}
+	data := make([]byte, 5, 5+1+len(h.ClientID)+2+len(h.Key))
+	data[0] = h.Version
+	binary.BigEndian.PutUint32(data[1:5], uint32(h.Capabilities))
+	data = append(data, byte(len(h.ClientID)))
+	data = append(data, h.ClientID...)
+	data = append(data, byte(len(h.Key)>>8), byte(len(h.Key)))
+	data = append(data, h.Key...)
+	return data, nil
+}
+
+// UnmarshalBinary decodes the payload of a MsgHello message
+func (h *Hello) UnmarshalBinary(data []byte) error {
+	if len(data) < 6 {
+		return ErrInvalidPayload
+	}
+	h.Version = data[0]
+	h.Capabilities = Capability(binary.BigEndian.Uint32(data[1:5]))
+
+	n := int(data[5])
+	data = data[6:]
+	if len(data) < n+2 {
+		return ErrInvalidPayload
+	}
+	h.ClientID = string(data[:n])
+	data = data[n:]
+
+	n = int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	if len(data) != n {
+		return ErrInvalidPayload
+	}
+	h.Key = string(data)
+	return nil
+}
+
+// Message returns the MsgHello message carrying the hello
+func (h *Hello) Message() (*Message, error) {
+	payload, err := h.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Type: MsgHello, Payload: payload}, nil
+}
+
+// HelloReply answers a Hello, either accepting the session with the version and features to use or rejecting it
+type HelloReply struct {
+	Status       uint16     // Status is StatusOK if the session is accepted
+	Version      uint8      // Version is the protocol version to speak for the rest of the session
+	Capabilities Capability // Capabilities are the optional features to use for the rest of the session
+	Reason       string     // Reason explains why a session is rejected
+}
+
+// MarshalBinary encodes the reply as the payload of a MsgHelloReply message. The layout is the big-endian status,
+// the version, the big-endian capabilities and the reason prefixed by its big-endian 2 byte length.
+func (r *HelloReply) MarshalBinary() ([]byte, error) {
+	if len(r.Reason) > 0xffff {
+		return nil, ErrInvalidPayload
+	}
+	data := make([]byte, 9, 9+len(r.Reason))
+	binary.BigEndian.PutUint16(data[0:2], r.Status)
+	data[2] = r.Version
+	binary.BigEndian.PutUint32(data[3:7], uint32(r.Capabilities))
+	binary.BigEndian.PutUint16(data[7:9], uint16(len(r.Reason)))
+	data = append(data, r.Reason...)
+	return data, nil
+}
+
+// UnmarshalBinary decodes the payload of a MsgHelloReply message
+func (r *HelloReply) UnmarshalBinary(data []byte) error {
+	if len(data) < 9 || len(data) != 9+int(binary.BigEndian.Uint16(data[7:9])) {
+		return ErrInvalidPayload
+	}
+	r.Status = binary.BigEndian.Uint16(data[0:2])
+	r.Version = data[2]
+	r.Capabilities = Capability(binary.BigEndian.Uint32(data[3:7]))
+	r.Reason = string(data[9:])
+	return nil
+}
+
+// Message returns the MsgHelloReply message carrying the reply
+func (r *HelloReply) Message() (*Message, error) {
+	payload, err := r.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Type: MsgHelloReply, Payload: payload}, nil
+}
+
+// Negotiate picks the version and features to use with a peer which sent the hello. Peers speaking a newer version
+// are downgraded to Version, whereas peers older than MinVersion are rejected with StatusVersionNotSupported. The
+// credentials in the hello are not checked.
+func Negotiate(h *Hello) *HelloReply {
+	if h.Version < MinVersion {
+		return &HelloReply{Status: StatusVersionNotSupported, Version: Version,
+			Reason: "protocol version is no longer supported"}
+	}
+	version := h.Version
+	if version > Version {
+		version = Version
+	}
+	return &HelloReply{Status: StatusOK, Version: version, Capabilities: h.Capabilities & Capabilities}
+}
+
+// Accepts reports whether a reply from a peer can be spoken with, which is when the peer accepted the session with a
+// version this package understands
+func (r *HelloReply) Accepts() bool {
+	return r.Status == StatusOK && r.Version >= MinVersion && r.Version <= Version
+}
@@ -0,0 +1,192 @@
+// Package tunnel implements the framed protocol which carries the streams of several channels between the client
+// and the server over a single TLS session.
+//
+// Every message starts with a 7 byte header made up of the message type, a big-endian stream ID and a big-endian
+// payload length. The client says hello once per session, agreeing on a protocol version and authenticating, then
+// opens a stream for each channel and sends the frames of that channel as data messages on the stream.
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Message framing
+const (
+	HeaderSize     = 7       // HeaderSize is the size of the header preceding each message
+	MaxPayloadSize = 8 << 20 // MaxPayloadSize is the largest payload accepted before assuming corruption
+)
+
+// MessageType identifies what a message carries
+type MessageType uint8
+
+// Message types
+const (
+	MsgHello       MessageType = 0x01 // MsgHello negotiates the version and authenticates the session with a Hello
+	MsgHelloReply  MessageType = 0x02 // MsgHelloReply answers MsgHello with a HelloReply
+	MsgOpen        MessageType = 0x03 // MsgOpen opens a stream with the channel number as its payload
+	MsgOpenReply   MessageType = 0x04 // MsgOpenReply answers MsgOpen with a status
+	MsgData        MessageType = 0x05 // MsgData carries an encoded frame of a stream
+	MsgClose       MessageType = 0x06 // MsgClose closes a stream
+	MsgAck         MessageType = 0x07 // MsgAck acknowledges the data messages of a stream up to a sequence number
+	MsgEnroll      MessageType = 0x08 // MsgEnroll asks for a client certificate with an Enrollment instead of MsgHello
+	MsgEnrollReply MessageType = 0x09 // MsgEnrollReply answers MsgEnroll with an EnrollmentReply
+)
+
+// Status codes, matching those of the original per-channel handshake
+const (
+	StatusOK                  uint16 = 200 // StatusOK accepts the request
+	StatusInvalidChannel      uint16 = 400 // StatusInvalidChannel rejects a channel which is out of range
+	StatusUnauthorized        uint16 = 403 // StatusUnauthorized rejects invalid credentials
+	StatusChannelInUse        uint16 = 409 // StatusChannelInUse rejects a channel which is already being streamed
+	StatusVersionNotSupported uint16 = 505 // StatusVersionNotSupported rejects a client which is too old
+)
+
+// Errors returned when reading messages
+var (
+	ErrPayloadTooLarge = errors.New("tunnel: payload too large")
+	ErrInvalidPayload  = errors.New("tunnel: invalid payload")
+)
+
+// Message is a single message of the protocol
+type Message struct {
+	Type    MessageType // Type identifies what the message carries
+	Stream  uint16      // Stream is the ID of the stream the message belongs to, or zero for the session
+	Payload []byte      // Payload is the content of the message
+}
+
+// MarshalBinary encodes the message along with its header
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if len(m.Payload) > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+	data := make([]byte, HeaderSize+len(m.Payload))
+	data[0] = byte(m.Type)
+	binary.BigEndian.PutUint16(data[1:3], m.Stream)
+	binary.BigEndian.PutUint32(data[3:7], uint32(len(m.Payload)))
+	copy(data[HeaderSize:], m.Payload)
+	return data, nil
+}
+
+// ReadMessage reads a whole message from r
+func ReadMessage(r io.Reader) (*Message, error) {
+	hdr := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(hdr[3:7])
+	if length > MaxPayloadSize {
+		return nil, ErrPayloadTooLarge
+	}
+	m := &Message{Type: MessageType(hdr[0]), Stream: binary.BigEndian.Uint16(hdr[1:3]), Payload: make([]byte, length)}
+	if _, err := io.ReadFull(r, m.Payload); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// StatusMessage returns a reply carrying a status code
+func StatusMessage(t MessageType, stream uint16, status uint16) *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, status)
+	return &Message{Type: t, Stream: stream, Payload: payload}
+}
+
+// Status decodes the status code of a reply
+func (m *Message) Status() (uint16, error) {
+	if len(m.Payload) != 2 {
+		return 0, ErrInvalidPayload
+	}
+	return binary.BigEndian.Uint16(m.Payload), nil
+}
+
+// Open is the content of a MsgOpen message
+type Open struct {
+	Channel int    // Channel is the channel number of the stream
+	Site    string // Site names the site of the channel, at most 255 bytes long, or is empty for the client ID
+}
+
+// Message returns the MsgOpen message opening the stream on a session using caps. The payload is the channel number,
+// followed by the site if the session uses CapSites.
+func (o *Open) Message(stream uint16, caps Capability) (*Message, error) {
+	if o.Channel < 0 || o.Channel > 0xff || len(o.Site) > 0xff || (o.Site != "" && !caps.Has(CapSites)) {
+		return nil, ErrInvalidPayload
+	}
+	payload := make([]byte, 1, 1+len(o.Site))
+	payload[0] = byte(o.Channel)
+	if caps.Has(CapSites) {
+		payload = append(payload, o.Site...)
+	}
+	return &Message{Type: MsgOpen, Stream: stream, Payload: payload}, nil
+}
+
+// Open decodes a MsgOpen message sent on a session using caps
+func (m *Message) Open(caps Capability) (*Open, error) {
+	if len(m.Payload) < 1 || len(m.Payload) > 1+0xff || (len(m.Payload) > 1 && !caps.Has(CapSites)) {
+		return nil, ErrInvalidPayload
+	}
+	return &Open{Channel: int(m.Payload[0]), Site: string(m.Payload[1:])}, nil
+}
+
+// ValidSite reports whether the name can be used as the site of a stream. Servers name folders and URLs after
+// sites, so sites are limited to letters, digits, dots, dashes and underscores and cannot be . or ..
+func ValidSite(name string) bool {
+	if name == "" || len(name) > 255 || name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' ||
+			r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// OpenMessage returns a message opening a stream for the channel of the client ID
+func OpenMessage(stream uint16, channel int) *Message {
+	return &Message{Type: MsgOpen, Stream: stream, Payload: []byte{byte(channel)}}
+}
+
+// Channel decodes the channel number of a MsgOpen message which does not name a site
+func (m *Message) Channel() (int, error) {
+	open, err := m.Open(0)
+	if err != nil {
+		return 0, err
+	}
+	return open.Channel, nil
+}
+
+// Conn sends and receives messages on a connection. Messages can be sent from several goroutines at once.
+type Conn struct {
+	rw  io.ReadWriter
+	wmu sync.Mutex // wmu prevents messages sent at the same time from being interleaved
+}
+
+// NewConn creates a Conn on the connection
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{rw: rw}
+}
+
+// Send writes a message to the connection
+func (c *Conn) Send(m *Message) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err = c.rw.Write(data)
+	return err
+}
+
+// Receive reads the next message from the connection
+func (c *Conn) Receive() (*Message, error) {
+	return ReadMessage(c.rw)
+}
@@ -0,0 +1,243 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	data, err := (&Message{Type: MsgData, Stream: 0x0102, Payload: []byte{0xaa, 0xbb}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := hex.DecodeString("05010200000002aabb")
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected %x but got %x", expected, data)
+	}
+
+	m, err := ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != MsgData || m.Stream != 0x0102 || !bytes.Equal(m.Payload, []byte{0xaa, 0xbb}) {
+		t.Errorf("Unexpected message %+v", m)
+	}
+}
+
+func TestReadMessageRejectsBadInput(t *testing.T) {
+	// Lengths above the maximum are rejected before any payload is read
+	if _, err := ReadMessage(bytes.NewReader([]byte{5, 0, 1, 0xff, 0xff, 0xff, 0xff})); err != ErrPayloadTooLarge {
+		t.Errorf("Expected ErrPayloadTooLarge, got %v", err)
+	}
+	if _, err := ReadMessage(bytes.NewReader([]byte{5, 0, 1, 0, 0, 0, 4, 1})); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	c := NewConn(buf)
+	for _, m := range []*Message{
+		StatusMessage(MsgOpenReply, 1, StatusChannelInUse),
+		OpenMessage(3, 4),
+	} {
+		if err := c.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := reply.Status(); err != nil || status != StatusChannelInUse {
+		t.Errorf("Expected status %d but got %d (%v)", StatusChannelInUse, status, err)
+	}
+	open, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel, err := open.Channel(); err != nil || open.Stream != 3 || channel != 4 {
+		t.Errorf("Expected stream 3 to open channel 4, got stream %d channel %d (%v)", open.Stream, channel, err)
+	}
+}
+
+func TestHelloEncoding(t *testing.T) {
+	h := &Hello{Version: 1, Capabilities: 0x0102, ClientID: "site", Key: "pass\nword"}
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := hex.DecodeString("0100000102" + "0473697465" + "000970617373" + "0a776f7264")
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected %x but got %x", expected, data)
+	}
+
+	decoded := &Hello{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *h {
+		t.Errorf("Expected %+v but got %+v", h, decoded)
+	}
+
+	// Truncated and overlong payloads are rejected
+	for _, bad := range [][]byte{data[:5], data[:len(data)-1], append(data, 0)} {
+		if err := decoded.UnmarshalBinary(bad); err != ErrInvalidPayload {
+			t.Errorf("Expected ErrInvalidPayload for %x, got %v", bad, err)
+		}
+	}
+}
+
+func TestHelloReplyEncoding(t *testing.T) {
+	r := &HelloReply{Status: StatusVersionNotSupported, Version: 1, Reason: "too old"}
+	data, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &HelloReply{}
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *r {
+		t.Errorf("Expected %+v but got %+v", r, decoded)
+	}
+	if err := decoded.UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidPayload {
+		t.Errorf("Expected ErrInvalidPayload, got %v", err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	// Newer clients are downgraded to the version of this package
+	reply := Negotiate(&Hello{Version: Version + 1, Capabilities: ^Capability(0)})
+	if !reply.Accepts() || reply.Version != Version || reply.Capabilities != Capabilities {
+		t.Errorf("Expected the session to be downgraded, got %+v", reply)
+	}
+
+	// Clients older than the minimum version are rejected
+	if MinVersion > 0 {
+		reply = Negotiate(&Hello{Version: MinVersion - 1})
+		if reply.Accepts() || reply.Status != StatusVersionNotSupported || reply.Reason == "" {
+			t.Errorf("Expected the session to be rejected, got %+v", reply)
+		}
+	}
+
+	// Replies with versions which are not understood cannot be spoken with
+	if (&HelloReply{Status: StatusOK, Version: Version + 1}).Accepts() {
+		t.Errorf("Expected a newer version not to be accepted")
+	}
+}
+
+func TestDataMessage(t *testing.T) {
+	d := &Data{Sequence: 7, Captured: time.Unix(1500000000, 123), Frame: []byte{0xaa}}
+	m := d.Message(2, CapTimestamps|CapAck)
+	expected, _ := hex.DecodeString("14d1120d7b16007b" + "0000000000000007" + "aa")
+	if m.Type != MsgData || m.Stream != 2 || !bytes.Equal(m.Payload, expected) {
+		t.Errorf("Expected payload %x but got %x", expected, m.Payload)
+	}
+	decoded, err := m.Data(CapTimestamps | CapAck)
+	if err != nil || decoded.Sequence != 7 || !decoded.Captured.Equal(d.Captured) || !bytes.Equal(decoded.Frame, d.Frame) {
+		t.Errorf("Expected %+v but got %+v (%v)", d, decoded, err)
+	}
+
+	// Sessions without optional features carry the frame alone
+	m = d.Message(2, 0)
+	decoded, err = m.Data(0)
+	if err != nil || !bytes.Equal(m.Payload, []byte{0xaa}) || decoded.Sequence != 0 || !decoded.Captured.IsZero() {
+		t.Errorf("Expected frame aa alone, got %+v (%v)", decoded, err)
+	}
+	if _, err := m.Data(CapAck); err != ErrInvalidPayload {
+		t.Errorf("Expected ErrInvalidPayload, got %v", err)
+	}
+}
+
+func TestOpenMessage(t *testing.T) {
+	o := &Open{Channel: 3, Site: "dvr-1"}
+	m, err := o.Message(2, CapSites)
+	if err != nil || m.Type != MsgOpen || m.Stream != 2 || !bytes.Equal(m.Payload, []byte("\x03dvr-1")) {
+		t.Fatalf("Expected payload 03 followed by the site, got %x (%v)", m.Payload, err)
+	}
+	decoded, err := m.Open(CapSites)
+	if err != nil || *decoded != *o {
+		t.Errorf("Expected %+v but got %+v (%v)", o, decoded, err)
+	}
+	if _, err := m.Open(0); err != ErrInvalidPayload {
+		t.Errorf("Expected ErrInvalidPayload, got %v", err)
+	}
+
+	// Sessions without CapSites open the channels of the client ID only
+	if _, err := o.Message(2, 0); err != ErrInvalidPayload {
+		t.Errorf("Expected ErrInvalidPayload, got %v", err)
+	}
+	m, err = (&Open{Channel: 3}).Message(2, CapSites)
+	if err != nil || !bytes.Equal(m.Payload, []byte{3}) {
+		t.Errorf("Expected payload 03, got %x (%v)", m.Payload, err)
+	}
+	if channel, err := m.Channel(); err != nil || channel != 3 {
+		t.Errorf("Expected channel 3 but got %d (%v)", channel, err)
+	}
+}
+
+func TestValidSite(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"home": true, "dvr-1.garage_2": true, "": false, ".": false, "..": false, "a/b": false, "a b": false,
+		"caf\u00e9": false, strings.Repeat("a", 255): true, strings.Repeat("a", 256): false,
+	} {
+		if ValidSite(name) != valid {
+			t.Errorf("Expected ValidSite(%q) to be %v", name, valid)
+		}
+	}
+}
+
+func TestAckMessage(t *testing.T) {
+	seq, err := AckMessage(3, 1<<40).Sequence()
+	if err != nil || seq != 1<<40 {
+		t.Errorf("Expected sequence %d but got %d (%v)", uint64(1<<40), seq, err)
+	}
+	if _, err := (&Message{Type: MsgAck, Payload: []byte{1}}).Sequence(); err != ErrInvalidPayload {
+		t.Errorf("Expected ErrInvalidPayload, got %v", err)
+	}
+}
+
+func TestEnrollment(t *testing.T) {
+	e := &Enrollment{Token: "secret", Request: []byte("request")}
+	m, err := e.Message()
+	if err != nil || m.Type != MsgEnroll {
+		t.Fatalf("Expected a MsgEnroll message, got %+v (%v)", m, err)
+	}
+	decoded := &Enrollment{}
+	if err := decoded.UnmarshalBinary(m.Payload); err != nil || decoded.Token != "secret" ||
+		string(decoded.Request) != "request" {
+		t.Errorf("Expected %+v but got %+v (%v)", e, decoded, err)
+	}
+	if err := decoded.UnmarshalBinary([]byte{0, 9, 's'}); err != ErrInvalidPayload {
+		t.Errorf("Expected ErrInvalidPayload, got %v", err)
+	}
+}
+
+func TestEnrollmentReply(t *testing.T) {
+	r := &EnrollmentReply{Status: StatusOK, Certificate: []byte("cert"), CA: []byte("ca")}
+	m, err := r.Message()
+	if err != nil || m.Type != MsgEnrollReply {
+		t.Fatalf("Expected a MsgEnrollReply message, got %+v (%v)", m, err)
+	}
+	decoded := &EnrollmentReply{}
+	if err := decoded.UnmarshalBinary(m.Payload); err != nil || decoded.Status != StatusOK ||
+		string(decoded.Certificate) != "cert" || string(decoded.CA) != "ca" || decoded.Reason != "" {
+		t.Errorf("Expected %+v but got %+v (%v)", r, decoded, err)
+	}
+
+	// Refusals carry a reason and no certificates
+	m, _ = (&EnrollmentReply{Status: StatusUnauthorized, Reason: "expired"}).Message()
+	if err := decoded.UnmarshalBinary(m.Payload); err != nil || decoded.Reason != "expired" ||
+		len(decoded.Certificate) != 0 {
+		t.Errorf("Expected a refusal, got %+v (%v)", decoded, err)
+	}
+	if err := decoded.UnmarshalBinary(m.Payload[:4]); err != ErrInvalidPayload {
+		t.Errorf("Expected ErrInvalidPayload, got %v", err)
+	}
+}